@@ -1,20 +1,46 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	//"github.com/davecgh/go-spew/spew"
 	"github.com/jawher/mow.cli"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+	"gopkg.in/yaml.v2"
 
 	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/cache"
+	"github.com/jondlm/ankh/internal/diff"
+	"github.com/jondlm/ankh/internal/graph"
 	"github.com/jondlm/ankh/internal/helm"
+	"github.com/jondlm/ankh/internal/history"
 	"github.com/jondlm/ankh/internal/kubectl"
+	"github.com/jondlm/ankh/internal/lint"
+	"github.com/jondlm/ankh/internal/runner"
+	"github.com/jondlm/ankh/internal/script"
+	"github.com/jondlm/ankh/internal/secrets"
+	"github.com/jondlm/ankh/internal/values"
+	"github.com/jondlm/ankh/internal/workdir"
 )
 
 var log = logrus.New()
 
+// r runs the helm and kubectl binaries
+var r runner.Runner = runner.Exec{}
+
 func main() {
 	formatter := logrus.TextFormatter{
 		DisableTimestamp: true,
@@ -24,40 +50,162 @@ func main() {
 	log.Formatter = &formatter
 
 	app := cli.App("ankh", "AppNexus Kubernetes Helper")
-	app.Spec = ""
+	app.Spec = "[--ankh-config] [--context] [--parallelism] [--timings] [--keep-workdir] [--secrets-key]"
+
+	var (
+		ankhConfigPaths = app.String(cli.StringOpt{
+			Name:   "ankh-config",
+			Desc:   "Colon separated list of ankh config files to merge, later files take precedence (default \"" + ankh.AnkhConfigPath + "\")",
+			EnvVar: "ANKH_CONFIG",
+		})
+		contextOverride = app.String(cli.StringOpt{
+			Name:   "context",
+			Desc:   "Context from the ankh config to use for this run instead of `current_context`",
+			EnvVar: "ANKH_CONTEXT",
+		})
+		parallelism = app.Int(cli.IntOpt{
+			Name:   "parallelism",
+			Desc:   "How many charts to template at once",
+			Value:  runtime.NumCPU(),
+			EnvVar: "ANKH_PARALLELISM",
+		})
+		timings = app.Bool(cli.BoolOpt{
+			Name: "timings",
+			Desc: "Print how long each chart took to template",
+		})
+		keep = app.Bool(cli.BoolOpt{
+			Name:   "keep-workdir",
+			Desc:   "Keep the working directory with the templated charts and values files after the run and print its path",
+			EnvVar: "ANKH_KEEP_WORKDIR",
+		})
+		secretsKey = app.String(cli.StringOpt{
+			Name:   "secrets-key",
+			Desc:   "Key file used to decrypt secrets files (default \"" + ankh.SecretsKeyPath + "\")",
+			EnvVar: "ANKH_SECRETS_KEY",
+		})
+	)
+
+	app.Before = func() {
+		ankh.AnkhConfigPaths = ankh.SplitConfigPaths(*ankhConfigPaths)
+		helm.Parallelism = *parallelism
+		helm.Timings = *timings
+		keepWorkdir = *keep
+		if *secretsKey != "" {
+			ankh.SecretsKeyPath = *secretsKey
+		}
+		logrus.RegisterExitHandler(failedRun)
+	}
 
 	app.Command("apply", "Deploy an ankh file to a kubernetes cluster", func(cmd *cli.Cmd) {
 
-		cmd.Spec = "[-f]"
+		cmd.Spec = "[-f] [--dry-run | --server-dry-run] [--allow-unlocked]"
 
 		var (
-			filename = cmd.StringOpt("f filename", "ankh.yaml", "Config file name")
+			filename      = cmd.StringOpt("f filename", "ankh.yaml", "Config file name")
+			dryRun        = cmd.BoolOpt("dry-run", false, "Have kubectl validate the manifests locally without changing the cluster")
+			serverDryRun  = cmd.BoolOpt("server-dry-run", false, "Have the api server validate the manifests without persisting them")
+			allowUnlocked = cmd.BoolOpt("allow-unlocked", false, "Run even if an ankh.lock is missing or out of date")
 		)
 
 		cmd.Action = func() {
-			ankhConfig, err := ankh.GetAnkhConfig()
+			ankhConfig, err := ankh.GetAnkhConfig(*contextOverride)
 			check(err)
 
 			config, err := ankh.ProcessAnkhFile(filename)
 			check(err)
 
-			helmOutput, err := helm.Template(log, config, ankhConfig)
+			checkLocks(config, *allowUnlocked)
+
+			chartOutputs, err := helm.TemplateCharts(log, r, config, ankhConfig)
+			check(err)
+			helmOutput := helm.Join(chartOutputs)
+
+			kubectlArgs := []string{}
+			dryRunMode := ""
+			switch {
+			case *dryRun:
+				dryRunMode = kubectl.DryRunClient
+			case *serverDryRun:
+				dryRunMode = kubectl.DryRunServer
+			}
+			isDryRun := dryRunMode != ""
+			if isDryRun {
+				kubectlArgs = kubectl.DryRunArgs(dryRunMode)
+			}
+
+			redactor := helm.Redactor(chartOutputs)
+			kubectlOutput := ""
+			if isDryRun {
+				log.Info("dry run, skipping bootstrap scripts")
+			} else {
+				err = script.RunBootstrap(log, r, config, ankhConfig)
+			}
+
+			if err == nil {
+				action := kubectl.Apply
+				log.Info("starting kubectl")
+				kubectlOutput, err = kubectl.Execute(log, r, redactor, action, helmOutput, config, ankhConfig, kubectlArgs...)
+			}
+
+			recordApply(config, ankhConfig, chartOutputs, helmOutput, dryRunMode, kubectlOutput, err)
+			if err != nil {
+				check(fmt.Errorf("%s", redactor.Redact(err.Error())))
+			}
+
+			log.Info(redactor.Redact(helmOutput))
+			if isDryRun {
+				log.Info("dry run complete, nothing was changed")
+			} else {
+				log.Info("complete")
+			}
+			finish(0)
+		}
+	})
+
+	app.Command("delete", "Delete everything an ankh file deployed from a kubernetes cluster", func(cmd *cli.Cmd) {
+
+		cmd.Spec = "[-f] [-y]"
+
+		var (
+			filename = cmd.StringOpt("f filename", "ankh.yaml", "Config file name")
+			yes      = cmd.BoolOpt("y yes", false, "Skip the confirmation prompt")
+		)
+
+		cmd.Action = func() {
+			ankhConfig, err := ankh.GetAnkhConfig(*contextOverride)
+			check(err)
+
+			config, err := ankh.ProcessAnkhFile(filename)
 			check(err)
 
-			action := kubectl.Apply
-			log.Info("starting kubectl")
-			kubectlOutput, err := kubectl.Execute(action, helmOutput, config, ankhConfig)
+			if !*yes && !confirm(fmt.Sprintf("Delete everything in %s from kube context '%s'?", config.Path, ankhConfig.CurrentContext.KubeContext)) {
+				log.Info("aborting, nothing was deleted")
+				os.Exit(1)
+			}
+
+			chartOutputs, err := helm.TemplateChartsReverse(log, r, config, ankhConfig)
 			check(err)
+			helmOutput := helm.Join(chartOutputs)
+
+			check(script.RunPreDelete(log, r, config, ankhConfig))
+
+			if strings.TrimSpace(helmOutput) == "" {
+				log.Info("nothing to delete")
+			} else {
+				action := kubectl.Delete
+				log.Info("starting kubectl")
+				_, err := kubectl.Execute(log, r, helm.Redactor(chartOutputs), action, helmOutput, config, ankhConfig)
+				check(err)
+			}
 
-			fmt.Println(kubectlOutput)
+			check(script.RunTeardown(log, r, config, ankhConfig))
 
-			log.Info(helmOutput)
 			log.Info("complete")
-			os.Exit(0)
+			finish(0)
 		}
 	})
 
-	app.Command("template", "Output the results of templating an ankh file", func(cmd *cli.Cmd) {
+	app.Command("diff", "Show what applying an ankh file would change in a kubernetes cluster, exits 1 if there are changes and 2 on errors", func(cmd *cli.Cmd) {
 
 		cmd.Spec = "[-f]"
 
@@ -66,28 +214,742 @@ func main() {
 		)
 
 		cmd.Action = func() {
-			ankhConfig, err := ankh.GetAnkhConfig()
+			ankhConfig, err := ankh.GetAnkhConfig(*contextOverride)
+			checkDiff(err)
+
+			config, err := ankh.ProcessAnkhFile(filename)
+			checkDiff(err)
+
+			chartOutputs, err := helm.TemplateCharts(log, r, config, ankhConfig)
+			checkDiff(err)
+
+			color := terminal.IsTerminal(int(os.Stdout.Fd()))
+			redactor := helm.Redactor(chartOutputs)
+			getter := kubectl.NewGetter(r, ankhConfig)
+			changed := false
+
+			for _, chartOutput := range chartOutputs {
+				log.Infof("diffing chart '%s' from %s", chartOutput.ChartName, chartOutput.AnkhFilePath)
+
+				diffs, err := kubectl.Diff(getter, chartOutput.Output, chartOutput.Namespace)
+				checkDiff(err)
+
+				for _, d := range diffs {
+					if d.Diff == "" {
+						continue
+					}
+					changed = true
+
+					if color {
+						fmt.Print(diff.Colorize(redactor.Redact(d.Diff)))
+					} else {
+						fmt.Print(redactor.Redact(d.Diff))
+					}
+				}
+			}
+
+			if changed {
+				log.Info("complete, changes found")
+				finish(1)
+			}
+
+			log.Info("complete, no changes")
+			finish(0)
+		}
+	})
+
+	app.Command("template", "Output the results of templating an ankh file", func(cmd *cli.Cmd) {
+
+		cmd.Spec = "[-f] [--allow-unlocked]"
+
+		var (
+			filename      = cmd.StringOpt("f filename", "ankh.yaml", "Config file name")
+			allowUnlocked = cmd.BoolOpt("allow-unlocked", false, "Run even if an ankh.lock is missing or out of date")
+		)
+
+		cmd.Action = func() {
+			ankhConfig, err := ankh.GetAnkhConfig(*contextOverride)
 			check(err)
 
 			config, err := ankh.ProcessAnkhFile(filename)
 			check(err)
 
+			checkLocks(config, *allowUnlocked)
+
 			log.Info("starting helm template")
-			helmOutput, err := helm.Template(log, config, ankhConfig)
+			helmOutput, err := helm.Template(log, r, config, ankhConfig)
 			check(err)
 
 			fmt.Println(helmOutput)
 			log.Info("complete")
+			finish(0)
+		}
+	})
+
+	app.Command("values", "Show the values a chart is templated with", func(cmd *cli.Cmd) {
+
+		cmd.Spec = "[-f] [--chart] [--explain]"
+
+		var (
+			filename  = cmd.StringOpt("f filename", "ankh.yaml", "Config file name")
+			chartName = cmd.StringOpt("chart", "", "Chart to show the values of, needed when the ankh file has more than one")
+			explain   = cmd.BoolOpt("explain", false, "Annotate every value with the layer and file that set it")
+		)
+
+		cmd.Action = func() {
+			ankhConfig, err := ankh.GetAnkhConfig(*contextOverride)
+			check(err)
+
+			config, err := ankh.ProcessAnkhFile(filename)
+			check(err)
+
+			layers, err := helm.ChartValues(log, config, ankhConfig, *chartName)
+			check(err)
+
+			merged, err := values.Merge(layers)
+			check(err)
+
+			out, err := merged.YAML(*explain)
+			check(err)
+
+			fmt.Print(out)
+			finish(0)
+		}
+	})
+
+	app.Command("lint", "Check the config and every ankh file in the tree without contacting a registry or a cluster, exits 1 if there are problems", func(cmd *cli.Cmd) {
+
+		cmd.Spec = "[-f] [-o]"
+
+		var (
+			filename = cmd.StringOpt("f filename", "ankh.yaml", "Config file name")
+			format   = cmd.StringOpt("o output", lint.FormatText, "Output format, one of text or json")
+		)
+
+		cmd.Action = func() {
+			if *format == lint.FormatJSON {
+				// keep stdout for the report
+				log.Out = os.Stderr
+			}
+
+			report := lint.Lint(log, *filename, *contextOverride)
+
+			out, err := report.Format(*format)
+			check(err)
+
+			fmt.Print(out)
+			if len(report.Findings) > 0 {
+				log.Errorf("found %d problem(s)", len(report.Findings))
+				finish(1)
+			}
+
+			log.Info("no problems found")
+			finish(0)
+		}
+	})
+
+	app.Command("lock", "Pin the charts of an ankh file and its dependencies in ankh.lock files", func(cmd *cli.Cmd) {
+
+		cmd.Spec = "[-f] [--update]"
+
+		var (
+			filename = cmd.StringOpt("f filename", "ankh.yaml", "Config file name")
+			update   = cmd.BoolOpt("update", false, "Resolve every chart again instead of keeping existing entries")
+		)
+
+		cmd.Action = func() {
+			ankhConfig, err := ankh.GetAnkhConfig(*contextOverride)
+			check(err)
+
+			config, err := ankh.ProcessAnkhFile(filename)
+			check(err)
+
+			check(helm.Lock(log, config, ankhConfig, *update))
+
+			log.Info("complete")
+			os.Exit(0)
+		}
+	})
+
+	app.Command("graph", "Draw the dependency tree of an ankh file", func(cmd *cli.Cmd) {
+
+		cmd.Spec = "[-f] [-o]"
+
+		var (
+			filename = cmd.StringOpt("f filename", "ankh.yaml", "Config file name")
+			format   = cmd.StringOpt("o output", graph.FormatText, "Output format, one of text, dot or mermaid")
+		)
+
+		cmd.Action = func() {
+			config, err := ankh.ProcessAnkhFile(filename)
+			check(err)
+
+			out, err := graph.Render(config, *format)
+			check(err)
+
+			fmt.Print(out)
+			os.Exit(0)
+		}
+	})
+
+	app.Command("cache", "Manage the local cache of downloaded charts", func(cmd *cli.Cmd) {
+
+		cmd.Command("list", "List cached charts", func(cmd *cli.Cmd) {
+			cmd.Action = func() {
+				entries, err := cache.New(ankh.ChartCacheDir).List()
+				check(err)
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "NAME\tVERSION\tSIZE\tLAST USED\tDIGEST")
+				for _, entry := range entries {
+					fmt.Fprintf(w, "%s\t%s\t%d\t%s\tsha256:%s\n", entry.Name, entry.Version, entry.Size, entry.LastUsed.Format(time.RFC3339), entry.Digest)
+				}
+				w.Flush()
+
+				os.Exit(0)
+			}
+		})
+
+		cmd.Command("prune", "Remove cached charts that haven't been used recently", func(cmd *cli.Cmd) {
+
+			cmd.Spec = "[--max-age]"
+
+			var (
+				maxAge = cmd.StringOpt("max-age", "720h", "Remove charts that haven't been used for this long")
+			)
+
+			cmd.Action = func() {
+				age, err := time.ParseDuration(*maxAge)
+				check(err)
+
+				removed, err := cache.New(ankh.ChartCacheDir).Prune(age)
+				check(err)
+
+				for _, entry := range removed {
+					log.Infof("removed %s-%s", entry.Name, entry.Version)
+				}
+				log.Infof("pruned %d chart(s)", len(removed))
+				os.Exit(0)
+			}
+		})
+
+		cmd.Command("clear", "Remove every cached chart", func(cmd *cli.Cmd) {
+			cmd.Action = func() {
+				check(cache.New(ankh.ChartCacheDir).Clear())
+
+				log.Infof("cleared %s", ankh.ChartCacheDir)
+				os.Exit(0)
+			}
+		})
+	})
+
+	app.Command("history", "Show the history of applies", func(cmd *cli.Cmd) {
+
+		cmd.Spec = "[--ankh-context] [--namespace] [--file] [--user] [--since] [--failed] [-n]"
+
+		var (
+			filterContext = cmd.StringOpt("ankh-context", "", "Only show applies to this ankh context")
+			namespace     = cmd.StringOpt("namespace", "", "Only show applies to this namespace")
+			file          = cmd.StringOpt("file", "", "Only show applies of this ankh file")
+			username      = cmd.StringOpt("user", "", "Only show applies by this user")
+			since         = cmd.StringOpt("since", "", "Only show applies within this long, e.g. 24h")
+			failed        = cmd.BoolOpt("failed", false, "Only show failed applies")
+			limit         = cmd.IntOpt("n limit", 20, "Show at most this many of the newest applies, 0 for all")
+		)
+
+		cmd.Action = func() {
+			filter := history.Filter{
+				Context:   *filterContext,
+				Namespace: *namespace,
+				User:      *username,
+				Failed:    *failed,
+				Limit:     *limit,
+			}
+			if *file != "" {
+				path, err := filepath.Abs(*file)
+				check(err)
+				filter.AnkhFile = path
+			}
+			if *since != "" {
+				age, err := time.ParseDuration(*since)
+				check(err)
+				filter.Since = time.Now().Add(-age)
+			}
+
+			records, err := history.New(ankh.HistoryDir).List(filter)
+			check(err)
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tTIME\tUSER\tCONTEXT\tNAMESPACE\tSTATUS\tANKH FILE")
+			for _, rec := range records {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", rec.ID, rec.Time.Local().Format(time.RFC3339), rec.User, rec.Context, rec.Namespace, historyStatus(rec), rec.AnkhFile)
+			}
+			w.Flush()
+
+			os.Exit(0)
+		}
+
+		cmd.Command("show", "Print the manifest stored with an apply", func(cmd *cli.Cmd) {
+
+			cmd.Spec = "ID"
+
+			var (
+				id = cmd.StringArg("ID", "", "Id of the apply, or a unique prefix of it")
+			)
+
+			cmd.Action = func() {
+				store := history.New(ankh.HistoryDir)
+				rec, err := store.Get(*id)
+				check(err)
+
+				manifest, err := store.Manifest(rec)
+				check(err)
+
+				// the details are yaml comments so the output can still be fed
+				// to kubectl
+				fmt.Printf("# id: %s\n", rec.ID)
+				fmt.Printf("# time: %s\n", rec.Time.Local().Format(time.RFC3339))
+				fmt.Printf("# user: %s\n", rec.User)
+				fmt.Printf("# context: %s (kube context %s)\n", rec.Context, rec.KubeContext)
+				fmt.Printf("# namespace: %s\n", rec.Namespace)
+				fmt.Printf("# ankh file: %s\n", rec.AnkhFile)
+				for _, chart := range rec.Charts {
+					fmt.Printf("# chart: %s %s (%s)\n", chart.Name, chart.Version, chart.AnkhFile)
+				}
+				fmt.Printf("# manifest digest: %s\n", rec.ManifestDigest)
+				fmt.Printf("# status: %s\n", historyStatus(rec))
+				if rec.Error != "" {
+					fmt.Printf("# error: %s\n", strings.Replace(rec.Error, "\n", "\n#   ", -1))
+				}
+				fmt.Print(manifest)
+				os.Exit(0)
+			}
+		})
+	})
+
+	app.Command("secrets", "Manage encrypted secrets files", func(cmd *cli.Cmd) {
+
+		cmd.Command("keygen", "Create a key for decrypting secrets files and print its public key", func(cmd *cli.Cmd) {
+			cmd.Action = func() {
+				identity, err := secrets.GenerateIdentity()
+				check(err)
+				check(secrets.WriteIdentity(ankh.SecretsKeyPath, identity))
+
+				// only the public key goes to stdout so it can be appended
+				// straight to a recipients file
+				fmt.Fprintf(os.Stderr, "wrote %s, add this public key to the `%s` file next to your secrets files:\n", ankh.SecretsKeyPath, secrets.RecipientsFile)
+				fmt.Println(identity.Recipient())
+				os.Exit(0)
+			}
+		})
+
+		cmd.Command("encrypt", "Encrypt a secrets file to the public keys in the recipients file next to it", func(cmd *cli.Cmd) {
+
+			cmd.Spec = "[-i] FILE"
+
+			var (
+				inPlace = cmd.BoolOpt("i in-place", false, "Replace the file instead of printing the result")
+				file    = cmd.StringArg("FILE", "", "Secrets file to encrypt")
+			)
+
+			cmd.Action = func() {
+				plaintext, err := ioutil.ReadFile(*file)
+				check(err)
+				if secrets.IsEncrypted(plaintext) {
+					check(fmt.Errorf("%s is already encrypted", *file))
+				}
+				_, err = secrets.Values(plaintext)
+				check(err)
+
+				recipients, err := secrets.FindRecipients(*file)
+				check(err)
+
+				encrypted, err := secrets.Encrypt(plaintext, recipients)
+				check(err)
+
+				writeSecretsOutput(*file, encrypted, *inPlace)
+				os.Exit(0)
+			}
+		})
+
+		cmd.Command("decrypt", "Decrypt a secrets file", func(cmd *cli.Cmd) {
+
+			cmd.Spec = "[-i] FILE"
+
+			var (
+				inPlace = cmd.BoolOpt("i in-place", false, "Replace the file instead of printing the result")
+				file    = cmd.StringArg("FILE", "", "Secrets file to decrypt")
+			)
+
+			cmd.Action = func() {
+				plaintext := decryptSecretsFile(*file)
+				writeSecretsOutput(*file, plaintext, *inPlace)
+				os.Exit(0)
+			}
+		})
+
+		cmd.Command("edit", "Edit a secrets file in $EDITOR, creating it if it doesn't exist", func(cmd *cli.Cmd) {
+
+			cmd.Spec = "FILE"
+
+			var (
+				file = cmd.StringArg("FILE", "", "Secrets file to edit")
+			)
+
+			cmd.Action = func() {
+				check(editSecretsFile(*file))
+				os.Exit(0)
+			}
+		})
+	})
+
+	app.Command("gc", "Remove working directories left behind in "+ankh.DataRootDir+" by failed or kept runs", func(cmd *cli.Cmd) {
+
+		cmd.Spec = "[--max-age] [--max-count] [--all]"
+
+		var (
+			maxAge   = cmd.StringOpt("max-age", workdir.DefaultMaxAge.String(), "Remove working directories older than this")
+			maxCount = cmd.IntOpt("max-count", workdir.DefaultMaxCount, "Keep at most this many of the newest working directories")
+			all      = cmd.BoolOpt("all", false, "Remove every working directory")
+		)
+
+		cmd.Action = func() {
+			age, err := time.ParseDuration(*maxAge)
+			check(err)
+
+			policy := workdir.Policy{MaxAge: age, MaxCount: *maxCount}
+			if *all {
+				policy = workdir.Policy{MaxAge: -1}
+			}
+
+			removed, err := workdir.GC(ankh.DataRootDir, "", policy)
+			check(err)
+
+			for _, d := range removed {
+				log.Infof("removed %s", d.Path)
+			}
+			log.Infof("removed %d working dir(s)", len(removed))
 			os.Exit(0)
 		}
 	})
 
+	app.Command("config", "Inspect and switch between the contexts in the ankh config", func(cmd *cli.Cmd) {
+
+		cmd.Command("get-contexts", "List the contexts in the ankh config", func(cmd *cli.Cmd) {
+			cmd.Action = func() {
+				ankhConfig, err := ankh.ReadAnkhConfigs(ankh.AnkhConfigPaths)
+				check(err)
+
+				if *contextOverride != "" {
+					ankhConfig.CurrentContextName = *contextOverride
+				}
+
+				names := []string{}
+				for name := range ankhConfig.Contexts {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "CURRENT\tNAME\tKUBE CONTEXT\tENVIRONMENT\tRESOURCE PROFILE")
+				for _, name := range names {
+					ctx := ankhConfig.Contexts[name]
+					current := ""
+					if name == ankhConfig.CurrentContextName {
+						current = "*"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", current, name, ctx.KubeContext, ctx.Environment, ctx.ResourceProfile)
+				}
+				w.Flush()
+
+				os.Exit(0)
+			}
+		})
+
+		cmd.Command("use-context", "Switch the current context in the ankh config", func(cmd *cli.Cmd) {
+
+			cmd.Spec = "CONTEXT"
+
+			var (
+				name = cmd.StringArg("CONTEXT", "", "Name of the context to switch to")
+			)
+
+			cmd.Action = func() {
+				check(ankh.SwitchContext(ankh.AnkhConfigPaths, *name))
+
+				log.Infof("switched to context '%s'", *name)
+				os.Exit(0)
+			}
+		})
+
+		cmd.Command("view", "Print the resolved current context", func(cmd *cli.Cmd) {
+			cmd.Action = func() {
+				ankhConfig, err := ankh.GetAnkhConfig(*contextOverride)
+				check(err)
+
+				ctx := ankhConfig.CurrentContext
+				ctx.HelmRegistryPassword = redact(ctx.HelmRegistryPassword)
+				ctx.HelmRegistryToken = redact(ctx.HelmRegistryToken)
+
+				out, err := yaml.Marshal(ctx)
+				check(err)
+
+				fmt.Print(string(out))
+				os.Exit(0)
+			}
+		})
+	})
+
 	app.Run(os.Args)
 }
 
+// keepWorkdir is set by --keep-workdir
+var keepWorkdir bool
+
+// finish exits after a successful run, removing the run's working directory
+// unless it's being kept, and cleaning up after older runs
+func finish(code int) {
+	switch {
+	case ankh.AnkhDataDir == "":
+		// nothing needed a working directory
+	case keepWorkdir:
+		log.Infof("kept the working directory %s", ankh.AnkhDataDir)
+	default:
+		if err := workdir.Remove(ankh.AnkhDataDir); err != nil {
+			log.Warnf("unable to remove the working directory %s: %v", ankh.AnkhDataDir, err)
+		}
+	}
+
+	gc()
+	os.Exit(code)
+}
+
+// failedRun runs when ankh exits through log.Fatal. The working directory is
+// kept for debugging, and removed later by gc once it's old enough.
+func failedRun() {
+	if _, err := os.Stat(ankh.AnkhDataDir); ankh.AnkhDataDir != "" && err == nil {
+		log.Infof("the working directory of this run was kept at %s", ankh.AnkhDataDir)
+	}
+	gc()
+}
+
+// gc applies the default retention policy to the working directories of
+// earlier runs
+func gc() {
+	removed, err := workdir.GC(ankh.DataRootDir, ankh.AnkhDataDir, workdir.DefaultPolicy)
+	if err != nil {
+		log.Warnf("unable to clean up old working directories: %v", err)
+		return
+	}
+	for _, d := range removed {
+		log.Debugf("removed old working directory %s", d.Path)
+	}
+}
+
+// decryptSecretsFile decrypts a secrets file with the key at
+// ankh.SecretsKeyPath
+func decryptSecretsFile(path string) []byte {
+	encrypted, err := ioutil.ReadFile(path)
+	check(err)
+	if !secrets.IsEncrypted(encrypted) {
+		check(fmt.Errorf("%s isn't encrypted", path))
+	}
+
+	identities, err := secrets.ReadIdentities(ankh.SecretsKeyPath)
+	check(err)
+
+	plaintext, err := secrets.Decrypt(encrypted, identities)
+	check(err)
+	return plaintext
+}
+
+// writeSecretsOutput prints the result of encrypting or decrypting a secrets
+// file, or replaces the file with it
+func writeSecretsOutput(path string, contents []byte, inPlace bool) {
+	if !inPlace {
+		os.Stdout.Write(contents)
+		return
+	}
+
+	info, err := os.Stat(path)
+	check(err)
+	check(ioutil.WriteFile(path, contents, info.Mode().Perm()))
+	log.Infof("wrote %s", path)
+}
+
+// editSecretsFile decrypts a secrets file into a private temp dir, opens it
+// in $EDITOR and encrypts the result back. The plain text copy is removed
+// afterwards no matter what.
+func editSecretsFile(path string) error {
+	// age files don't say who they're encrypted to, so the recipients file
+	// has to be there even for existing files
+	recipients, err := secrets.FindRecipients(path)
+	if err != nil {
+		return err
+	}
+
+	plaintext := []byte{}
+	if _, err := os.Stat(path); err == nil {
+		plaintext = decryptSecretsFile(path)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "ankh-secrets-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpPath := filepath.Join(tmpDir, filepath.Base(path))
+	if err := ioutil.WriteFile(tmpPath, plaintext, 0600); err != nil {
+		return err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	// $EDITOR can carry its own arguments, e.g. `code --wait`
+	editorArgs := append(strings.Fields(editor), tmpPath)
+	if err := r.Run(runner.Command{Args: editorArgs, Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}); err != nil {
+		return fmt.Errorf("editor exited with an error, %s was left unchanged: %v", path, err)
+	}
+
+	edited, err := ioutil.ReadFile(tmpPath)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(edited, plaintext) {
+		log.Infof("no changes, %s was left unchanged", path)
+		return nil
+	}
+	if _, err := secrets.Values(edited); err != nil {
+		return fmt.Errorf("%v, %s was left unchanged", err, path)
+	}
+
+	encrypted, err := secrets.Encrypt(edited, recipients)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, encrypted, 0644); err != nil {
+		return err
+	}
+	log.Infof("wrote %s", path)
+	return nil
+}
+
+// historyStatus summarizes how an apply went
+func historyStatus(rec history.Record) string {
+	status := "ok"
+	if rec.Failed() {
+		status = fmt.Sprintf("failed (%d)", rec.ExitStatus)
+	}
+	if rec.DryRun != "" {
+		status += ", dry run " + rec.DryRun
+	}
+	return status
+}
+
+// recordApply adds an apply to the history. Failing to record it is only
+// worth a warning, the apply itself already happened. Secret values are
+// redacted from everything that's stored, the digest is of the real manifest.
+func recordApply(ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig, chartOutputs []helm.ChartOutput, manifest, dryRunMode, kubectlOutput string, applyErr error) {
+	redactor := helm.Redactor(chartOutputs)
+
+	rec := history.Record{
+		User:           currentUser(),
+		Context:        ankhConfig.CurrentContext.Name,
+		KubeContext:    ankhConfig.CurrentContext.KubeContext,
+		Namespace:      ankhFile.Namespace,
+		AnkhFile:       ankhFile.Path,
+		Charts:         []history.Chart{},
+		ManifestDigest: "sha256:" + history.Digest(manifest),
+		DryRun:         dryRunMode,
+		Result:         redactor.Redact(kubectlOutput),
+	}
+	for _, o := range chartOutputs {
+		rec.Charts = append(rec.Charts, history.Chart{AnkhFile: o.AnkhFilePath, Name: o.ChartName, Version: o.Version})
+	}
+	if applyErr != nil {
+		rec.ExitStatus = runner.ExitCode(applyErr)
+		if kubectlErr, ok := applyErr.(*kubectl.Error); ok {
+			rec.ExitStatus = kubectlErr.ExitCode
+		}
+		rec.Error = redactor.Redact(applyErr.Error())
+	}
+
+	rec, err := history.New(ankh.HistoryDir).Add(rec, redactor.Redact(manifest))
+	if err != nil {
+		log.Warnf("unable to record this apply in the history: %v", err)
+		return
+	}
+	log.Infof("recorded as history entry %s", rec.ID)
+}
+
+// currentUser is who ran ankh, for the history
+func currentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// redact hides a secret from the config unless it's just a reference to an
+// environment variable
+func redact(secret string) string {
+	if secret == "" || strings.HasPrefix(secret, "$") {
+		return secret
+	}
+	return "REDACTED"
+}
+
+// checkLocks stops the run when the ankh.lock files for an ankh file are
+// missing or out of date, unless allowUnlocked is set
+func checkLocks(ankhFile ankh.AnkhFile, allowUnlocked bool) {
+	if err := helm.CheckLocks(ankhFile); err != nil {
+		if !allowUnlocked {
+			check(err)
+		}
+		log.Warnf("continuing without an up to date lock: %v", err)
+	}
+}
+
+// confirm asks the user a yes/no question on stdin and reports whether they
+// answered yes
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N]: ", question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
 func check(err error) {
 	if err != nil {
 		log.Fatal(err)
 		os.Exit(1)
 	}
 }
+
+// diffErrorCode is what `ankh diff` exits with when it fails, so it can't be
+// mistaken for the 1 that means there are changes. It matches `kubectl diff`.
+const diffErrorCode = 2
+
+// checkDiff is check for `ankh diff`
+func checkDiff(err error) {
+	if err != nil {
+		log.Error(err)
+		logrus.Exit(diffErrorCode)
+	}
+}
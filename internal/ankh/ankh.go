@@ -6,15 +6,51 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/jondlm/ankh/internal/util"
+	"github.com/jondlm/ankh/internal/workdir"
 	"gopkg.in/yaml.v2"
 )
 
 var ConfigDir = filepath.Join(os.Getenv("HOME"), ".ankh")
 var AnkhConfigPath = filepath.Join(ConfigDir, "config")
-var AnkhDataDir = filepath.Join(ConfigDir, "data", fmt.Sprintf("%v", time.Now().Unix()))
+
+// AnkhConfigPaths are the config files that get merged together, in order,
+// to make up the ankh config. It defaults to just AnkhConfigPath.
+var AnkhConfigPaths = []string{AnkhConfigPath}
+
+// DataRootDir holds a working directory per run, AnkhDataDir is the one for
+// this run. It's empty until DataDir creates it.
+var DataRootDir = filepath.Join(ConfigDir, "data")
+var AnkhDataDir = ""
+var ChartCacheDir = filepath.Join(ConfigDir, "cache", "charts")
+var IndexCacheDir = filepath.Join(ConfigDir, "cache", "index")
+var HistoryDir = filepath.Join(ConfigDir, "history")
+
+// SecretsKeyPath is the key file used to decrypt secrets files
+var SecretsKeyPath = filepath.Join(ConfigDir, "keys", "secrets.key")
+
+// DataDir returns the working directory of this run, creating it the first
+// time. Every run gets a directory of its own under DataRootDir.
+func DataDir() (string, error) {
+	if AnkhDataDir != "" {
+		if err := os.MkdirAll(AnkhDataDir, 0755); err != nil {
+			return "", fmt.Errorf("unable to make data dir '%s': %v", AnkhDataDir, err)
+		}
+		return AnkhDataDir, nil
+	}
+
+	dir, err := workdir.Create(DataRootDir)
+	if err != nil {
+		return "", fmt.Errorf("unable to make a data dir in '%s': %v", DataRootDir, err)
+	}
+	AnkhDataDir = dir
+	return dir, nil
+}
 
 // Context is a struct that represents a context for applying files to a
 // Kubernetes cluster
@@ -26,6 +62,34 @@ type Context struct {
 	HelmRegistryURL string `yaml:"helm_registry_url"`
 	ClusterAdmin    bool   `yaml:"cluster_admin"`
 	Global          map[string]interface{}
+
+	// HelmRegistryCAFile is a PEM bundle to trust for the registry on top of
+	// the system roots, and HelmRegistryCertFile and HelmRegistryKeyFile are
+	// a client certificate to present to it
+	HelmRegistryCAFile   string `yaml:"helm_registry_ca_file,omitempty"`
+	HelmRegistryCertFile string `yaml:"helm_registry_cert_file,omitempty"`
+	HelmRegistryKeyFile  string `yaml:"helm_registry_key_file,omitempty"`
+	// HelmRegistryInsecure turns off certificate verification for the
+	// registry. Only use it for testing.
+	HelmRegistryInsecure bool `yaml:"helm_registry_insecure,omitempty"`
+
+	// HelmRegistryUsername and HelmRegistryPassword are sent as basic auth,
+	// HelmRegistryToken as a bearer token. Environment variables like
+	// `${REGISTRY_TOKEN}` in them are expanded so the secrets themselves
+	// can stay out of the config. ANKH_HELM_REGISTRY_USERNAME,
+	// ANKH_HELM_REGISTRY_PASSWORD and ANKH_HELM_REGISTRY_TOKEN override
+	// them, and when none are set the netrc file at HelmRegistryNetrc
+	// (default $NETRC or ~/.netrc) is used.
+	HelmRegistryUsername string `yaml:"helm_registry_username,omitempty"`
+	HelmRegistryPassword string `yaml:"helm_registry_password,omitempty"`
+	HelmRegistryToken    string `yaml:"helm_registry_token,omitempty"`
+	HelmRegistryNetrc    string `yaml:"helm_registry_netrc,omitempty"`
+
+	// VaultAddress and VaultNamespace say where `ref+vault://` references in
+	// chart values are looked up. $VAULT_ADDR and $VAULT_NAMESPACE override
+	// them and the token comes from $VAULT_TOKEN or ~/.vault-token.
+	VaultAddress   string `yaml:"vault_address,omitempty"`
+	VaultNamespace string `yaml:"vault_namespace,omitempty"`
 }
 
 // AnkhConfig defines the shape of the ~/.ankh/config file used for global
@@ -76,6 +140,14 @@ func (ankhConfig *AnkhConfig) ValidateAndInit() []error {
 			errors = append(errors, fmt.Errorf("missing or empty `helm_registry_url`"))
 		}
 
+		if (selectedContext.HelmRegistryCertFile == "") != (selectedContext.HelmRegistryKeyFile == "") {
+			errors = append(errors, fmt.Errorf("`helm_registry_cert_file` and `helm_registry_key_file` must be set together"))
+		}
+
+		if selectedContext.HelmRegistryToken != "" && selectedContext.HelmRegistryPassword != "" {
+			errors = append(errors, fmt.Errorf("only one of `helm_registry_token` and `helm_registry_password` can be set"))
+		}
+
 		if selectedContext.KubeContext == "" {
 			errors = append(errors, fmt.Errorf("missing or empty `kube_context`"))
 		}
@@ -88,6 +160,7 @@ func (ankhConfig *AnkhConfig) ValidateAndInit() []error {
 			errors = append(errors, fmt.Errorf("missing or empty `resource_profile`"))
 		}
 
+		selectedContext.Name = ankhConfig.CurrentContextName
 		ankhConfig.CurrentContext = selectedContext
 	}
 
@@ -105,26 +178,71 @@ type Chart struct {
 	ResourceProfiles map[string]interface{} `yaml:"resource_profiles"`
 }
 
+// UnsupportedKeyError is a key in a chart's `values` or `resource_profiles`
+// that isn't in the ankh config's supported environments or resource
+// profiles
+type UnsupportedKeyError struct {
+	Chart string
+	// Field is `values` or `resource_profiles`
+	Field string
+	Key   string
+}
+
+func (e *UnsupportedKeyError) Error() string {
+	kind := "environment"
+	if e.Field == "resource_profiles" {
+		kind = "resource profile"
+	}
+	return fmt.Sprintf("unsupported %s '%s' found in ankh file `%s` for chart '%s'", kind, e.Key, e.Field, e.Chart)
+}
+
 // Validate ensures that a chart is valid and requires a filled out AnkhConfig
-// to do so
+// to do so. It returns the first of Errors.
 func (c *Chart) Validate(ankhConfig AnkhConfig) error {
-	if c.Values != nil {
-		for k := range c.Values {
-			if !util.Contains(ankhConfig.SupportedEnvironments, k) {
-				return fmt.Errorf("unsupported environment '%s' found in ankh file `values` for chart '%s'", k, c.Name)
-			}
+	if errs := c.Errors(ankhConfig); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// Errors returns everything that's wrong with a chart, as
+// *UnsupportedKeyErrors, in a stable order
+func (c *Chart) Errors(ankhConfig AnkhConfig) []error {
+	errs := []error{}
+
+	for _, k := range sortedKeys(c.Values) {
+		if !util.Contains(ankhConfig.SupportedEnvironments, k) {
+			errs = append(errs, &UnsupportedKeyError{Chart: c.Name, Field: "values", Key: k})
 		}
 	}
 
-	if c.ResourceProfiles != nil {
-		for k := range c.ResourceProfiles {
-			if !util.Contains(ankhConfig.SupportedResourceProfiles, k) {
-				return fmt.Errorf("unsupported resource profile '%s' found in ankh file `resource_profiles` for chart '%s'", k, c.Name)
-			}
+	for _, k := range sortedKeys(c.ResourceProfiles) {
+		if !util.Contains(ankhConfig.SupportedResourceProfiles, k) {
+			errs = append(errs, &UnsupportedKeyError{Chart: c.Name, Field: "resource_profiles", Key: k})
 		}
 	}
 
-	return nil
+	return errs
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Script is an executable referenced by the `bootstrap` or `teardown`
+// sections of an ankh file
+type Script struct {
+	// Path to the script, relative paths are resolved against the directory
+	// of the ankh file
+	Path string
+	// Timeout caps how long the script may run, e.g. `30s` or `5m`. Defaults
+	// to script.DefaultTimeout when empty
+	Timeout time.Duration
 }
 
 // AnkhFile defines the shape of the `ankh.yaml` file which is used to define
@@ -134,15 +252,14 @@ type AnkhFile struct {
 	Path string
 
 	Bootstrap struct {
-		Scripts []struct {
-			Path string
-		}
+		Scripts []Script
 	}
 
+	// Teardown scripts run after everything is deleted, apart from
+	// PreDeleteScripts, which run before
 	Teardown struct {
-		Scripts []struct {
-			Path string
-		}
+		PreDeleteScripts []Script `yaml:"pre_delete_scripts"`
+		Scripts          []Script
 	}
 
 	// Array of paths to other ankh.yaml files that should only be run for
@@ -165,24 +282,70 @@ type AnkhFile struct {
 	Charts []Chart
 }
 
+// CycleError is returned by ProcessAnkhFile when ankh files depend on each
+// other in a loop
+type CycleError struct {
+	// Chain holds the absolute path of every file in the loop, starting and
+	// ending with the same file
+	Chain []string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("dependency cycle detected: %s", strings.Join(e.Chain, " -> "))
+}
+
+// ProcessAnkhFile parses an ankh file and all of its dependencies. Files are
+// keyed on their absolute path, so a file that's depended on by several
+// others is only parsed once, and dependency cycles are reported as a
+// *CycleError.
 func ProcessAnkhFile(filename *string) (AnkhFile, error) {
+	p := processor{processed: map[string]AnkhFile{}}
+	return p.process(*filename)
+}
+
+type processor struct {
+	// processed holds every finished file by absolute path
+	processed map[string]AnkhFile
+	// stack is the chain of files currently being processed, used to detect
+	// cycles
+	stack []string
+}
+
+func (p *processor) process(filename string) (AnkhFile, error) {
 	config := AnkhFile{}
-	deployFile, err := ioutil.ReadFile(fmt.Sprintf("%s", *filename))
+
+	absPath, err := filepath.Abs(filename)
 	if err != nil {
 		return config, err
 	}
 
-	err = yaml.UnmarshalStrict(deployFile, &config)
-	if err != nil {
-		return config, fmt.Errorf("unable to process %s file: %v", *filename, err)
+	if processed, ok := p.processed[absPath]; ok {
+		return processed, nil
 	}
 
-	// Add the absolute path of the config to the struct
-	config.Path, err = filepath.Abs(*filename)
+	for i, inProgress := range p.stack {
+		if inProgress == absPath {
+			chain := append(append([]string{}, p.stack[i:]...), absPath)
+			return config, &CycleError{Chain: chain}
+		}
+	}
+
+	p.stack = append(p.stack, absPath)
+	defer func() { p.stack = p.stack[:len(p.stack)-1] }()
+
+	deployFile, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return config, err
 	}
 
+	err = yaml.UnmarshalStrict(deployFile, &config)
+	if err != nil {
+		return config, fmt.Errorf("unable to process %s file: %v", filename, err)
+	}
+
+	// Add the absolute path of the config to the struct
+	config.Path = absPath
+
 	// Recursively process admin dependencies
 	if config.AdminDependencies != nil {
 		if config.AdminDependenciesResolved == nil {
@@ -194,8 +357,11 @@ func ProcessAnkhFile(filename *string) (AnkhFile, error) {
 				c = path.Join(filepath.Dir(config.Path), c, "ankh.yaml")
 			}
 
-			newAdminDependencyResolved, err := ProcessAnkhFile(&c)
+			newAdminDependencyResolved, err := p.process(c)
 			if err != nil {
+				if _, ok := err.(*CycleError); ok {
+					return config, err
+				}
 				return config, fmt.Errorf("unable to process admin dependency: %v", err)
 			}
 
@@ -215,8 +381,11 @@ func ProcessAnkhFile(filename *string) (AnkhFile, error) {
 				c = path.Join(filepath.Dir(config.Path), c, "ankh.yaml")
 			}
 
-			newDependencyResolved, err := ProcessAnkhFile(&c)
+			newDependencyResolved, err := p.process(c)
 			if err != nil {
+				if _, ok := err.(*CycleError); ok {
+					return config, err
+				}
 				return config, fmt.Errorf("unable to process dependency: %v", err)
 			}
 
@@ -224,24 +393,152 @@ func ProcessAnkhFile(filename *string) (AnkhFile, error) {
 		}
 	}
 
+	p.processed[absPath] = config
+
 	return config, nil
 }
 
-func GetAnkhConfig() (AnkhConfig, error) {
+// TopologicalOrder flattens an ankh file and its dependencies into a list
+// where every file comes after everything it depends on. Each file appears
+// once no matter how many files depend on it. Within a file, admin
+// dependencies come before dependencies, and admin dependencies are only
+// followed when includeAdmin is set. Walk the list backwards for the order
+// things should be torn down in.
+func TopologicalOrder(ankhFile AnkhFile, includeAdmin bool) []AnkhFile {
+	ordered := []AnkhFile{}
+	visited := map[string]bool{}
+
+	var visit func(f AnkhFile)
+	visit = func(f AnkhFile) {
+		if visited[f.Path] {
+			return
+		}
+		visited[f.Path] = true
+
+		if includeAdmin {
+			for _, dep := range f.AdminDependenciesResolved {
+				visit(dep)
+			}
+		}
+		for _, dep := range f.DependenciesResovled {
+			visit(dep)
+		}
+
+		ordered = append(ordered, f)
+	}
+	visit(ankhFile)
+
+	return ordered
+}
+
+// ReadAnkhConfig parses the config file at path without validating it
+func ReadAnkhConfig(path string) (AnkhConfig, error) {
 	ankhConfig := AnkhConfig{}
 
-	ankhRcFile, err := ioutil.ReadFile(AnkhConfigPath)
+	ankhRcFile, err := ioutil.ReadFile(path)
 	if err != nil {
-		return ankhConfig, fmt.Errorf("unable to read %s file: %v", AnkhConfigPath, err)
+		return ankhConfig, fmt.Errorf("unable to read %s file: %v", path, err)
 	}
 
-	if err := os.MkdirAll(AnkhDataDir, 0755); err != nil {
-		return ankhConfig, fmt.Errorf("unable to make data dir '%s': %v", AnkhDataDir, err)
+	err = yaml.UnmarshalStrict(ankhRcFile, &ankhConfig)
+	if err != nil {
+		return ankhConfig, fmt.Errorf("unable to process %s file: %v", path, err)
 	}
 
-	err = yaml.UnmarshalStrict(ankhRcFile, &ankhConfig)
+	return ankhConfig, nil
+}
+
+// ExistingConfigPaths returns the config files in paths that exist, in order.
+// Missing files are skipped, so a shared list of configs can name files that
+// only some people have, but it's an error when none of them exist.
+func ExistingConfigPaths(paths []string) ([]string, error) {
+	existing := []string{}
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		existing = append(existing, path)
+	}
+
+	if len(existing) == 0 {
+		return existing, fmt.Errorf("unable to read the ankh config, none of %s exist", strings.Join(paths, ", "))
+	}
+	return existing, nil
+}
+
+// ReadAnkhConfigs parses and merges several config files without validating
+// the result, skipping any that don't exist. Later files override
+// `current_context`, add to `supported_environments` and
+// `supported_resource_profiles`, and add to or replace entries in `contexts`.
+func ReadAnkhConfigs(paths []string) (AnkhConfig, error) {
+	merged := AnkhConfig{}
+
+	paths, err := ExistingConfigPaths(paths)
 	if err != nil {
-		return ankhConfig, fmt.Errorf("unable to process %s file: %v", AnkhConfigPath, err)
+		return merged, err
+	}
+
+	for _, path := range paths {
+		ankhConfig, err := ReadAnkhConfig(path)
+		if err != nil {
+			return merged, err
+		}
+
+		if ankhConfig.CurrentContextName != "" {
+			merged.CurrentContextName = ankhConfig.CurrentContextName
+		}
+
+		for _, env := range ankhConfig.SupportedEnvironments {
+			if !util.Contains(merged.SupportedEnvironments, env) {
+				merged.SupportedEnvironments = append(merged.SupportedEnvironments, env)
+			}
+		}
+
+		for _, profile := range ankhConfig.SupportedResourceProfiles {
+			if !util.Contains(merged.SupportedResourceProfiles, profile) {
+				merged.SupportedResourceProfiles = append(merged.SupportedResourceProfiles, profile)
+			}
+		}
+
+		for name, ctx := range ankhConfig.Contexts {
+			if merged.Contexts == nil {
+				merged.Contexts = map[string]Context{}
+			}
+			merged.Contexts[name] = ctx
+		}
+	}
+
+	return merged, nil
+}
+
+// SplitConfigPaths turns a list of config files separated the same way as
+// $PATH, e.g. `./ankh-config:~/.ankh/config`, into a slice. Empty entries are
+// dropped and an empty list gives AnkhConfigPath.
+func SplitConfigPaths(list string) []string {
+	paths := []string{}
+	for _, p := range filepath.SplitList(list) {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+
+	if len(paths) == 0 {
+		return []string{AnkhConfigPath}
+	}
+	return paths
+}
+
+// GetAnkhConfig reads, validates and initializes the ankh config. A
+// non-empty contextOverride selects that context for this run instead of
+// `current_context`, without touching the file.
+func GetAnkhConfig(contextOverride string) (AnkhConfig, error) {
+	ankhConfig, err := ReadAnkhConfigs(AnkhConfigPaths)
+	if err != nil {
+		return ankhConfig, err
+	}
+
+	if contextOverride != "" {
+		ankhConfig.CurrentContextName = contextOverride
 	}
 
 	errs := ankhConfig.ValidateAndInit()
@@ -251,3 +548,65 @@ func GetAnkhConfig() (AnkhConfig, error) {
 
 	return ankhConfig, nil
 }
+
+var currentContextLine = regexp.MustCompile(`(?m)^current_context:.*$`)
+
+// SwitchContext changes `current_context` in the config. The merged config
+// from paths must pass ValidateAndInit with the new context selected before
+// anything is written. The change goes to the last file that sets
+// `current_context`, since that's the one that wins, or the last file that
+// exists if none do. Only the `current_context` line is touched so comments and formatting
+// elsewhere in the file survive.
+func SwitchContext(paths []string, name string) error {
+	ankhConfig, err := ReadAnkhConfigs(paths)
+	if err != nil {
+		return err
+	}
+
+	ankhConfig.CurrentContextName = name
+	errs := ankhConfig.ValidateAndInit()
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to use context '%s', ankh config validation error(s):\n%s", name, util.MultiErrorFormat(errs))
+	}
+
+	paths, err = ExistingConfigPaths(paths)
+	if err != nil {
+		return err
+	}
+
+	path := paths[len(paths)-1]
+	for _, p := range paths {
+		c, err := ReadAnkhConfig(p)
+		if err != nil {
+			return err
+		}
+		if c.CurrentContextName != "" {
+			path = p
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	nameBytes, err := yaml.Marshal(name)
+	if err != nil {
+		return err
+	}
+	line := "current_context: " + strings.TrimSpace(string(nameBytes))
+
+	var updated []byte
+	if currentContextLine.Match(original) {
+		updated = currentContextLine.ReplaceAllLiteral(original, []byte(line))
+	} else {
+		updated = append([]byte(line+"\n"), original...)
+	}
+
+	return ioutil.WriteFile(path, updated, info.Mode())
+}
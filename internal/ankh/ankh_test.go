@@ -0,0 +1,305 @@
+package ankh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = `# team config
+current_context: dev
+supported_environments: [dev, production]
+supported_resource_profiles: [natural, constrained]
+contexts:
+  dev: # local cluster
+    kube_context: minikube
+    environment: dev
+    resource_profile: constrained
+    helm_registry_url: http://localhost
+  prod:
+    kube_context: prod
+    environment: production
+    resource_profile: natural
+    helm_registry_url: http://localhost
+  broken:
+    kube_context: broken
+    environment: staging
+    resource_profile: natural
+    helm_registry_url: http://localhost
+`
+
+func writeTestConfig(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "ankh-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestSwitchContext(t *testing.T) {
+	path, cleanup := writeTestConfig(t, testConfig)
+	defer cleanup()
+
+	if err := SwitchContext([]string{path}, "prod"); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Replace(testConfig, "current_context: dev", "current_context: prod", 1)
+	if string(contents) != expected {
+		t.Errorf("expected only current_context to change, got:\n%s", contents)
+	}
+}
+
+func TestSwitchContextValidates(t *testing.T) {
+	path, cleanup := writeTestConfig(t, testConfig)
+	defer cleanup()
+
+	for _, name := range []string{"broken", "missing"} {
+		if err := SwitchContext([]string{path}, name); err == nil {
+			t.Errorf("expected switching to '%s' to fail", name)
+		}
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != testConfig {
+		t.Errorf("expected the config to be untouched, got:\n%s", contents)
+	}
+}
+
+func TestGetAnkhConfigContextOverride(t *testing.T) {
+	path, cleanup := writeTestConfig(t, testConfig)
+	defer cleanup()
+
+	oldConfigPaths, oldDataDir := AnkhConfigPaths, AnkhDataDir
+	AnkhConfigPaths, AnkhDataDir = []string{path}, filepath.Join(filepath.Dir(path), "data")
+	defer func() { AnkhConfigPaths, AnkhDataDir = oldConfigPaths, oldDataDir }()
+
+	ankhConfig, err := GetAnkhConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ankhConfig.CurrentContext.KubeContext != "minikube" {
+		t.Errorf("expected the current_context to be used, got %+v", ankhConfig.CurrentContext)
+	}
+
+	ankhConfig, err = GetAnkhConfig("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ankhConfig.CurrentContext.KubeContext != "prod" {
+		t.Errorf("expected the override to be used, got %+v", ankhConfig.CurrentContext)
+	}
+
+	if _, err := GetAnkhConfig("broken"); err == nil {
+		t.Error("expected the overridden context to be validated")
+	}
+}
+
+func TestReadAnkhConfigsMerges(t *testing.T) {
+	team, cleanupTeam := writeTestConfig(t, testConfig)
+	defer cleanupTeam()
+
+	personal, cleanupPersonal := writeTestConfig(t, `current_context: mine
+supported_environments: [dev, staging]
+contexts:
+  mine:
+    kube_context: mine
+    environment: staging
+    resource_profile: natural
+    helm_registry_url: http://localhost
+  prod:
+    kube_context: prod-override
+    environment: production
+    resource_profile: natural
+    helm_registry_url: http://localhost
+`)
+	defer cleanupPersonal()
+
+	ankhConfig, err := ReadAnkhConfigs([]string{team, personal})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ankhConfig.CurrentContextName != "mine" {
+		t.Errorf("expected the later current_context to win, got '%s'", ankhConfig.CurrentContextName)
+	}
+	if strings.Join(ankhConfig.SupportedEnvironments, ",") != "dev,production,staging" {
+		t.Errorf("expected environments to be combined, got %v", ankhConfig.SupportedEnvironments)
+	}
+	if strings.Join(ankhConfig.SupportedResourceProfiles, ",") != "natural,constrained" {
+		t.Errorf("expected resource profiles to be kept, got %v", ankhConfig.SupportedResourceProfiles)
+	}
+	if len(ankhConfig.Contexts) != 4 {
+		t.Errorf("expected 4 contexts, got %v", ankhConfig.Contexts)
+	}
+	if ankhConfig.Contexts["prod"].KubeContext != "prod-override" {
+		t.Errorf("expected the later prod context to win, got %+v", ankhConfig.Contexts["prod"])
+	}
+
+	if errs := ankhConfig.ValidateAndInit(); len(errs) > 0 {
+		t.Errorf("expected the merged config to be valid, got %v", errs)
+	}
+
+	// the personal file sets current_context so it's the one that changes
+	if err := SwitchContext([]string{team, personal}, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	teamContents, _ := ioutil.ReadFile(team)
+	personalContents, _ := ioutil.ReadFile(personal)
+	if string(teamContents) != testConfig {
+		t.Errorf("expected the team config to be untouched, got:\n%s", teamContents)
+	}
+	if !strings.HasPrefix(string(personalContents), "current_context: dev\n") {
+		t.Errorf("expected the personal config to be switched, got:\n%s", personalContents)
+	}
+}
+
+func TestReadAnkhConfigsSkipsMissing(t *testing.T) {
+	team, cleanup := writeTestConfig(t, testConfig)
+	defer cleanup()
+	missing := filepath.Join(filepath.Dir(team), "missing")
+
+	ankhConfig, err := ReadAnkhConfigs([]string{missing, team, missing + "-too"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := ankhConfig.ValidateAndInit(); len(errs) > 0 {
+		t.Errorf("expected the existing config to be used, got %v", errs)
+	}
+
+	// the switch goes to the last file that exists
+	if err := SwitchContext([]string{team, missing}, "prod"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("expected the missing config not to be created, got %v", err)
+	}
+
+	expected := "unable to read the ankh config, none of " + missing + ", " + missing + "-too exist"
+	if _, err := ReadAnkhConfigs([]string{missing, missing + "-too"}); err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+}
+
+func TestSplitConfigPaths(t *testing.T) {
+	tests := map[string][]string{
+		"":            {AnkhConfigPath},
+		"a":           {"a"},
+		"a:b":         {"a", "b"},
+		":a::/tmp/b:": {"a", "/tmp/b"},
+	}
+
+	for list, expected := range tests {
+		actual := SplitConfigPaths(list)
+		if strings.Join(actual, "|") != strings.Join(expected, "|") {
+			t.Errorf("SplitConfigPaths(%q): expected %v, got %v", list, expected, actual)
+		}
+	}
+}
+
+// writeAnkhFiles writes each ankh file under dir, keyed by its directory
+func writeAnkhFiles(t *testing.T, files map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "ankh-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, contents := range files {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name, "ankh.yaml"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestProcessAnkhFileCycle(t *testing.T) {
+	dir, cleanup := writeAnkhFiles(t, map[string]string{
+		"root": "dependencies: [../a]\n",
+		"a":    "dependencies: [../b]\n",
+		"b":    "admin_dependencies: [../a]\n",
+	})
+	defer cleanup()
+
+	filename := filepath.Join(dir, "root", "ankh.yaml")
+	_, err := ProcessAnkhFile(&filename)
+
+	cycleErr, ok := err.(*CycleError)
+	if !ok {
+		t.Fatalf("expected a *CycleError, got %v", err)
+	}
+
+	expected := []string{
+		filepath.Join(dir, "a", "ankh.yaml"),
+		filepath.Join(dir, "b", "ankh.yaml"),
+		filepath.Join(dir, "a", "ankh.yaml"),
+	}
+	if strings.Join(cycleErr.Chain, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected chain %v, got %v", expected, cycleErr.Chain)
+	}
+}
+
+func TestProcessAnkhFileSelfCycle(t *testing.T) {
+	dir, cleanup := writeAnkhFiles(t, map[string]string{
+		"root": "dependencies: [.]\n",
+	})
+	defer cleanup()
+
+	filename := filepath.Join(dir, "root", "ankh.yaml")
+	if _, err := ProcessAnkhFile(&filename); err == nil {
+		t.Error("expected a file depending on itself to be a cycle")
+	}
+}
+
+func TestTopologicalOrder(t *testing.T) {
+	// root depends on left and right, which both depend on shared. admin is
+	// only reachable as an admin dependency.
+	dir, cleanup := writeAnkhFiles(t, map[string]string{
+		"root":   "admin_dependencies: [../admin]\ndependencies: [../left, ../right]\n",
+		"left":   "dependencies: [../shared]\n",
+		"right":  "dependencies: [../shared]\n",
+		"shared": "namespace: shared\n",
+		"admin":  "dependencies: [../shared]\n",
+	})
+	defer cleanup()
+
+	filename := filepath.Join(dir, "root", "ankh.yaml")
+	root, err := ProcessAnkhFile(&filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(files []AnkhFile) string {
+		s := []string{}
+		for _, f := range files {
+			s = append(s, filepath.Base(filepath.Dir(f.Path)))
+		}
+		return strings.Join(s, " ")
+	}
+
+	if actual := names(TopologicalOrder(root, false)); actual != "shared left right root" {
+		t.Errorf("unexpected order without admin: %s", actual)
+	}
+	if actual := names(TopologicalOrder(root, true)); actual != "shared admin left right root" {
+		t.Errorf("unexpected order with admin: %s", actual)
+	}
+}
@@ -0,0 +1,347 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Cache is a content addressed store of chart tarballs. Tarballs live under
+// `blobs/sha256/<digest>.tgz` and a small ref file at `refs/<name>/<version>`
+// points each chart version at its tarball. A ref's modification time is
+// bumped every time it's used so stale entries can be pruned. Changes to
+// refs and blobs are made while holding the cache's lock file, so any number
+// of ankh processes, and goroutines, can share a cache. Downloads happen
+// before the lock is taken.
+type Cache struct {
+	Dir string
+}
+
+// LockFile is held while the refs and blobs of a cache change
+const LockFile = ".lock"
+
+// staleDownload is how old a download in progress has to be before Prune
+// takes it for one left behind by an ankh that died
+const staleDownload = time.Hour
+
+// Entry describes a cached chart version
+type Entry struct {
+	Name     string    `yaml:"-"`
+	Version  string    `yaml:"-"`
+	Path     string    `yaml:"-"`
+	Digest   string    `yaml:"digest"`
+	URL      string    `yaml:"url"`
+	Fetched  time.Time `yaml:"fetched"`
+	LastUsed time.Time `yaml:"-"`
+	Size     int64     `yaml:"-"`
+}
+
+// New returns a cache rooted at dir. The directory is created the first time
+// the cache is used.
+func New(dir string) *Cache {
+	return &Cache{Dir: dir}
+}
+
+// Get returns the cache entry for a chart version, whose Path is the
+// tarball. ok is false when the chart isn't cached. Tarballs are checked
+// against their digest when they're stored, so a ref whose tarball is gone is
+// the only kind of miss that needs cleaning up.
+func (c *Cache) Get(name, version string) (entry Entry, ok bool, err error) {
+	if err := checkRef(name, version); err != nil {
+		return entry, false, err
+	}
+
+	unlock, err := c.lock()
+	if err != nil {
+		return entry, false, err
+	}
+	defer unlock()
+
+	entry, err = c.readRef(name, version)
+	if os.IsNotExist(err) {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, err
+	}
+
+	if _, err := os.Stat(entry.Path); os.IsNotExist(err) {
+		os.Remove(c.refPath(name, version))
+		return Entry{}, false, nil
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(c.refPath(name, version), now, now); err != nil {
+		return entry, false, err
+	}
+
+	return entry, true, nil
+}
+
+// Put stores a chart tarball read from r and returns its entry. url is
+// recorded for `ankh cache list`. When digest is set, the tarball must have
+// that sha256 digest or it's rejected. r is read without holding the lock,
+// so several charts can be downloaded at once.
+func (c *Cache) Put(name, version, url, digest string, r io.Reader) (Entry, error) {
+	if err := checkRef(name, version); err != nil {
+		return Entry{}, err
+	}
+
+	blobDir := filepath.Join(c.Dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return Entry{}, err
+	}
+
+	tmp, err := ioutil.TempFile(blobDir, ".download-")
+	if err != nil {
+		return Entry{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		tmp.Close()
+		return Entry{}, fmt.Errorf("unable to download chart %s-%s: %v", name, version, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return Entry{}, err
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if digest != "" && actual != digest {
+		return Entry{}, fmt.Errorf("chart %s-%s from %s has digest sha256:%s, expected sha256:%s", name, version, url, actual, digest)
+	}
+
+	unlock, err := c.lock()
+	if err != nil {
+		return Entry{}, err
+	}
+	defer unlock()
+
+	path := c.blobPath(actual)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return Entry{}, err
+	}
+
+	entry := Entry{Name: name, Version: version, Path: path, Digest: actual, URL: url, Fetched: time.Now().UTC()}
+	entryBytes, err := yaml.Marshal(entry)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	if err := writeFile(c.refPath(name, version), entryBytes); err != nil {
+		return Entry{}, err
+	}
+
+	return entry, nil
+}
+
+// List returns every cached chart version sorted by name and version
+func (c *Cache) List() ([]Entry, error) {
+	unlock, err := c.lock()
+	if err != nil {
+		return []Entry{}, err
+	}
+	defer unlock()
+
+	return c.list()
+}
+
+func (c *Cache) list() ([]Entry, error) {
+	entries := []Entry{}
+
+	refsDir := filepath.Join(c.Dir, "refs")
+	names, err := ioutil.ReadDir(refsDir)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return entries, err
+	}
+
+	for _, name := range names {
+		versions, err := ioutil.ReadDir(filepath.Join(refsDir, name.Name()))
+		if err != nil {
+			return entries, err
+		}
+
+		for _, version := range versions {
+			// a ref that was being written when ankh died
+			if strings.HasPrefix(version.Name(), ".") {
+				continue
+			}
+			entry, err := c.readRef(name.Name(), version.Name())
+			if err != nil {
+				return entries, err
+			}
+			entry.LastUsed = version.ModTime()
+			if info, err := os.Stat(entry.Path); err == nil {
+				entry.Size = info.Size()
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Version < entries[j].Version
+	})
+
+	return entries, nil
+}
+
+// Prune removes chart versions that haven't been used in maxAge along with
+// any tarballs no longer referenced by a chart version. It returns the
+// entries that were removed.
+func (c *Cache) Prune(maxAge time.Duration) ([]Entry, error) {
+	unlock, err := c.lock()
+	if err != nil {
+		return []Entry{}, err
+	}
+	defer unlock()
+
+	removed := []Entry{}
+
+	entries, err := c.list()
+	if err != nil {
+		return removed, err
+	}
+
+	referenced := map[string]bool{}
+	cutoff := time.Now().Add(-maxAge)
+	for _, entry := range entries {
+		if entry.LastUsed.Before(cutoff) {
+			if err := os.Remove(c.refPath(entry.Name, entry.Version)); err != nil {
+				return removed, err
+			}
+			removed = append(removed, entry)
+			continue
+		}
+		referenced[entry.Digest] = true
+	}
+
+	blobDir := filepath.Join(c.Dir, "blobs", "sha256")
+	blobs, err := ioutil.ReadDir(blobDir)
+	if os.IsNotExist(err) {
+		return removed, nil
+	}
+	if err != nil {
+		return removed, err
+	}
+
+	for _, blob := range blobs {
+		// downloads in progress aren't blobs yet
+		if strings.HasPrefix(blob.Name(), ".") && time.Since(blob.ModTime()) < staleDownload {
+			continue
+		}
+		digest := strings.TrimSuffix(blob.Name(), ".tgz")
+		if !referenced[digest] {
+			if err := os.Remove(filepath.Join(blobDir, blob.Name())); err != nil {
+				return removed, err
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+// Clear removes everything from the cache. The lock file stays, since other
+// processes could be waiting on it.
+func (c *Cache) Clear() error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, dir := range []string{"refs", "blobs"} {
+		if err := os.RemoveAll(filepath.Join(c.Dir, dir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lock holds the cache's lock file until the returned func is called. Every
+// call opens the file again, so goroutines wait on each other too.
+func (c *Cache) lock() (func(), error) {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return lockFile(filepath.Join(c.Dir, LockFile))
+}
+
+func (c *Cache) refPath(name, version string) string {
+	return filepath.Join(c.Dir, "refs", name, version)
+}
+
+func (c *Cache) blobPath(digest string) string {
+	return filepath.Join(c.Dir, "blobs", "sha256", digest+".tgz")
+}
+
+func (c *Cache) readRef(name, version string) (Entry, error) {
+	entry := Entry{}
+
+	entryBytes, err := ioutil.ReadFile(c.refPath(name, version))
+	if err != nil {
+		return entry, err
+	}
+
+	if err := yaml.Unmarshal(entryBytes, &entry); err != nil {
+		return entry, fmt.Errorf("unable to read cache entry for %s-%s: %v", name, version, err)
+	}
+	entry.Name = name
+	entry.Version = version
+	entry.Path = c.blobPath(entry.Digest)
+
+	return entry, nil
+}
+
+// checkRef makes sure a chart name and version are safe to use as path
+// elements
+func checkRef(name, version string) error {
+	for _, s := range []string{name, version} {
+		if s == "" || s == "." || s == ".." || strings.ContainsAny(s, `/\`) {
+			return fmt.Errorf("invalid chart name or version '%s-%s'", name, version)
+		}
+	}
+	return nil
+}
+
+// writeFile writes data to path by way of a temp file, so the file is never
+// seen half written, even if ankh dies while writing it
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".ref-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
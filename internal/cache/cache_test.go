@@ -0,0 +1,237 @@
+package cache
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempCache(t *testing.T) (*Cache, func()) {
+	dir, err := ioutil.TempDir("", "ankh-cache-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(filepath.Join(dir, "charts")), func() { os.RemoveAll(dir) }
+}
+
+func TestPutAndGet(t *testing.T) {
+	c, cleanup := tempCache(t)
+	defer cleanup()
+
+	if _, ok, err := c.Get("web", "1.0.0"); ok || err != nil {
+		t.Fatalf("expected a miss on an empty cache, got ok=%v err=%v", ok, err)
+	}
+
+	put, err := c.Put("web", "1.0.0", "http://registry/web-1.0.0.tgz", "", strings.NewReader("tarball"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := c.Get("web", "1.0.0")
+	if err != nil || !ok {
+		t.Fatalf("expected a hit, got ok=%v err=%v", ok, err)
+	}
+	if got.Path != put.Path || got.Digest != put.Digest {
+		t.Errorf("expected %+v, got %+v", put, got)
+	}
+
+	contents, err := ioutil.ReadFile(got.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "tarball" {
+		t.Errorf("unexpected contents %q", contents)
+	}
+
+	// the same tarball under another version is stored once
+	if _, err := c.Put("web", "1.0.1", "http://registry/web-1.0.1.tgz", "", strings.NewReader("tarball")); err != nil {
+		t.Fatal(err)
+	}
+	blobs, _ := ioutil.ReadDir(filepath.Join(c.Dir, "blobs", "sha256"))
+	if len(blobs) != 1 {
+		t.Errorf("expected one blob, got %d", len(blobs))
+	}
+
+	entries, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Version != "1.0.0" || entries[1].Version != "1.0.1" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if entries[0].URL != "http://registry/web-1.0.0.tgz" || entries[0].Size != int64(len("tarball")) {
+		t.Errorf("unexpected entry %+v", entries[0])
+	}
+}
+
+func TestGetMissingBlob(t *testing.T) {
+	c, cleanup := tempCache(t)
+	defer cleanup()
+
+	entry, err := c.Put("web", "1.0.0", "", "", strings.NewReader("tarball"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(entry.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := c.Get("web", "1.0.0"); ok || err != nil {
+		t.Errorf("expected a missing tarball to be a miss, got ok=%v err=%v", ok, err)
+	}
+	if _, err := os.Stat(c.refPath("web", "1.0.0")); !os.IsNotExist(err) {
+		t.Errorf("expected the ref to be removed, got %v", err)
+	}
+}
+
+func TestPutDigestMismatch(t *testing.T) {
+	c, cleanup := tempCache(t)
+	defer cleanup()
+
+	if _, err := c.Put("web", "1.0.0", "", "0000", strings.NewReader("tarball")); err == nil {
+		t.Error("expected a digest mismatch error")
+	}
+	if _, ok, _ := c.Get("web", "1.0.0"); ok {
+		t.Error("expected nothing to be cached after a digest mismatch")
+	}
+}
+
+func TestInvalidRef(t *testing.T) {
+	c, cleanup := tempCache(t)
+	defer cleanup()
+
+	if _, err := c.Put("../web", "1.0.0", "", "", strings.NewReader("tarball")); err == nil {
+		t.Error("expected an error for a name with a path in it")
+	}
+	if _, _, err := c.Get("web", ".."); err == nil {
+		t.Error("expected an error for a version of `..`")
+	}
+}
+
+func TestPruneAndClear(t *testing.T) {
+	c, cleanup := tempCache(t)
+	defer cleanup()
+
+	for _, version := range []string{"1.0.0", "2.0.0"} {
+		if _, err := c.Put("web", version, "", "", strings.NewReader("tarball "+version)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(c.refPath("web", "1.0.0"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := c.Prune(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Version != "1.0.0" {
+		t.Fatalf("expected 1.0.0 to be pruned, got %+v", removed)
+	}
+
+	blobs, _ := ioutil.ReadDir(filepath.Join(c.Dir, "blobs", "sha256"))
+	if len(blobs) != 1 {
+		t.Errorf("expected the unreferenced blob to be removed, got %d blobs", len(blobs))
+	}
+	if _, ok, _ := c.Get("web", "2.0.0"); !ok {
+		t.Error("expected 2.0.0 to survive pruning")
+	}
+
+	if err := c.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := c.List(); len(entries) != 0 {
+		t.Errorf("expected an empty cache after clearing, got %+v", entries)
+	}
+}
+
+// blockingReader returns its contents once release is closed
+type blockingReader struct {
+	release chan struct{}
+	r       io.Reader
+}
+
+func (b blockingReader) Read(p []byte) (int, error) {
+	<-b.release
+	return b.r.Read(p)
+}
+
+func TestPutDownloadsWithoutTheLock(t *testing.T) {
+	c, cleanup := tempCache(t)
+	defer cleanup()
+
+	slow := blockingReader{release: make(chan struct{}), r: strings.NewReader("slow tarball")}
+	done := make(chan error)
+	go func() {
+		_, err := c.Put("slow", "1.0.0", "", "", slow)
+		done <- err
+	}()
+
+	// a download that's stuck doesn't hold up the others
+	fast := make(chan error)
+	go func() {
+		_, err := New(c.Dir).Put("fast", "1.0.0", "", "", strings.NewReader("fast tarball"))
+		fast <- err
+	}()
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the second download not to wait for the first")
+	}
+
+	close(slow.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.Get("slow", "1.0.0"); !ok || err != nil {
+		t.Errorf("expected the slow chart to be cached, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestSharedBetweenInstances(t *testing.T) {
+	c, cleanup := tempCache(t)
+	defer cleanup()
+
+	// every run of ankh has its own Cache, so only the lock file keeps them
+	// from stepping on each other
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			other := New(c.Dir)
+			if i%5 == 0 {
+				_, err := other.Prune(0)
+				errs <- err
+				return
+			}
+			if _, err := other.Put("web", "1.0.0", "", "", strings.NewReader("tarball")); err != nil {
+				errs <- err
+				return
+			}
+			_, _, err := other.Get("web", "1.0.0")
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// a ref left behind half written is ignored
+	if err := ioutil.WriteFile(filepath.Join(c.Dir, "refs", "web", ".ref-123"), []byte("dig"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.List(); err != nil {
+		t.Errorf("expected the partial ref to be skipped, got %v", err)
+	}
+}
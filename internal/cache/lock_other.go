@@ -0,0 +1,10 @@
+//go:build !unix
+
+package cache
+
+// Without flock, processes sharing a cache only have the atomic renames of
+// its files to keep them from seeing each other's partial writes
+
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,212 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorCyan  = "\x1b[36m"
+	colorBold  = "\x1b[1m"
+	colorReset = "\x1b[0m"
+)
+
+type opKind int
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+type op struct {
+	kind opKind
+	line string
+}
+
+// Unified returns a unified diff between a and b with `context` lines of
+// surrounding context for each hunk. An empty string means there were no
+// differences.
+func Unified(a, b, fromName, toName string, context int) string {
+	if a == b {
+		return ""
+	}
+
+	ops := lineOps(splitLines(a), splitLines(b))
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+
+	// walk the ops, grouping changes that are within 2*context lines of each
+	// other into a single hunk
+	i := 0
+	aLine, bLine := 1, 1
+	for i < len(ops) {
+		if ops[i].kind == opEqual {
+			i++
+			aLine++
+			bLine++
+			continue
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		hunkALine := aLine - (i - start)
+		hunkBLine := bLine - (i - start)
+
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != opEqual {
+				end++
+				continue
+			}
+			run := 0
+			for end+run < len(ops) && ops[end+run].kind == opEqual {
+				run++
+			}
+			if end+run == len(ops) || run > 2*context {
+				if run > context {
+					run = context
+				}
+				end += run
+				break
+			}
+			end += run
+		}
+
+		aCount, bCount := 0, 0
+		var body strings.Builder
+		for _, o := range ops[start:end] {
+			switch o.kind {
+			case opEqual:
+				aCount++
+				bCount++
+				body.WriteString(" " + o.line)
+			case opDelete:
+				aCount++
+				body.WriteString("-" + o.line)
+			case opInsert:
+				bCount++
+				body.WriteString("+" + o.line)
+			}
+			if !strings.HasSuffix(o.line, "\n") {
+				body.WriteString("\n" + noNewline + "\n")
+			}
+		}
+
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(hunkALine, aCount), hunkRange(hunkBLine, bCount))
+		sb.WriteString(body.String())
+
+		for _, o := range ops[i:end] {
+			if o.kind != opInsert {
+				aLine++
+			}
+			if o.kind != opDelete {
+				bLine++
+			}
+		}
+		i = end
+	}
+
+	return sb.String()
+}
+
+// Colorize adds terminal colors to a unified diff
+func Colorize(unified string) string {
+	lines := strings.SplitAfter(unified, "\n")
+	var sb strings.Builder
+	for _, line := range lines {
+		trimmed := strings.TrimRight(line, "\n")
+		newline := line[len(trimmed):]
+		switch {
+		case trimmed == "":
+			sb.WriteString(line)
+		case strings.HasPrefix(trimmed, "---"), strings.HasPrefix(trimmed, "+++"):
+			sb.WriteString(colorBold + trimmed + colorReset + newline)
+		case strings.HasPrefix(trimmed, "@@"):
+			sb.WriteString(colorCyan + trimmed + colorReset + newline)
+		case strings.HasPrefix(trimmed, "-"):
+			sb.WriteString(colorRed + trimmed + colorReset + newline)
+		case strings.HasPrefix(trimmed, "+"):
+			sb.WriteString(colorGreen + trimmed + colorReset + newline)
+		default:
+			sb.WriteString(line)
+		}
+	}
+	return sb.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		// an empty range refers to the line before the hunk
+		return fmt.Sprintf("%d,0", start-1)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// noNewline follows a last line that doesn't end in a newline, the way GNU
+// diff marks it
+const noNewline = `\ No newline at end of file`
+
+// splitLines keeps the newline on every line, so a last line without one
+// doesn't match the same line with one
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// lineOps computes an edit script between a and b using the longest common
+// subsequence of their lines. Manifests are small enough that the quadratic
+// table isn't a concern.
+func lineOps(a, b []string) []op {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := []op{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, op{opEqual, a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, op{opDelete, a[i]})
+			i++
+		default:
+			ops = append(ops, op{opInsert, b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, op{opDelete, a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, op{opInsert, b[j]})
+	}
+
+	return ops
+}
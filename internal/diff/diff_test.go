@@ -0,0 +1,157 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// numbered returns the lines 1 to n, with the ones in changed replaced
+func numbered(n int, changed ...int) string {
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		line := fmt.Sprint(i)
+		for _, c := range changed {
+			if c == i {
+				line = "changed"
+			}
+		}
+		sb.WriteString(line + "\n")
+	}
+	return sb.String()
+}
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     string
+		expected string
+	}{
+		{
+			name:     "no changes",
+			a:        numbered(3),
+			b:        numbered(3),
+			expected: "",
+		},
+		{
+			name: "hunk context",
+			a:    numbered(10),
+			b:    numbered(10, 5),
+			expected: `--- a
++++ b
+@@ -2,7 +2,7 @@
+ 2
+ 3
+ 4
+-5
++changed
+ 6
+ 7
+ 8
+`,
+		},
+		{
+			name: "hunks close together are merged",
+			a:    numbered(12),
+			b:    numbered(12, 2, 8),
+			expected: `--- a
++++ b
+@@ -1,11 +1,11 @@
+ 1
+-2
++changed
+ 3
+ 4
+ 5
+ 6
+ 7
+-8
++changed
+ 9
+ 10
+ 11
+`,
+		},
+		{
+			name: "hunks far apart stay separate",
+			a:    numbered(14),
+			b:    numbered(14, 2, 10),
+			expected: `--- a
++++ b
+@@ -1,5 +1,5 @@
+ 1
+-2
++changed
+ 3
+ 4
+ 5
+@@ -7,7 +7,7 @@
+ 7
+ 8
+ 9
+-10
++changed
+ 11
+ 12
+ 13
+`,
+		},
+		{
+			name: "no trailing newline",
+			a:    "a\nb\n",
+			b:    "a\nb",
+			expected: `--- a
++++ b
+@@ -1,2 +1,2 @@
+ a
+-b
++b
+\ No newline at end of file
+`,
+		},
+		{
+			name: "no trailing newline on either side",
+			a:    "a\nb",
+			b:    "a\nc",
+			expected: `--- a
++++ b
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++c
+\ No newline at end of file
+`,
+		},
+		{
+			name: "new file",
+			a:    "",
+			b:    "x\ny\n",
+			expected: `--- a
++++ b
+@@ -0,0 +1,2 @@
++x
++y
+`,
+		},
+	}
+
+	for _, test := range tests {
+		if actual := Unified(test.a, test.b, "a", "b", 3); actual != test.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestColorize(t *testing.T) {
+	actual := Colorize("--- a\n+++ b\n@@ -1 +1 @@\n-x\n+y\n same\n")
+	expected := colorBold + "--- a" + colorReset + "\n" +
+		colorBold + "+++ b" + colorReset + "\n" +
+		colorCyan + "@@ -1 +1 @@" + colorReset + "\n" +
+		colorRed + "-x" + colorReset + "\n" +
+		colorGreen + "+y" + colorReset + "\n" +
+		" same\n"
+	if actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
@@ -0,0 +1,194 @@
+package graph
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/jondlm/ankh/internal/ankh"
+)
+
+// Formats supported by Render
+const (
+	FormatText    = "text"
+	FormatDot     = "dot"
+	FormatMermaid = "mermaid"
+)
+
+type node struct {
+	id        string
+	ankhFile  ankh.AnkhFile
+	name      string
+	namespace string
+	charts    []string
+}
+
+type edge struct {
+	from, to string
+	admin    bool
+}
+
+// graph is the dependency graph of an ankh file with one node per file
+type graph struct {
+	nodes []node
+	edges []edge
+}
+
+// Render draws the dependency tree of an ankh file in the given format. Admin
+// dependencies are always included and are drawn differently from regular
+// dependencies.
+func Render(root ankh.AnkhFile, format string) (string, error) {
+	switch format {
+	case FormatText:
+		return text(root), nil
+	case FormatDot:
+		return build(root).dot(), nil
+	case FormatMermaid:
+		return build(root).mermaid(), nil
+	default:
+		return "", fmt.Errorf("unknown graph format '%s', expected one of %s, %s or %s", format, FormatText, FormatDot, FormatMermaid)
+	}
+}
+
+func build(root ankh.AnkhFile) graph {
+	g := graph{}
+	rootDir := filepath.Dir(root.Path)
+	ids := map[string]string{}
+
+	for _, f := range ankh.TopologicalOrder(root, true) {
+		id := fmt.Sprintf("n%d", len(g.nodes))
+		ids[f.Path] = id
+		g.nodes = append(g.nodes, newNode(id, f, rootDir))
+	}
+
+	for _, n := range g.nodes {
+		for _, dep := range n.ankhFile.AdminDependenciesResolved {
+			g.edges = append(g.edges, edge{from: n.id, to: ids[dep.Path], admin: true})
+		}
+		for _, dep := range n.ankhFile.DependenciesResovled {
+			g.edges = append(g.edges, edge{from: n.id, to: ids[dep.Path]})
+		}
+	}
+
+	return g
+}
+
+func newNode(id string, f ankh.AnkhFile, rootDir string) node {
+	name, err := filepath.Rel(rootDir, f.Path)
+	if err != nil {
+		name = f.Path
+	}
+
+	n := node{id: id, ankhFile: f, name: name, namespace: f.Namespace}
+	for _, chart := range f.Charts {
+		n.charts = append(n.charts, chartLabel(chart))
+	}
+
+	return n
+}
+
+func chartLabel(chart ankh.Chart) string {
+	if chart.Version == "" {
+		return chart.Name
+	}
+	return chart.Name + "@" + chart.Version
+}
+
+func (n node) lines() []string {
+	namespace := n.namespace
+	if namespace == "" {
+		namespace = "(none)"
+	}
+
+	return append([]string{n.name, "namespace: " + namespace}, n.charts...)
+}
+
+func (g graph) dot() string {
+	var sb strings.Builder
+
+	sb.WriteString("digraph ankh {\n")
+	sb.WriteString("  node [shape=box];\n")
+	for _, n := range g.nodes {
+		lines := []string{}
+		for _, line := range n.lines() {
+			lines = append(lines, dotEscape(line))
+		}
+		fmt.Fprintf(&sb, "  %s [label=\"%s\"];\n", n.id, strings.Join(lines, "\\n"))
+	}
+	for _, e := range g.edges {
+		if e.admin {
+			fmt.Fprintf(&sb, "  %s -> %s [style=dashed, label=\"admin\"];\n", e.from, e.to)
+		} else {
+			fmt.Fprintf(&sb, "  %s -> %s;\n", e.from, e.to)
+		}
+	}
+	sb.WriteString("}\n")
+
+	return sb.String()
+}
+
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+func (g graph) mermaid() string {
+	var sb strings.Builder
+
+	sb.WriteString("graph TD\n")
+	for _, n := range g.nodes {
+		lines := []string{}
+		for _, line := range n.lines() {
+			lines = append(lines, mermaidEscape(line))
+		}
+		fmt.Fprintf(&sb, "  %s[\"%s\"]\n", n.id, strings.Join(lines, "<br/>"))
+	}
+	for _, e := range g.edges {
+		if e.admin {
+			fmt.Fprintf(&sb, "  %s -. admin .-> %s\n", e.from, e.to)
+		} else {
+			fmt.Fprintf(&sb, "  %s --> %s\n", e.from, e.to)
+		}
+	}
+
+	return sb.String()
+}
+
+func mermaidEscape(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace(s)
+}
+
+// text draws an indented tree. Files that show up more than once only have
+// their details printed the first time.
+func text(root ankh.AnkhFile) string {
+	var sb strings.Builder
+	rootDir := filepath.Dir(root.Path)
+	printed := map[string]bool{}
+
+	var walk func(f ankh.AnkhFile, depth int, prefix string)
+	walk = func(f ankh.AnkhFile, depth int, prefix string) {
+		indent := strings.Repeat("  ", depth)
+		n := newNode("", f, rootDir)
+
+		if printed[f.Path] {
+			fmt.Fprintf(&sb, "%s%s%s (see above)\n", indent, prefix, n.name)
+			return
+		}
+		printed[f.Path] = true
+
+		lines := n.lines()
+		fmt.Fprintf(&sb, "%s%s%s\n", indent, prefix, lines[0])
+		for _, line := range lines[1:] {
+			fmt.Fprintf(&sb, "%s%s  %s\n", indent, strings.Repeat(" ", len(prefix)), line)
+		}
+
+		for _, dep := range f.AdminDependenciesResolved {
+			walk(dep, depth+1, "[admin] ")
+		}
+		for _, dep := range f.DependenciesResovled {
+			walk(dep, depth+1, "")
+		}
+	}
+	walk(root, 0, "")
+
+	return sb.String()
+}
@@ -0,0 +1,85 @@
+package graph
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jondlm/ankh/internal/ankh"
+)
+
+func testTree() ankh.AnkhFile {
+	shared := ankh.AnkhFile{Path: "/ankh/shared/ankh.yaml", Namespace: "shared"}
+	admin := ankh.AnkhFile{Path: "/ankh/admin/ankh.yaml", Namespace: "kube-system", DependenciesResovled: []ankh.AnkhFile{shared}}
+	return ankh.AnkhFile{
+		Path:                      "/ankh/root/ankh.yaml",
+		Namespace:                 "web",
+		Charts:                    []ankh.Chart{{Name: "web", Version: "1.2.3"}, {Name: "local"}},
+		AdminDependenciesResolved: []ankh.AnkhFile{admin},
+		DependenciesResovled:      []ankh.AnkhFile{shared},
+	}
+}
+
+func TestRenderDot(t *testing.T) {
+	out, err := Render(testTree(), FormatDot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `digraph ankh {
+  node [shape=box];
+  n0 [label="../shared/ankh.yaml\nnamespace: shared"];
+  n1 [label="../admin/ankh.yaml\nnamespace: kube-system"];
+  n2 [label="ankh.yaml\nnamespace: web\nweb@1.2.3\nlocal"];
+  n1 -> n0;
+  n2 -> n1 [style=dashed, label="admin"];
+  n2 -> n0;
+}
+`
+	if out != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
+
+func TestRenderMermaid(t *testing.T) {
+	out, err := Render(testTree(), FormatMermaid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`  n2["ankh.yaml<br/>namespace: web<br/>web@1.2.3<br/>local"]`,
+		"  n2 -. admin .-> n1",
+		"  n2 --> n0",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, out)
+		}
+	}
+}
+
+func TestRenderText(t *testing.T) {
+	out, err := Render(testTree(), FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `ankh.yaml
+  namespace: web
+  web@1.2.3
+  local
+  [admin] ../admin/ankh.yaml
+            namespace: kube-system
+    ../shared/ankh.yaml
+      namespace: shared
+  ../shared/ankh.yaml (see above)
+`
+	if out != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
+
+func TestRenderUnknownFormat(t *testing.T) {
+	if _, err := Render(testTree(), "png"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
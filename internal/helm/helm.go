@@ -1,195 +1,430 @@
 package helm
 
 import (
-	"crypto/tls"
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
-	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/Masterminds/semver"
 	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/cache"
+	"github.com/jondlm/ankh/internal/lock"
+	"github.com/jondlm/ankh/internal/registry"
+	"github.com/jondlm/ankh/internal/runner"
+	"github.com/jondlm/ankh/internal/secrets"
 	"github.com/jondlm/ankh/internal/util"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
-func templateChart(log *logrus.Logger, chart ankh.Chart, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig) (string, error) {
+// templateChart runs `helm template` for a single chart. A non-nil pin from
+// the ankh.lock file decides exactly which tarball is used for remote charts.
+// The helm process is killed if runCtx is cancelled. The output records the
+// chart version that was actually used. `ref+vault://` references are
+// resolved with vault.
+func templateChart(runCtx context.Context, log *logrus.Logger, r runner.Runner, chart ankh.Chart, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig, pin *lock.Entry, vault *secrets.VaultProvider) (ChartOutput, error) {
 	ctx := ankhConfig.CurrentContext
 	helmArgs := []string{"helm", "template", "--kube-context", ctx.KubeContext, "--namespace", ankhFile.Namespace}
 
-	dirPath := filepath.Join(filepath.Dir(ankhFile.Path), "charts", chart.Name)
-	_, dirErr := os.Stat(dirPath)
-
 	// Setup a directory where we'll either copy the chart files, if we've got a
 	// directory, or we'll download and extract a tarball to the temp dir. Then
-	// we'll mutate some of the ankh specific files based on the current
-	// environment and resource profile. Then we'll use those files as arguments
-	// to the helm command.
+	// we'll write a values file for every layer of values that applies to the
+	// current environment and resource profile and use those files as
+	// arguments to the helm command.
 	tmpDir, err := ioutil.TempDir(ankh.AnkhDataDir, chart.Name+"-")
 	if err != nil {
-		return "", err
+		return ChartOutput{}, err
 	}
 
-	if chart.DefaultValues != nil {
-		defaultValuesPath := filepath.Join(tmpDir, "default-values.yaml")
-		defaultValuesBytes, err := yaml.Marshal(chart.DefaultValues)
-		if err != nil {
-			return "", err
-		}
-
-		if err := ioutil.WriteFile(defaultValuesPath, defaultValuesBytes, 0644); err != nil {
-			return "", err
-		}
+	chartPath, source, err := prepareChart(log, tmpDir, chart, ankhFile, ctx, pin, false)
+	if err != nil {
+		return ChartOutput{}, err
+	}
+	version, err := chartVersion(chartPath)
+	if err != nil {
+		return ChartOutput{}, fmt.Errorf("unable to read the version of chart '%s': %v", chart.Name, err)
+	}
 
-		helmArgs = append(helmArgs, "-f", defaultValuesPath)
+	layers, err := chartLayers(chart, ankhFile, ankhConfig, chartPath, source)
+	if err != nil {
+		return ChartOutput{}, err
+	}
+	secretsFiles, err := readSecrets(ankhFile, chart, ctx.Environment)
+	if err != nil {
+		return ChartOutput{}, err
 	}
 
-	if chart.Values != nil && chart.Values[ctx.Environment] != nil {
-		valuesPath := filepath.Join(tmpDir, "values.yaml")
-		valuesBytes, err := yaml.Marshal(chart.Values[ctx.Environment])
-		if err != nil {
-			return "", err
-		}
+	// catch values that don't match the chart's schema before helm ever
+	// sees them
+	all, err := valueLayers(chart, chartPath, source, layers, secretsFiles, ctx.Environment)
+	if err != nil {
+		return ChartOutput{}, err
+	}
+	if err := checkSchema(log, ankhFile, chart, chartPath, all); err != nil {
+		return ChartOutput{}, err
+	}
 
-		if err := ioutil.WriteFile(valuesPath, valuesBytes, 0644); err != nil {
-			return "", err
+	// values files that end up holding secrets, whether resolved from
+	// `ref+` references or decrypted from secrets files, only exist for as
+	// long as helm needs them so a kept or failed run doesn't leave them lying
+	// around
+	sensitive := &chartSecrets{resolver: newResolver(ankhFile, vault)}
+	defer sensitive.remove()
+
+	for _, l := range layers {
+		path := filepath.Join(tmpDir, l.valuesFile)
+		if err := sensitive.writeValues(path, l.Values); err != nil {
+			return ChartOutput{}, fmt.Errorf("unable to process %s for chart '%s': %v", l.Name, chart.Name, err)
 		}
+		helmArgs = append(helmArgs, "-f", path)
+	}
 
-		helmArgs = append(helmArgs, "-f", valuesPath)
+	// secrets files are the very last layer
+	secretsPaths, secretValues, err := writeSecrets(tmpDir, secretsFiles)
+	sensitive.add(secretsPaths, secretValues)
+	if err != nil {
+		return ChartOutput{}, err
+	}
+	for _, path := range secretsPaths {
+		helmArgs = append(helmArgs, "-f", path)
 	}
+	redactor := secrets.NewRedactor(sensitive.values)
 
-	if chart.ResourceProfiles != nil && chart.ResourceProfiles[ctx.ResourceProfile] != nil {
-		resourceProfilesPath := filepath.Join(tmpDir, "resource-profiles.yaml")
-		resourceProfilesBytes, err := yaml.Marshal(chart.ResourceProfiles[ctx.ResourceProfile])
-		if err != nil {
-			return "", err
-		}
+	helmArgs = append(helmArgs, chartPath)
 
-		if err := ioutil.WriteFile(resourceProfilesPath, resourceProfilesBytes, 0644); err != nil {
-			return "", err
-		}
+	log.Debugf("running helm command %s", strings.Join(helmArgs, " "))
 
-		helmArgs = append(helmArgs, "-f", resourceProfilesPath)
+	var helmOutput bytes.Buffer
+	err = r.Run(runner.Command{Args: helmArgs, Stdout: &helmOutput, Stderr: &helmOutput, Context: runCtx})
+	if runCtx.Err() != nil {
+		return ChartOutput{}, runCtx.Err()
+	}
+	if err != nil {
+		return ChartOutput{}, fmt.Errorf("error running the helm command: %s", redactor.Redact(helmOutput.String()))
 	}
 
-	// Check if Global contains anything
-	if ctx.Global != nil {
-		for _, item := range util.Collapse(ctx.Global, nil, nil) {
-			helmArgs = append(helmArgs, "--set", "global."+item)
+	return ChartOutput{
+		AnkhFilePath: ankhFile.Path,
+		Namespace:    ankhFile.Namespace,
+		ChartName:    chart.Name,
+		Version:      version,
+		Output:       helmOutput.String(),
+		SecretValues: sensitive.values,
+	}, nil
+}
+
+// writeSecrets writes decrypted secrets files into dir, returning the paths
+// of the files and every value in them
+func writeSecrets(dir string, files []secretsFile) ([]string, []string, error) {
+	paths, values := []string{}, []string{}
+
+	for i, f := range files {
+		values = append(values, f.values...)
+
+		path := filepath.Join(dir, fmt.Sprintf("secrets-%d.yaml", i))
+		if err := ioutil.WriteFile(path, f.plaintext, 0600); err != nil {
+			return paths, values, err
 		}
+		paths = append(paths, path)
 	}
 
-	tarballFileName := fmt.Sprintf("%s-%s.tgz", chart.Name, chart.Version)
-	tarballPath := filepath.Join(filepath.Dir(ankhFile.Path), "charts", tarballFileName)
-	tarballURL := fmt.Sprintf("%s/%s", strings.TrimRight(ctx.HelmRegistryURL, "/"), tarballFileName)
+	return paths, values, nil
+}
 
-	// if we already have a dir, let's just copy it to a temp directory so we can
-	// make changes to the ankh specific yaml files before passing them as `-f`
-	// args to `helm template`
-	if dirErr == nil {
-		if err := util.CopyDir(dirPath, filepath.Join(tmpDir, chart.Name)); err != nil {
-			return "", err
+// secretsFile is a decrypted secrets file
+type secretsFile struct {
+	path      string
+	plaintext []byte
+	values    []string
+}
+
+// readSecrets decrypts the secrets files of a chart, least specific first.
+// The files have to be encrypted, a plain text secrets file is an error.
+func readSecrets(ankhFile ankh.AnkhFile, chart ankh.Chart, environment string) ([]secretsFile, error) {
+	files := secrets.Files(ankhFile.Path, chart.Name, environment)
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	identities, err := secrets.ReadIdentities(ankh.SecretsKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("chart '%s' has secrets but they can't be decrypted: %v", chart.Name, err)
+	}
+
+	decrypted := []secretsFile{}
+	for _, file := range files {
+		encrypted, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		log.Debugf("ensuring chart directory is made at %s", filepath.Dir(tarballPath))
-		if err := os.MkdirAll(filepath.Dir(tarballPath), 0755); err != nil {
-			return "", err
+		if !secrets.IsEncrypted(encrypted) {
+			return nil, fmt.Errorf("secrets file %s isn't encrypted, run `ankh secrets encrypt -i %s`", file, file)
 		}
 
-		log.Debugf("opening system file at %s", tarballPath)
-		f, err := os.Create(tarballPath)
+		plaintext, err := secrets.Decrypt(encrypted, identities)
 		if err != nil {
-			return "", err
+			return nil, fmt.Errorf("unable to decrypt %s: %v", file, err)
 		}
-		defer f.Close()
 
-		// TODO: this code should be modified to properly fetch charts
-		log.Debugf("downloading chart from %s", tarballURL)
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		client := &http.Client{Transport: tr}
-		resp, err := client.Get(tarballURL)
+		values, err := secrets.Values(plaintext)
 		if err != nil {
-			return "", err
+			return nil, fmt.Errorf("unable to decrypt %s: %v", file, err)
 		}
-		if resp.StatusCode != 200 {
-			return "", fmt.Errorf("got a status code %v when trying to call %s", resp.StatusCode, tarballURL)
-		}
-		// defer resp.Body.Close()
+		decrypted = append(decrypted, secretsFile{path: file, plaintext: plaintext, values: values})
+	}
 
-		log.Debugf("untarring chart to %s", tmpDir)
-		if err = util.Untar(tmpDir, resp.Body); err != nil {
-			return "", err
-		}
+	return decrypted, nil
+}
+
+// chartVersion reads the version out of a chart's Chart.yaml
+func chartVersion(chartPath string) (string, error) {
+	chartBytes, err := ioutil.ReadFile(filepath.Join(chartPath, "Chart.yaml"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
 	}
 
-	chartPath := filepath.Join(tmpDir, chart.Name)
-	valuesPath := filepath.Join(chartPath, "ankh-values.yaml")
-	resourceProfilesPath := filepath.Join(chartPath, "ankh-resource-profiles.yaml")
+	metadata := struct {
+		Version string
+	}{}
+	if err := yaml.Unmarshal(chartBytes, &metadata); err != nil {
+		return "", err
+	}
+	return metadata.Version, nil
+}
 
-	// TODO: load secrets from another repo, eventually from vault
-	// secretsPath := filepath.Join(filepath.Dir(ankhFile.Path), "secrets", chart.Name+".yaml")
-	// _, secretsErr := os.Stat(secretsPath)
-	// if secretsErr == nil {
-	// 	helmArgs = append(helmArgs, "-f", secretsPath)
-	// }
+// localChartDir returns where a chart would live if it's checked in next to
+// the ankh file, and whether it's actually there
+func localChartDir(ankhFile ankh.AnkhFile, chart ankh.Chart) (string, bool) {
+	dirPath := filepath.Join(filepath.Dir(ankhFile.Path), "charts", chart.Name)
+	_, err := os.Stat(dirPath)
+	return dirPath, err == nil
+}
 
-	_, valuesErr := os.Stat(valuesPath)
-	if valuesErr == nil {
-		if err := createReducedYAMLFile(valuesPath, ctx.Environment, ankhConfig.SupportedEnvironments); err != nil {
-			return "", fmt.Errorf("unable to process ankh-values.yaml file for chart '%s': %v", chart.Name, err)
-		}
-		helmArgs = append(helmArgs, "-f", valuesPath)
+// fetchChart returns the chart cache entry for a chart's tarball,
+// downloading it first if it isn't cached yet. When pin is set the exact
+// version, url and digest it names are used. Otherwise `version` can be an
+// exact version or a constraint like `~1.2`, which is resolved against the
+// registry's index.yaml, which is fetched again rather than read from the
+// local copy when refresh is set. Registries without an index only work with
+// exact versions.
+func fetchChart(log *logrus.Logger, chart ankh.Chart, ctx ankh.Context, pin *lock.Entry, refresh bool) (cache.Entry, error) {
+	if chart.Version == "" {
+		return cache.Entry{}, fmt.Errorf("chart '%s' has no local directory and no `version` to fetch", chart.Name)
 	}
 
-	_, resourceProfilesError := os.Stat(resourceProfilesPath)
-	if resourceProfilesError == nil {
-		if err := createReducedYAMLFile(resourceProfilesPath, ctx.ResourceProfile, ankhConfig.SupportedResourceProfiles); err != nil {
-			return "", fmt.Errorf("unable to process ankh-resource-profiles.yaml file for chart '%s': %v", chart.Name, err)
+	// charts shared by several ankh files are only downloaded once even when
+	// they're templated at the same time
+	unlock := lockChart(chart.Name + "@" + chart.Version)
+	defer unlock()
+
+	chartCache := cache.New(ankh.ChartCacheDir)
+	entry, ok, err := cachedChart(chartCache, chart, pin)
+	if err != nil {
+		return entry, err
+	}
+	if ok {
+		log.Debugf("using cached chart %s", entry.Path)
+		return entry, nil
+	}
+
+	reg, err := newRegistry(ctx)
+	if err != nil {
+		return cache.Entry{}, err
+	}
+	if refresh {
+		reg.IndexTTL = 0
+	}
+
+	var version, tarballURL, digest string
+
+	if pin != nil {
+		version, tarballURL, digest = pin.Resolved, pin.URL, pin.HexDigest()
+		log.Debugf("using locked chart '%s' version %s", chart.Name, version)
+	} else {
+		var exact bool
+		version, exact = exactVersion(chart.Version)
+
+		index, err := reg.Index()
+
+		switch {
+		case err == nil:
+			cv, err := index.Resolve(chart.Name, chart.Version)
+			if err != nil {
+				return cache.Entry{}, err
+			}
+			log.Debugf("resolved chart '%s' version '%s' to %s", chart.Name, chart.Version, cv.Version)
+
+			version, digest = cv.Version, cv.Digest
+			if tarballURL, err = reg.ChartURL(cv); err != nil {
+				return cache.Entry{}, err
+			}
+
+			entry, ok, err := chartCache.Get(chart.Name, version)
+			if err != nil {
+				return entry, err
+			}
+			if ok && (digest == "" || entry.Digest == digest) {
+				log.Debugf("using cached chart %s", entry.Path)
+				return entry, nil
+			}
+		case err == registry.ErrNoIndex && exact:
+			tarballURL = fmt.Sprintf("%s/%s-%s.tgz", strings.TrimRight(ctx.HelmRegistryURL, "/"), chart.Name, version)
+		case err == registry.ErrNoIndex:
+			return cache.Entry{}, fmt.Errorf("chart '%s' version '%s' is a range, which needs an index.yaml at %s", chart.Name, chart.Version, ctx.HelmRegistryURL)
+		default:
+			return cache.Entry{}, fmt.Errorf("unable to fetch the registry index for chart '%s': %v", chart.Name, err)
 		}
-		helmArgs = append(helmArgs, "-f", resourceProfilesPath)
 	}
 
-	helmArgs = append(helmArgs, chartPath)
+	log.Debugf("downloading chart from %s", tarballURL)
+	body, err := reg.Get(tarballURL)
+	if err != nil {
+		return cache.Entry{}, err
+	}
+	defer body.Close()
 
-	log.Debugf("running helm command %s", strings.Join(helmArgs, " "))
+	entry, err = chartCache.Put(chart.Name, version, tarballURL, digest, body)
+	if err != nil {
+		return entry, err
+	}
+	log.Debugf("cached chart at %s", entry.Path)
+
+	return entry, nil
+}
 
-	helmCmd := exec.Command(helmArgs[0], helmArgs[1:]...)
-	helmOutput, err := helmCmd.CombinedOutput()
+// cachedChart finds the tarball of a remote chart in the chart cache without
+// contacting the registry, which is only possible for locked charts and exact
+// versions
+func cachedChart(chartCache *cache.Cache, chart ankh.Chart, pin *lock.Entry) (cache.Entry, bool, error) {
+	if pin != nil {
+		entry, ok, err := chartCache.Get(chart.Name, pin.Resolved)
+		return entry, ok && entry.Digest == pin.HexDigest(), err
+	}
+	version, exact := exactVersion(chart.Version)
+	if !exact {
+		return cache.Entry{}, false, nil
+	}
+	return chartCache.Get(chart.Name, version)
+}
 
+var exactVersionRegexp = regexp.MustCompile(`^=?\s*v?[0-9]+\.[0-9]+\.[0-9]+(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// exactVersion reports whether a chart version names a single version rather
+// than a range and returns it in the canonical form used for tarball names
+// and cache refs, so `=1.2.3` and `v1.2.3` both become `1.2.3`
+func exactVersion(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if !exactVersionRegexp.MatchString(s) {
+		return "", false
+	}
+	v, err := semver.NewVersion(strings.TrimSpace(strings.TrimPrefix(s, "=")))
 	if err != nil {
-		return "", fmt.Errorf("error running the helm command: %s", helmOutput)
+		return "", false
 	}
+	return v.String(), true
+}
+
+var chartLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: map[string]*sync.Mutex{}}
+
+// lockChart holds a lock for a chart until the returned func is called
+func lockChart(key string) func() {
+	chartLocks.Lock()
+	mu, ok := chartLocks.m[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		chartLocks.m[key] = mu
+	}
+	chartLocks.Unlock()
 
-	return string(helmOutput), nil
+	mu.Lock()
+	return mu.Unlock
 }
 
-func createReducedYAMLFile(filename, key string, supportedKeys []string) error {
+// newRegistry connects to a context's chart registry with its TLS settings
+// and credentials
+func newRegistry(ctx ankh.Context) (*registry.Registry, error) {
+	creds, err := registryCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return registry.New(ctx.HelmRegistryURL, ankh.IndexCacheDir, registry.Options{
+		CAFile:      ctx.HelmRegistryCAFile,
+		CertFile:    ctx.HelmRegistryCertFile,
+		KeyFile:     ctx.HelmRegistryKeyFile,
+		Insecure:    ctx.HelmRegistryInsecure,
+		Credentials: creds,
+	})
+}
+
+// registryCredentials picks the registry credentials from the environment,
+// then the context, then the netrc file
+func registryCredentials(ctx ankh.Context) (registry.Credentials, error) {
+	creds := registry.Credentials{
+		Username: firstSet(os.Getenv("ANKH_HELM_REGISTRY_USERNAME"), os.ExpandEnv(ctx.HelmRegistryUsername)),
+		Password: firstSet(os.Getenv("ANKH_HELM_REGISTRY_PASSWORD"), os.ExpandEnv(ctx.HelmRegistryPassword)),
+		Token:    firstSet(os.Getenv("ANKH_HELM_REGISTRY_TOKEN"), os.ExpandEnv(ctx.HelmRegistryToken)),
+	}
+	if !creds.Empty() {
+		return creds, nil
+	}
+
+	u, err := url.Parse(ctx.HelmRegistryURL)
+	if err != nil {
+		return creds, fmt.Errorf("unable to parse `helm_registry_url`: %v", err)
+	}
+
+	netrc := firstSet(ctx.HelmRegistryNetrc, os.Getenv("NETRC"), filepath.Join(os.Getenv("HOME"), ".netrc"))
+	return registry.NetrcCredentials(netrc, u.Hostname())
+}
+
+func firstSet(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// reduceYAMLFile reads a file keyed by environment or resource profile and
+// returns just the part under key
+func reduceYAMLFile(filename, key string, supportedKeys []string) (map[interface{}]interface{}, error) {
 	in := make(map[string]interface{})
 
 	inBytes, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if err = yaml.Unmarshal(inBytes, &in); err != nil {
-		return err
+		return nil, err
 	}
 
 	out := make(map[interface{}]interface{})
 
 	for k := range in {
 		if util.Contains(supportedKeys, k) == false {
-			return fmt.Errorf("unsupported key `%s` found", k)
+			return nil, fmt.Errorf("unsupported key `%s` found", k)
 		}
 	}
 
 	if in[key] == nil {
-		return fmt.Errorf("missing `%s` key", key)
+		return nil, fmt.Errorf("missing `%s` key", key)
 	}
 
 	switch t := in[key].(type) {
@@ -205,63 +440,183 @@ func createReducedYAMLFile(filename, key string, supportedKeys []string) error {
 		out[key] = in[key]
 	}
 
-	outBytes, err := yaml.Marshal(&out)
-	if err != nil {
-		return err
+	return out, nil
+}
+
+// Parallelism is how many charts are templated at once
+var Parallelism = 1
+
+// Timings makes templating report how long each chart took
+var Timings = false
+
+// ChartOutput is the result of templating a single chart
+type ChartOutput struct {
+	// AnkhFilePath is the path of the ankh file the chart was declared in
+	AnkhFilePath string
+	// Namespace is the namespace of that ankh file, which the chart was
+	// templated for
+	Namespace string
+	ChartName string
+	// Version comes from the Chart.yaml of the chart that was templated
+	Version string
+	Output  string
+	// SecretValues are the decrypted values that went into Output, so they
+	// can be redacted before it's logged or stored
+	SecretValues []string
+}
+
+// Redactor returns a Redactor for every secret value that went into outputs
+func Redactor(outputs []ChartOutput) *secrets.Redactor {
+	values := []string{}
+	for _, o := range outputs {
+		values = append(values, o.SecretValues...)
 	}
+	return secrets.NewRedactor(values)
+}
+
+// Template templates every chart in an ankh file along with its
+// dependencies. Files are templated once each, in topological order, so
+// dependencies come before the files that need them and admin dependencies
+// come before regular ones. That's the order they should be applied in.
+func Template(log *logrus.Logger, r runner.Runner, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig) (string, error) {
+	outputs, err := template(log, r, ankhFile, ankhConfig, false)
+	return Join(outputs), err
+}
+
+// TemplateChartsReverse is like TemplateCharts but produces output in the
+// order things should be deleted: the exact reverse of Template.
+func TemplateChartsReverse(log *logrus.Logger, r runner.Runner, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig) ([]ChartOutput, error) {
+	return template(log, r, ankhFile, ankhConfig, true)
+}
+
+// TemplateCharts is like Template but keeps the output of each chart
+// separate
+func TemplateCharts(log *logrus.Logger, r runner.Runner, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig) ([]ChartOutput, error) {
+	return template(log, r, ankhFile, ankhConfig, false)
+}
 
-	if err := ioutil.WriteFile(filename, outBytes, 0644); err != nil {
-		return err
+// Join puts the output of every chart together into a single manifest
+func Join(outputs []ChartOutput) string {
+	combined := ""
+	for _, o := range outputs {
+		combined += o.Output
 	}
+	return combined
+}
 
-	return nil
+// job is a single chart to template, in the position its output goes
+type job struct {
+	ankhFile ankh.AnkhFile
+	chart    ankh.Chart
+	pin      *lock.Entry
 }
 
-func Template(log *logrus.Logger, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig) (string, error) {
-	adminDepOutputCombined := ""
-	depOutputCombined := ""
-	chartOutputCombined := ""
+func template(log *logrus.Logger, r runner.Runner, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig, reverse bool) ([]ChartOutput, error) {
+	jobs := []job{}
 
-	log.Debugf("beginning templating of %s", ankhFile.Path)
+	ankhFiles := ankh.TopologicalOrder(ankhFile, ankhConfig.CurrentContext.ClusterAdmin)
+	for _, f := range ankhFiles {
+		l, _, err := lock.Read(lock.Path(f.Path))
+		if err != nil {
+			return nil, err
+		}
 
-	if ankhFile.AdminDependenciesResolved != nil && ankhConfig.CurrentContext.ClusterAdmin == true {
-		log.Debugf("templating admin deps")
-		for _, adminDepConfig := range ankhFile.AdminDependenciesResolved {
-			adminDepOutput, err := Template(log, adminDepConfig, ankhConfig)
-			if err != nil {
-				return adminDepOutputCombined, err
+		for _, chart := range f.Charts {
+			if err := chart.Validate(ankhConfig); err != nil {
+				return nil, err
 			}
-			adminDepOutputCombined += adminDepOutput
+			jobs = append(jobs, job{ankhFile: f, chart: chart, pin: pinFor(l, chart)})
 		}
 	}
 
-	if ankhFile.DependenciesResovled != nil {
-		log.Debugf("templating deps")
-		for _, dependencyConfig := range ankhFile.DependenciesResovled {
-			depOutput, err := Template(log, dependencyConfig, ankhConfig)
-			if err != nil {
-				return depOutputCombined, err
-			}
-			depOutputCombined += depOutput
+	if _, err := ankh.DataDir(); err != nil {
+		return nil, err
+	}
+
+	outputs, err := run(log, r, ankhConfig, jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	if reverse {
+		for i, j := 0, len(outputs)-1; i < j; i, j = i+1, j-1 {
+			outputs[i], outputs[j] = outputs[j], outputs[i]
 		}
 	}
 
-	if len(ankhFile.Charts) > 0 {
-		log.Debugf("templating charts")
-		for _, chart := range ankhFile.Charts {
-			log.Debugf("templating chart '%s'", chart.Name)
+	return outputs, nil
+}
 
-			if err := chart.Validate(ankhConfig); err != nil {
-				return chartOutputCombined, err
-			}
+// run templates jobs on up to Parallelism goroutines. Each output lands in
+// the same position as its job so the result doesn't depend on which chart
+// finishes first. The first failure cancels everything still running and is
+// the error that gets returned.
+func run(log *logrus.Logger, r runner.Runner, ankhConfig ankh.AnkhConfig, jobs []job) ([]ChartOutput, error) {
+	parallelism := Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vault := newVaultProvider(ankhConfig.CurrentContext)
+	outputs := make([]ChartOutput, len(jobs))
+	var firstErr error
+	var errOnce sync.Once
+
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for i, j := range jobs {
+		sem <- struct{}{}
+		if runCtx.Err() != nil {
+			<-sem
+			break
+		}
 
-			chartOutput, err := templateChart(log, chart, ankhFile, ankhConfig)
+		wg.Add(1)
+		go func(i int, j job) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			log.Debugf("templating chart '%s' from %s", j.chart.Name, j.ankhFile.Path)
+			chartStart := time.Now()
+
+			output, err := templateChart(runCtx, log, r, j.chart, j.ankhFile, ankhConfig, j.pin, vault)
 			if err != nil {
-				return chartOutputCombined, err
+				if err != runCtx.Err() {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+				return
 			}
-			chartOutputCombined += chartOutput
-		}
+
+			logTiming(log, "templated chart '%s' in %v", j.chart.Name, time.Since(chartStart).Round(time.Millisecond))
+			outputs[i] = output
+		}(i, j)
 	}
 
-	return adminDepOutputCombined + depOutputCombined + chartOutputCombined, nil
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	logTiming(log, "templated %d charts in %v", len(jobs), time.Since(start).Round(time.Millisecond))
+	return outputs, nil
+}
+
+// logTiming logs how long templating took, at info level when Timings is
+// set and at debug level otherwise
+func logTiming(log *logrus.Logger, format string, args ...interface{}) {
+	if Timings {
+		log.Infof(format, args...)
+		return
+	}
+	log.Debugf(format, args...)
 }
@@ -0,0 +1,618 @@
+package helm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/runner"
+	"github.com/jondlm/ankh/internal/runner/runnertest"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	return log
+}
+
+func testConfig() ankh.AnkhConfig {
+	return ankh.AnkhConfig{
+		CurrentContextName:        "test",
+		SupportedEnvironments:     []string{"dev", "production"},
+		SupportedResourceProfiles: []string{"natural", "constrained"},
+		CurrentContext: ankh.Context{
+			KubeContext:     "minikube",
+			Environment:     "dev",
+			ResourceProfile: "constrained",
+			HelmRegistryURL: "http://localhost",
+		},
+	}
+}
+
+// setup points ankh.AnkhDataDir and the cache dirs at a fresh temp dir and returns a directory
+// to hold test ankh files along with a cleanup func
+func setup(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "ankh-helm-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldDataDir, oldChartCacheDir, oldIndexCacheDir := ankh.AnkhDataDir, ankh.ChartCacheDir, ankh.IndexCacheDir
+	ankh.AnkhDataDir = filepath.Join(dir, "data")
+	ankh.ChartCacheDir = filepath.Join(dir, "cache", "charts")
+	ankh.IndexCacheDir = filepath.Join(dir, "cache", "index")
+	if err := os.MkdirAll(ankh.AnkhDataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() {
+		ankh.AnkhDataDir, ankh.ChartCacheDir, ankh.IndexCacheDir = oldDataDir, oldChartCacheDir, oldIndexCacheDir
+		os.RemoveAll(dir)
+	}
+}
+
+// ankhFile makes an ankh file rooted at dir/name with a local chart directory
+// for each chart
+func ankhFile(t *testing.T, dir, name string, charts ...string) ankh.AnkhFile {
+	f := ankh.AnkhFile{
+		Path:      filepath.Join(dir, name, "ankh.yaml"),
+		Namespace: name,
+	}
+
+	for _, chart := range charts {
+		writeFile(t, filepath.Join(dir, name, "charts", chart, "Chart.yaml"), "name: "+chart+"\n")
+		f.Charts = append(f.Charts, ankh.Chart{Name: chart})
+	}
+
+	return f
+}
+
+func writeFile(t *testing.T, path, contents string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// echoChart is a fake helm that outputs the name of the chart it was given
+func echoChart() *runnertest.Fake {
+	return &runnertest.Fake{
+		Respond: func(call runnertest.Call) runnertest.Response {
+			return runnertest.Response{Stdout: filepath.Base(call.Args[len(call.Args)-1]) + "\n"}
+		},
+	}
+}
+
+// valuesFiles returns the `-f` arguments of a helm call
+func valuesFiles(args []string) []string {
+	files := []string{}
+	for i, arg := range args {
+		if arg == "-f" && i+1 < len(args) {
+			files = append(files, args[i+1])
+		}
+	}
+	return files
+}
+
+func TestTemplateOrdering(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	root := ankhFile(t, dir, "root", "root-a", "root-b")
+	root.AdminDependenciesResolved = []ankh.AnkhFile{
+		ankhFile(t, dir, "admin1", "admin1-a"),
+		ankhFile(t, dir, "admin2", "admin2-a"),
+	}
+	root.DependenciesResovled = []ankh.AnkhFile{
+		ankhFile(t, dir, "dep1", "dep1-a", "dep1-b"),
+		ankhFile(t, dir, "dep2", "dep2-a"),
+	}
+
+	adminConfig := testConfig()
+	adminConfig.CurrentContext.ClusterAdmin = true
+
+	tests := []struct {
+		name     string
+		config   ankh.AnkhConfig
+		template func(*logrus.Logger, runner.Runner, ankh.AnkhFile, ankh.AnkhConfig) (string, error)
+		expected []string
+	}{
+		{
+			name:     "apply order",
+			config:   testConfig(),
+			template: Template,
+			expected: []string{"dep1-a", "dep1-b", "dep2-a", "root-a", "root-b"},
+		},
+		{
+			name:     "apply order as cluster admin",
+			config:   adminConfig,
+			template: Template,
+			expected: []string{"admin1-a", "admin2-a", "dep1-a", "dep1-b", "dep2-a", "root-a", "root-b"},
+		},
+		{
+			name:   "delete order as cluster admin",
+			config: adminConfig,
+			template: func(log *logrus.Logger, r runner.Runner, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig) (string, error) {
+				outputs, err := TemplateChartsReverse(log, r, ankhFile, ankhConfig)
+				return Join(outputs), err
+			},
+			expected: []string{"root-b", "root-a", "dep2-a", "dep1-b", "dep1-a", "admin2-a", "admin1-a"},
+		},
+	}
+
+	for _, test := range tests {
+		output, err := test.template(testLogger(), echoChart(), root, test.config)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+
+		actual := strings.Fields(output)
+		if strings.Join(actual, " ") != strings.Join(test.expected, " ") {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestTemplateSharedDependencyOnce(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	shared := ankhFile(t, dir, "shared", "shared-a")
+	left := ankhFile(t, dir, "left", "left-a")
+	left.DependenciesResovled = []ankh.AnkhFile{shared}
+	right := ankhFile(t, dir, "right", "right-a")
+	right.DependenciesResovled = []ankh.AnkhFile{shared}
+	root := ankhFile(t, dir, "root", "root-a")
+	root.DependenciesResovled = []ankh.AnkhFile{left, right}
+
+	output, err := Template(testLogger(), echoChart(), root, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := strings.Join(strings.Fields(output), " "); actual != "shared-a left-a right-a root-a" {
+		t.Errorf("expected the shared dependency to be templated once, got %s", actual)
+	}
+}
+
+func TestTemplateChartsKeepsChartsSeparate(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	root := ankhFile(t, dir, "root", "a")
+	root.DependenciesResovled = []ankh.AnkhFile{ankhFile(t, dir, "dep", "b")}
+
+	outputs, err := TemplateCharts(testLogger(), echoChart(), root, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(outputs) != 2 {
+		t.Fatalf("expected 2 outputs, got %d", len(outputs))
+	}
+	if outputs[0].ChartName != "b" || outputs[0].AnkhFilePath != root.DependenciesResovled[0].Path || outputs[0].Namespace != "dep" || outputs[0].Output != "b\n" {
+		t.Errorf("unexpected first output: %+v", outputs[0])
+	}
+	if outputs[1].ChartName != "a" || outputs[1].AnkhFilePath != root.Path || outputs[1].Namespace != "root" || outputs[1].Output != "a\n" {
+		t.Errorf("unexpected second output: %+v", outputs[1])
+	}
+}
+
+func TestTemplateValuesLayering(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	root := ankhFile(t, dir, "root", "app")
+	root.Charts[0].DefaultValues = map[string]interface{}{"layer": "default"}
+	root.Charts[0].Values = map[string]interface{}{
+		"dev":        map[string]interface{}{"layer": "values-dev"},
+		"production": map[string]interface{}{"layer": "values-production"},
+	}
+	root.Charts[0].ResourceProfiles = map[string]interface{}{
+		"natural":     map[string]interface{}{"cpu": 2},
+		"constrained": map[string]interface{}{"cpu": 1},
+	}
+
+	chartDir := filepath.Join(dir, "root", "charts", "app")
+	writeFile(t, filepath.Join(chartDir, "ankh-values.yaml"), "dev:\n  layer: ankh-values-dev\nproduction:\n  layer: ankh-values-production\n")
+	writeFile(t, filepath.Join(chartDir, "ankh-resource-profiles.yaml"), "natural:\n  memory: 2Gi\nconstrained:\n  memory: 1Gi\n")
+
+	config := testConfig()
+	config.CurrentContext.Global = map[string]interface{}{
+		"cluster":  "test",
+		"replicas": 3,
+		"dns":      map[interface{}]interface{}{"zones": []interface{}{"a.example.com", "b.example.com"}},
+	}
+
+	fake := runnertest.NewFake(runnertest.Response{Stdout: "rendered"})
+	if _, err := Template(testLogger(), fake, root, config); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := fake.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("expected one helm call, got %d", len(calls))
+	}
+	args := calls[0].Args
+
+	expectedArgs := []string{"helm", "template", "--kube-context", "minikube", "--namespace", "root"}
+	if strings.Join(args[:len(expectedArgs)], " ") != strings.Join(expectedArgs, " ") {
+		t.Errorf("expected args to start with %v, got %v", expectedArgs, args)
+	}
+
+	files := valuesFiles(args)
+	expectedFiles := []string{"default-values.yaml", "values.yaml", "resource-profiles.yaml", "ankh-values.yaml", "ankh-resource-profiles.yaml", "globals.yaml"}
+	if len(files) != len(expectedFiles) {
+		t.Fatalf("expected values files %v, got %v", expectedFiles, files)
+	}
+	for i, f := range files {
+		if filepath.Base(f) != expectedFiles[i] {
+			t.Errorf("expected values file %d to be %s, got %s", i, expectedFiles[i], f)
+		}
+	}
+
+	expectedContents := []map[string]interface{}{
+		{"layer": "default"},
+		{"layer": "values-dev"},
+		{"cpu": 1},
+		{"layer": "ankh-values-dev"},
+		{"memory": "1Gi"},
+		{"global": map[interface{}]interface{}{
+			"cluster":  "test",
+			"replicas": 3,
+			"dns":      map[interface{}]interface{}{"zones": []interface{}{"a.example.com", "b.example.com"}},
+		}},
+	}
+	for i, f := range files {
+		contents, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual := map[string]interface{}{}
+		if err := yaml.Unmarshal(contents, &actual); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(expectedContents[i]) {
+			t.Errorf("expected %s to contain %v, got %v", expectedFiles[i], expectedContents[i], actual)
+		}
+	}
+
+	if args[len(args)-1] != filepath.Join(filepath.Dir(files[0]), "app") {
+		t.Errorf("expected the chart path last, got %v", args)
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	t.Run("helm failure", func(t *testing.T) {
+		root := ankhFile(t, dir, "helm-failure", "app")
+		fake := runnertest.NewFake(runnertest.Response{Stderr: "Error: parse error in deployment.yaml", Err: fmt.Errorf("exit status 1")})
+
+		_, err := Template(testLogger(), fake, root, testConfig())
+		if err == nil || !strings.Contains(err.Error(), "parse error in deployment.yaml") {
+			t.Errorf("expected the helm output in the error, got %v", err)
+		}
+	})
+
+	t.Run("unsupported environment", func(t *testing.T) {
+		root := ankhFile(t, dir, "unsupported-env", "app")
+		root.Charts[0].Values = map[string]interface{}{"staging": map[string]interface{}{}}
+		fake := runnertest.NewFake()
+
+		_, err := Template(testLogger(), fake, root, testConfig())
+		if err == nil || !strings.Contains(err.Error(), "unsupported environment 'staging'") {
+			t.Errorf("expected an unsupported environment error, got %v", err)
+		}
+		if len(fake.Calls()) != 0 {
+			t.Errorf("expected helm not to run, got %v", fake.Calls())
+		}
+	})
+
+	t.Run("ankh-values.yaml missing the environment", func(t *testing.T) {
+		root := ankhFile(t, dir, "missing-env", "app")
+		writeFile(t, filepath.Join(dir, "missing-env", "charts", "app", "ankh-values.yaml"), "production:\n  a: b\n")
+
+		_, err := Template(testLogger(), runnertest.NewFake(), root, testConfig())
+		if err == nil || !strings.Contains(err.Error(), "missing `dev` key") {
+			t.Errorf("expected a missing key error, got %v", err)
+		}
+	})
+
+	t.Run("ankh-resource-profiles.yaml with an unsupported key", func(t *testing.T) {
+		root := ankhFile(t, dir, "unsupported-key", "app")
+		writeFile(t, filepath.Join(dir, "unsupported-key", "charts", "app", "ankh-resource-profiles.yaml"), "constrained: {}\nhuge: {}\n")
+
+		_, err := Template(testLogger(), runnertest.NewFake(), root, testConfig())
+		if err == nil || !strings.Contains(err.Error(), "unsupported key `huge`") {
+			t.Errorf("expected an unsupported key error, got %v", err)
+		}
+	})
+
+	t.Run("error in a dependency stops templating", func(t *testing.T) {
+		root := ankhFile(t, dir, "dep-error-root", "app")
+		root.DependenciesResovled = []ankh.AnkhFile{ankhFile(t, dir, "dep-error-dep", "dep")}
+		fake := runnertest.NewFake(runnertest.Response{Stderr: "boom", Err: fmt.Errorf("exit status 1")})
+
+		if _, err := Template(testLogger(), fake, root, testConfig()); err == nil {
+			t.Error("expected an error")
+		}
+		if len(fake.Calls()) != 1 {
+			t.Errorf("expected templating to stop after the failed dependency, got %d calls", len(fake.Calls()))
+		}
+	})
+}
+
+// chartTarball builds a gzipped chart tarball the way `helm package` lays it
+// out, with every file under a directory named after the chart
+func chartTarball(t *testing.T, name string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	for path, contents := range files {
+		header := &tar.Header{Name: name + "/" + path, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestTemplateRemoteChartIsCached(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	tarball := chartTarball(t, "web", map[string]string{"Chart.yaml": "name: web\n"})
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// a registry without an index.yaml
+		if req.URL.Path != "/web-1.0.0.tgz" {
+			http.NotFound(w, req)
+			return
+		}
+		requests++
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	config := testConfig()
+	config.CurrentContext.HelmRegistryURL = server.URL
+
+	// every spelling of the same version shares a tarball name and cache ref
+	for _, version := range []string{"1.0.0", "v1.0.0", "=1.0.0"} {
+		root := ankh.AnkhFile{
+			Path:   filepath.Join(dir, "root", "ankh.yaml"),
+			Charts: []ankh.Chart{{Name: "web", Version: version}},
+		}
+		fake := runnertest.NewFake(runnertest.Response{Stdout: "rendered"})
+		if _, err := Template(testLogger(), fake, root, config); err != nil {
+			t.Fatal(err)
+		}
+
+		chartPath := fake.Calls()[0].Args[len(fake.Calls()[0].Args)-1]
+		if _, err := os.Stat(filepath.Join(chartPath, "Chart.yaml")); err != nil {
+			t.Errorf("expected the chart to be extracted: %v", err)
+		}
+	}
+
+	if requests != 1 {
+		t.Errorf("expected the chart to be downloaded once, got %d requests", requests)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "root", "charts")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written next to the ankh file, got %v", err)
+	}
+}
+
+func TestExactVersion(t *testing.T) {
+	tests := map[string]string{
+		"1.2.3":          "1.2.3",
+		" =1.2.3 ":       "1.2.3",
+		"= v1.2.3":       "1.2.3",
+		"v1.2.3-rc.1+b2": "1.2.3-rc.1+b2",
+		"1.2":            "",
+		"~1.2.3":         "",
+		">=1.2.3":        "",
+		"1.2.3 - 1.4.0":  "",
+		"*":              "",
+	}
+	for constraint, expected := range tests {
+		version, exact := exactVersion(constraint)
+		if version != expected || exact != (expected != "") {
+			t.Errorf("%q: expected %q, got %q (exact %v)", constraint, expected, version, exact)
+		}
+	}
+}
+
+func TestTemplateResolvesVersionThroughIndex(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	tarballs := map[string][]byte{
+		"1.2.0": chartTarball(t, "web", map[string]string{"Chart.yaml": "version: 1.2.0\n"}),
+		"1.2.5": chartTarball(t, "web", map[string]string{"Chart.yaml": "version: 1.2.5\n"}),
+		"1.3.0": chartTarball(t, "web", map[string]string{"Chart.yaml": "version: 1.3.0\n"}),
+	}
+	digest := func(b []byte) string {
+		sum := sha256.Sum256(b)
+		return hex.EncodeToString(sum[:])
+	}
+
+	index := "apiVersion: v1\nentries:\n  web:\n"
+	for _, version := range []string{"1.2.0", "1.2.5", "1.3.0"} {
+		index += fmt.Sprintf("  - name: web\n    version: %s\n    digest: %s\n    urls: [charts/web-%s.tgz]\n", version, digest(tarballs[version]), version)
+	}
+
+	// serve a tampered 1.3.0 to make sure digests are checked
+	served := map[string][]byte{
+		"/charts/web-1.2.0.tgz": tarballs["1.2.0"],
+		"/charts/web-1.2.5.tgz": tarballs["1.2.5"],
+		"/charts/web-1.3.0.tgz": tarballs["1.2.0"],
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/index.yaml" {
+			w.Write([]byte(index))
+			return
+		}
+		if b, ok := served[req.URL.Path]; ok {
+			w.Write(b)
+			return
+		}
+		http.NotFound(w, req)
+	}))
+	defer server.Close()
+
+	config := testConfig()
+	config.CurrentContext.HelmRegistryURL = server.URL
+
+	template := func(version string) (string, error) {
+		root := ankh.AnkhFile{
+			Path:   filepath.Join(dir, "root", "ankh.yaml"),
+			Charts: []ankh.Chart{{Name: "web", Version: version}},
+		}
+		fake := runnertest.NewFake(runnertest.Response{})
+		if _, err := Template(testLogger(), fake, root, config); err != nil {
+			return "", err
+		}
+
+		args := fake.Calls()[0].Args
+		chartYAML, err := ioutil.ReadFile(filepath.Join(args[len(args)-1], "Chart.yaml"))
+		return string(chartYAML), err
+	}
+
+	chartYAML, err := template("~1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chartYAML != "version: 1.2.5\n" {
+		t.Errorf("expected ~1.2 to resolve to 1.2.5, got %q", chartYAML)
+	}
+
+	if _, err := template(">=1.3 <2"); err == nil || !strings.Contains(err.Error(), "digest") {
+		t.Errorf("expected a digest mismatch error, got %v", err)
+	}
+
+	if _, err := template("^2"); err == nil || !strings.Contains(err.Error(), "satisfies '^2'") {
+		t.Errorf("expected an unsatisfiable constraint error, got %v", err)
+	}
+}
+
+// runnerFunc lets a test answer helm calls with a plain func
+type runnerFunc func(cmd runner.Command) error
+
+func (f runnerFunc) Run(cmd runner.Command) error { return f(cmd) }
+
+func TestTemplateParallel(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	defer func(p int) { Parallelism = p }(Parallelism)
+	Parallelism = 3
+
+	root := ankhFile(t, dir, "root", "c4", "c5")
+	root.DependenciesResovled = []ankh.AnkhFile{ankhFile(t, dir, "dep", "c0", "c1", "c2", "c3")}
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	// later charts finish first, so the output only comes out in order if
+	// it's put back together that way
+	r := runnerFunc(func(cmd runner.Command) error {
+		name := filepath.Base(cmd.Args[len(cmd.Args)-1])
+
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		n, _ := strconv.Atoi(strings.TrimPrefix(name, "c"))
+		time.Sleep(time.Duration(6-n) * 5 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		fmt.Fprintln(cmd.Stdout, name)
+		return nil
+	})
+
+	output, err := Template(testLogger(), r, root, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := strings.Join(strings.Fields(output), " "); actual != "c0 c1 c2 c3 c4 c5" {
+		t.Errorf("expected the output in dependency order, got %s", actual)
+	}
+	if maxRunning < 2 || maxRunning > 3 {
+		t.Errorf("expected up to 3 charts at once, got %d", maxRunning)
+	}
+}
+
+func TestTemplateParallelCancelsOnError(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	defer func(p int) { Parallelism = p }(Parallelism)
+	Parallelism = 2
+
+	root := ankhFile(t, dir, "root", "slow", "bad", "never1", "never2")
+
+	var mu sync.Mutex
+	started := []string{}
+	r := runnerFunc(func(cmd runner.Command) error {
+		name := filepath.Base(cmd.Args[len(cmd.Args)-1])
+		mu.Lock()
+		started = append(started, name)
+		mu.Unlock()
+
+		if name == "bad" {
+			fmt.Fprint(cmd.Stderr, "boom")
+			return fmt.Errorf("exit status 1")
+		}
+		// charts already running are killed by the cancelled context
+		<-cmd.Context.Done()
+		return cmd.Context.Err()
+	})
+
+	_, err := Template(testLogger(), r, root, testConfig())
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("expected the failing chart's error, got %v", err)
+	}
+	for _, name := range started {
+		if strings.HasPrefix(name, "never") {
+			t.Errorf("expected no charts to start after the failure, got %v", started)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package helm
+
+import (
+	"fmt"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/lock"
+	"github.com/sirupsen/logrus"
+)
+
+// remoteCharts returns the charts of an ankh file that are fetched from a
+// registry rather than checked in next to it, which are the ones that get
+// locked
+func remoteCharts(ankhFile ankh.AnkhFile) []lock.Chart {
+	charts := []lock.Chart{}
+	for _, chart := range ankhFile.Charts {
+		if _, isLocal := localChartDir(ankhFile, chart); !isLocal {
+			charts = append(charts, lock.Chart{Name: chart.Name, Version: chart.Version})
+		}
+	}
+	return charts
+}
+
+// pinFor returns the lock entry for a chart if it's locked at the version
+// the ankh file asks for
+func pinFor(l lock.Lock, chart ankh.Chart) *lock.Entry {
+	e, ok := l.Find(chart.Name)
+	if !ok || e.Version != chart.Version {
+		return nil
+	}
+	return &e
+}
+
+// CheckLocks makes sure every ankh file in the tree that uses remote charts
+// has an ankh.lock that matches it
+func CheckLocks(ankhFile ankh.AnkhFile) error {
+	for _, f := range ankh.TopologicalOrder(ankhFile, true) {
+		charts := remoteCharts(f)
+		lockPath := lock.Path(f.Path)
+
+		l, exists, err := lock.Read(lockPath)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			if len(charts) > 0 {
+				return fmt.Errorf("%s is missing, run `ankh lock` to create it", lockPath)
+			}
+			continue
+		}
+
+		if err := l.Check(charts); err != nil {
+			return fmt.Errorf("%s is out of date, run `ankh lock` to refresh it:\n%v", lockPath, err)
+		}
+	}
+
+	return nil
+}
+
+// Lock writes an ankh.lock next to every ankh file in the tree that uses
+// remote charts. Charts that are already locked at the requested version
+// keep their entries unless update is set, in which case everything is
+// resolved again against a freshly fetched index.
+func Lock(log *logrus.Logger, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig, update bool) error {
+	for _, f := range ankh.TopologicalOrder(ankhFile, true) {
+		charts := remoteCharts(f)
+		lockPath := lock.Path(f.Path)
+
+		existing, exists, err := lock.Read(lockPath)
+		if err != nil {
+			return err
+		}
+		if !exists && len(charts) == 0 {
+			continue
+		}
+
+		updated := lock.Lock{Charts: []lock.Entry{}}
+		for _, chart := range f.Charts {
+			if _, isLocal := localChartDir(f, chart); isLocal {
+				continue
+			}
+
+			if pin := pinFor(existing, chart); pin != nil && !update {
+				updated.Charts = append(updated.Charts, *pin)
+				continue
+			}
+
+			entry, err := fetchChart(log, chart, ankhConfig.CurrentContext, nil, update)
+			if err != nil {
+				return err
+			}
+
+			log.Infof("locked chart '%s' version '%s' at %s", chart.Name, chart.Version, entry.Version)
+			updated.Charts = append(updated.Charts, lock.Entry{
+				Name:     chart.Name,
+				Version:  chart.Version,
+				Resolved: entry.Version,
+				URL:      entry.URL,
+				Digest:   "sha256:" + entry.Digest,
+			})
+		}
+
+		if err := lock.Write(lockPath, updated); err != nil {
+			return err
+		}
+		log.Infof("wrote %s", lockPath)
+	}
+
+	return nil
+}
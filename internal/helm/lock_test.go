@@ -0,0 +1,133 @@
+package helm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/lock"
+	"github.com/jondlm/ankh/internal/runner/runnertest"
+)
+
+// testRegistry serves an index.yaml listing the given versions of the `web`
+// chart. It returns a func that adds another version later on.
+func testRegistry(t *testing.T, versions ...string) (*httptest.Server, func(version string)) {
+	tarballs := map[string][]byte{}
+	index := func() string {
+		s := "apiVersion: v1\nentries:\n  web:\n"
+		for version, tarball := range tarballs {
+			sum := sha256.Sum256(tarball)
+			s += fmt.Sprintf("  - name: web\n    version: %s\n    digest: %s\n    urls: [web-%s.tgz]\n", version, hex.EncodeToString(sum[:]), version)
+		}
+		return s
+	}
+	add := func(version string) {
+		tarballs[version] = chartTarball(t, "web", map[string]string{"Chart.yaml": "version: " + version + "\n"})
+	}
+	for _, version := range versions {
+		add(version)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/index.yaml" {
+			w.Write([]byte(index()))
+			return
+		}
+		for version, tarball := range tarballs {
+			if req.URL.Path == "/web-"+version+".tgz" {
+				w.Write(tarball)
+				return
+			}
+		}
+		http.NotFound(w, req)
+	}))
+
+	return server, add
+}
+
+func TestLock(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	server, addVersion := testRegistry(t, "1.2.0", "1.2.3")
+	defer server.Close()
+
+	config := testConfig()
+	config.CurrentContext.HelmRegistryURL = server.URL
+
+	root := ankhFile(t, dir, "root", "local")
+	root.Charts = append(root.Charts, ankh.Chart{Name: "web", Version: "~1.2"})
+	dep := ankhFile(t, dir, "dep", "only-local")
+	root.AdminDependenciesResolved = []ankh.AnkhFile{dep}
+
+	if err := CheckLocks(root); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("expected a missing lock error, got %v", err)
+	}
+
+	if err := Lock(testLogger(), root, config, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckLocks(root); err != nil {
+		t.Errorf("expected the lock to be up to date, got %v", err)
+	}
+
+	l, _, err := lock.Read(lock.Path(root.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Charts) != 1 {
+		t.Fatalf("expected only the remote chart to be locked, got %+v", l)
+	}
+	if e := l.Charts[0]; e.Name != "web" || e.Version != "~1.2" || e.Resolved != "1.2.3" || e.URL != server.URL+"/web-1.2.3.tgz" || !strings.HasPrefix(e.Digest, "sha256:") {
+		t.Errorf("unexpected lock entry %+v", e)
+	}
+	if _, exists, _ := lock.Read(lock.Path(dep.Path)); exists {
+		t.Error("expected no lock for a file with only local charts")
+	}
+
+	// a newer version shows up, but templating sticks to the lock
+	addVersion("1.2.9")
+	fake := runnertest.NewFake(runnertest.Response{}, runnertest.Response{})
+	outputs, err := TemplateCharts(testLogger(), fake, root, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outputs[1].Version != "1.2.3" {
+		t.Errorf("expected the output to record the locked version, got %+v", outputs[1])
+	}
+	args := fake.Calls()[1].Args
+	chartYAML, err := ioutil.ReadFile(filepath.Join(args[len(args)-1], "Chart.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(chartYAML) != "version: 1.2.3\n" {
+		t.Errorf("expected the locked version to be templated, got %q", chartYAML)
+	}
+
+	// a plain lock keeps the existing entry, --update moves it forward
+	if err := Lock(testLogger(), root, config, false); err != nil {
+		t.Fatal(err)
+	}
+	if l, _, _ := lock.Read(lock.Path(root.Path)); l.Charts[0].Resolved != "1.2.3" {
+		t.Errorf("expected the entry to be kept, got %+v", l.Charts[0])
+	}
+	if err := Lock(testLogger(), root, config, true); err != nil {
+		t.Fatal(err)
+	}
+	if l, _, _ := lock.Read(lock.Path(root.Path)); l.Charts[0].Resolved != "1.2.9" {
+		t.Errorf("expected the entry to be updated, got %+v", l.Charts[0])
+	}
+
+	// changing the requested version makes the lock stale
+	root.Charts[1].Version = "~1.3"
+	if err := CheckLocks(root); err == nil || !strings.Contains(err.Error(), "out of date") {
+		t.Errorf("expected an out of date lock error, got %v", err)
+	}
+}
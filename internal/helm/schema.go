@@ -0,0 +1,128 @@
+package helm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/schema"
+	"github.com/jondlm/ankh/internal/secrets"
+	"github.com/jondlm/ankh/internal/util"
+	"github.com/jondlm/ankh/internal/values"
+	"github.com/sirupsen/logrus"
+)
+
+// SchemaFile is the JSON Schema a chart can ship next to its values.yaml
+const SchemaFile = "values.schema.json"
+
+// SchemaViolation is a value of a chart that doesn't match its
+// values.schema.json
+type SchemaViolation struct {
+	AnkhFilePath string
+	Chart        string
+	schema.Violation
+	// Sources are the layers that set the value. It's empty for values that
+	// are missing.
+	Sources []values.Origin
+}
+
+func (v SchemaViolation) Error() string {
+	s := fmt.Sprintf("chart '%s': %s: %s", v.Chart, v.Path, v.Message)
+
+	sources := []string{}
+	for _, o := range v.Sources {
+		sources = append(sources, fmt.Sprintf("%s in %s", o.Layer, o.File))
+	}
+	if len(sources) > 0 {
+		s += " (set by " + strings.Join(sources, ", ") + ")"
+	}
+	return s
+}
+
+// validateValues merges the layers of a chart and checks the result against
+// the chart's schema. Charts without one always pass. Secret references and
+// redacted secrets aren't known yet, so they only count for `required`.
+// Keywords of the schema that aren't checked are logged as a warning.
+func validateValues(log *logrus.Logger, ankhFile ankh.AnkhFile, chart ankh.Chart, chartPath string, layers []values.Layer) ([]SchemaViolation, error) {
+	schemaPath := filepath.Join(chartPath, SchemaFile)
+	if _, err := os.Stat(schemaPath); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	s, err := schema.Read(schemaPath)
+	if err != nil {
+		return nil, fmt.Errorf("chart '%s' has an invalid %s: %v", chart.Name, SchemaFile, err)
+	}
+	if len(s.Unsupported) > 0 {
+		log.Warnf("chart '%s': ankh doesn't check %s of its %s", chart.Name, strings.Join(s.Unsupported, ", "), SchemaFile)
+	}
+	s.Unknown = func(v interface{}) bool {
+		str, ok := v.(string)
+		return ok && (secrets.IsRef(str) || str == secrets.Redacted)
+	}
+
+	merged, err := values.Merge(layers)
+	if err != nil {
+		return nil, fmt.Errorf("unable to merge the values of chart '%s': %v", chart.Name, err)
+	}
+
+	violations := []SchemaViolation{}
+	for _, v := range s.Validate(merged.Values) {
+		violations = append(violations, SchemaViolation{
+			AnkhFilePath: ankhFile.Path,
+			Chart:        chart.Name,
+			Violation:    v,
+			Sources:      merged.Sources(v.Keys...),
+		})
+	}
+	return violations, nil
+}
+
+// checkSchema is validateValues for templating, where any violation is an
+// error
+func checkSchema(log *logrus.Logger, ankhFile ankh.AnkhFile, chart ankh.Chart, chartPath string, layers []values.Layer) error {
+	violations, err := validateValues(log, ankhFile, chart, chartPath, layers)
+	if err != nil {
+		return err
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	errs := []error{}
+	for _, v := range violations {
+		errs = append(errs, v)
+	}
+	return fmt.Errorf("values of chart '%s' don't match its %s:\n%s", chart.Name, SchemaFile, util.MultiErrorFormat(errs))
+}
+
+// ErrNotCached is returned by ValidateChart for remote charts that aren't in
+// the chart cache
+var ErrNotCached = errors.New("chart isn't in the chart cache")
+
+// ValidateChart checks the values of a chart against its values.schema.json
+// without templating it or contacting the registry, so remote charts are only
+// checked once they're cached. Charts without a schema always pass. Without
+// secrets a chart's secrets files are left out, along with the `required`
+// violations they could have been setting the values for.
+func ValidateChart(log *logrus.Logger, ankhFile ankh.AnkhFile, chart ankh.Chart, ankhConfig ankh.AnkhConfig, withSecrets bool) ([]SchemaViolation, error) {
+	layers, chartPath, err := chartValues(log, ankhFile, chart, ankhConfig, valuesOptions{offline: true, withoutSecrets: !withSecrets})
+	if err != nil {
+		return nil, err
+	}
+	violations, err := validateValues(log, ankhFile, chart, chartPath, layers)
+	if err != nil || withSecrets || len(secrets.Files(ankhFile.Path, chart.Name, ankhConfig.CurrentContext.Environment)) == 0 {
+		return violations, err
+	}
+
+	known := []SchemaViolation{}
+	for _, v := range violations {
+		if len(v.Missing) == 0 {
+			known = append(known, v)
+		}
+	}
+	return known, nil
+}
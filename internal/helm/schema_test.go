@@ -0,0 +1,158 @@
+package helm
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/cache"
+	"github.com/jondlm/ankh/internal/runner/runnertest"
+	"github.com/jondlm/ankh/internal/secrets"
+)
+
+const appSchema = `{
+  "type": "object",
+  "required": ["image", "password"],
+  "additionalProperties": false,
+  "properties": {
+    "image": {"type": "object", "required": ["repo"], "properties": {"repo": {"type": "string"}, "tag": {"type": "string"}}},
+    "replicas": {"type": "integer", "minimum": 1},
+    "password": {"type": "string", "minLength": 8}
+  }
+}`
+
+func TestTemplateValidatesSchema(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	root := ankhFile(t, dir, "root", "app")
+	root.Charts[0].DefaultValues = map[string]interface{}{"replicas": 0, "password": "ref+vault://secret/app#password"}
+	chartDir := filepath.Join(dir, "root", "charts", "app")
+	writeFile(t, filepath.Join(chartDir, SchemaFile), appSchema)
+	writeFile(t, filepath.Join(chartDir, "values.yaml"), "image:\n  repo: app\n")
+	writeFile(t, filepath.Join(chartDir, "ankh-values.yaml"), "dev:\n  image:\n    tag: 1\n  replica: 2\nproduction: {}\n")
+
+	fake := runnertest.NewFake(runnertest.Response{Stdout: "rendered"})
+	_, err := Template(testLogger(), fake, root, testConfig())
+	if err == nil {
+		t.Fatal("expected values that don't match the schema to fail")
+	}
+	if len(fake.Calls()) != 0 {
+		t.Error("expected helm not to run")
+	}
+
+	ankhValues := filepath.Join(chartDir, "ankh-values.yaml")
+	expected := []string{
+		"values of chart 'app' don't match its values.schema.json:",
+		"chart 'app': $.image.tag: expected string, got integer (set by ankh-values.yaml[dev] in " + ankhValues + ")",
+		"chart 'app': $.replica: isn't an allowed key, did you mean replicas? (set by ankh-values.yaml[dev] in " + ankhValues + ")",
+		"chart 'app': $.replicas: must be at least 1 (set by default_values in " + root.Path + ")",
+	}
+	if err.Error() != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), err)
+	}
+
+	// the secret reference isn't known until it's resolved, so only the
+	// missing password is a problem here
+	root.Charts[0].DefaultValues = map[string]interface{}{"replicas": 1}
+	writeFile(t, filepath.Join(chartDir, "ankh-values.yaml"), "dev:\n  image:\n    tag: v1\nproduction: {}\n")
+	violations, err := ValidateChart(testLogger(), root, root.Charts[0], testConfig(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 1 || violations[0].Error() != "chart 'app': $: missing required password" || violations[0].AnkhFilePath != root.Path {
+		t.Errorf("unexpected violations %v", violations)
+	}
+
+	root.Charts[0].DefaultValues["password"] = "ref+vault://secret/app#password"
+	violations, err = ValidateChart(testLogger(), root, root.Charts[0], testConfig(), true)
+	if err != nil || len(violations) != 0 {
+		t.Errorf("expected no violations, got %v, %v", violations, err)
+	}
+}
+
+func TestValidateChartInvalidSchema(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	root := ankhFile(t, dir, "root", "app")
+	writeFile(t, filepath.Join(dir, "root", "charts", "app", SchemaFile), "{")
+	if _, err := ValidateChart(testLogger(), root, root.Charts[0], testConfig(), true); err == nil || !strings.Contains(err.Error(), "invalid values.schema.json") {
+		t.Errorf("expected an error for an invalid schema, got %v", err)
+	}
+}
+
+func TestValidateChartWarnsAboutUnsupportedKeywords(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	root := ankhFile(t, dir, "root", "app")
+	root.Charts[0].DefaultValues = map[string]interface{}{"url": "not a url"}
+	writeFile(t, filepath.Join(dir, "root", "charts", "app", SchemaFile), `{"properties": {"url": {"type": "string", "format": "uri"}}}`)
+
+	var out bytes.Buffer
+	log := testLogger()
+	log.Out = &out
+	violations, err := ValidateChart(log, root, root.Charts[0], testConfig(), true)
+	if err != nil || len(violations) != 0 {
+		t.Errorf("expected no violations, got %v, %v", violations, err)
+	}
+	if !strings.Contains(out.String(), "chart 'app': ankh doesn't check #/properties/url/format of its values.schema.json") {
+		t.Errorf("expected a warning about the format keyword, got %q", out.String())
+	}
+}
+
+func TestValidateChartOffline(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	config := testConfig()
+	// nothing listens here, so any request fails
+	config.CurrentContext.HelmRegistryURL = "http://127.0.0.1:1"
+
+	root := ankh.AnkhFile{
+		Path:   filepath.Join(dir, "root", "ankh.yaml"),
+		Charts: []ankh.Chart{{Name: "web", Version: "1.0.0", DefaultValues: map[string]interface{}{"replicas": 0}}},
+	}
+	if _, err := ValidateChart(testLogger(), root, root.Charts[0], config, true); err != ErrNotCached {
+		t.Fatalf("expected a chart that isn't cached to be skipped, got %v", err)
+	}
+
+	tarball := chartTarball(t, "web", map[string]string{
+		"Chart.yaml":         "name: web\nversion: 1.0.0\n",
+		"values.yaml":        "image:\n  repo: web\n",
+		"values.schema.json": appSchema,
+	})
+	if _, err := cache.New(ankh.ChartCacheDir).Put("web", "1.0.0", "http://example.com/web-1.0.0.tgz", "", bytes.NewReader(tarball)); err != nil {
+		t.Fatal(err)
+	}
+
+	violations, err := ValidateChart(testLogger(), root, root.Charts[0], config, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, v := range violations {
+		got = append(got, v.Error())
+	}
+	expected := []string{
+		"chart 'web': $: missing required password",
+		"chart 'web': $.replicas: must be at least 1 (set by default_values in " + root.Path + ")",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+
+	// the password could be in the secrets file, which can't be read without
+	// the key
+	writeFile(t, filepath.Join(dir, "root", secrets.Dir, "web.yaml"), "not decryptable\n")
+	violations, err = ValidateChart(testLogger(), root, root.Charts[0], config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 1 || violations[0].Path != "$.replicas" {
+		t.Errorf("expected only the replicas violation without secrets, got %v", violations)
+	}
+}
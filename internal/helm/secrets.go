@@ -0,0 +1,80 @@
+package helm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/secrets"
+	"gopkg.in/yaml.v2"
+)
+
+// chartSecrets keeps track of the values files of a chart that hold secrets
+// and of the secrets themselves, so the files can be removed once helm is
+// done and the secrets redacted from anything that's logged or stored
+type chartSecrets struct {
+	resolver *secrets.Resolver
+	paths    []string
+	values   []string
+}
+
+// newVaultProvider returns the provider for `ref+vault://` references in the
+// current context. One is shared by every chart of a run so each secret is
+// only fetched once.
+func newVaultProvider(ctx ankh.Context) *secrets.VaultProvider {
+	return secrets.NewVaultProvider(
+		firstSet(os.Getenv("VAULT_ADDR"), ctx.VaultAddress),
+		secrets.VaultToken(),
+		firstSet(os.Getenv("VAULT_NAMESPACE"), ctx.VaultNamespace),
+	)
+}
+
+// newResolver returns a resolver for the `ref+env://`, `ref+file://` and
+// `ref+vault://` references in a chart's values. Files are relative to the
+// ankh file.
+func newResolver(ankhFile ankh.AnkhFile, vault *secrets.VaultProvider) *secrets.Resolver {
+	return secrets.NewResolver(map[string]secrets.Provider{
+		"env":   secrets.EnvProvider{},
+		"file":  secrets.FileProvider{Dir: filepath.Dir(ankhFile.Path)},
+		"vault": vault,
+	})
+}
+
+// writeValues resolves the secret references in values and writes them to
+// path. A file that ends up holding secrets is only readable by its owner.
+func (s *chartSecrets) writeValues(path string, values interface{}) error {
+	resolved, found, err := s.resolver.Resolve(values)
+	if err != nil {
+		return err
+	}
+
+	valuesBytes, err := yaml.Marshal(resolved)
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if len(found) > 0 {
+		mode = 0600
+		s.add([]string{path}, found)
+	}
+
+	// ankh-values.yaml is rewritten in place, and WriteFile would keep the
+	// mode of the copy
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(path, valuesBytes, mode)
+}
+
+func (s *chartSecrets) add(paths, values []string) {
+	s.paths = append(s.paths, paths...)
+	s.values = append(s.values, values...)
+}
+
+func (s *chartSecrets) remove() {
+	for _, path := range s.paths {
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,254 @@
+package helm
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/runner/runnertest"
+	"github.com/jondlm/ankh/internal/secrets"
+)
+
+// writeEncrypted encrypts contents to the identity and writes them to path
+func writeEncrypted(t *testing.T, path, contents string, identity secrets.Identity) {
+	encrypted, err := secrets.Encrypt([]byte(contents), []secrets.Recipient{identity.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, string(encrypted))
+}
+
+func TestTemplateSecrets(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	identity, err := secrets.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKeyPath := ankh.SecretsKeyPath
+	ankh.SecretsKeyPath = filepath.Join(dir, "keys", "secrets.key")
+	defer func() { ankh.SecretsKeyPath = oldKeyPath }()
+	if err := secrets.WriteIdentity(ankh.SecretsKeyPath, identity); err != nil {
+		t.Fatal(err)
+	}
+
+	root := ankhFile(t, dir, "root", "app", "other")
+	secretsDir := filepath.Join(dir, "root", secrets.Dir)
+	writeEncrypted(t, filepath.Join(secretsDir, "app.yaml"), "password: everywhere-secret\n", identity)
+	writeEncrypted(t, filepath.Join(secretsDir, "dev", "app.yaml"), "password: dev-only-secret\n", identity)
+	writeEncrypted(t, filepath.Join(secretsDir, "production", "app.yaml"), "password: production-secret\n", identity)
+
+	// the decrypted files only exist while helm runs, so read them then
+	contents := map[string]string{}
+	var paths []string
+	fake := &runnertest.Fake{
+		Respond: func(call runnertest.Call) runnertest.Response {
+			for _, f := range valuesFiles(call.Args) {
+				if strings.HasPrefix(filepath.Base(f), "secrets-") {
+					b, _ := ioutil.ReadFile(f)
+					contents[filepath.Base(f)] = string(b)
+					paths = append(paths, f)
+				}
+			}
+			return runnertest.Response{Stdout: "rendered\n"}
+		},
+	}
+
+	outputs, err := TemplateCharts(testLogger(), fake, root, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := valuesFiles(fake.Calls()[0].Args)
+	last := []string{}
+	for _, f := range files[len(files)-2:] {
+		last = append(last, filepath.Base(f))
+	}
+	if strings.Join(last, " ") != "secrets-0.yaml secrets-1.yaml" {
+		t.Errorf("expected the secrets files to be the last values files, got %v", files)
+	}
+	if contents["secrets-0.yaml"] != "password: everywhere-secret\n" || contents["secrets-1.yaml"] != "password: dev-only-secret\n" {
+		t.Errorf("unexpected decrypted secrets %v", contents)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed after templating", path)
+		}
+	}
+
+	if len(fake.Calls()) != 2 || len(valuesFiles(fake.Calls()[1].Args)) != len(files)-2 {
+		t.Error("expected the chart without secrets not to get any secrets files")
+	}
+
+	redactor := Redactor(outputs)
+	if redactor.Redact("dev-only-secret everywhere-secret") != secrets.Redacted+" "+secrets.Redacted {
+		t.Errorf("expected the secret values to be redacted, got %v", outputs[0].SecretValues)
+	}
+}
+
+func TestTemplateSecretsErrors(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	oldKeyPath := ankh.SecretsKeyPath
+	ankh.SecretsKeyPath = filepath.Join(dir, "keys", "secrets.key")
+	defer func() { ankh.SecretsKeyPath = oldKeyPath }()
+
+	root := ankhFile(t, dir, "root", "app")
+	secretsPath := filepath.Join(dir, "root", secrets.Dir, "app.yaml")
+	writeFile(t, secretsPath, "password: not-encrypted\n")
+
+	if _, err := Template(testLogger(), echoChart(), root, testConfig()); err == nil || !strings.Contains(err.Error(), "can't be decrypted") {
+		t.Errorf("expected a missing key error, got %v", err)
+	}
+
+	identity, err := secrets.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := secrets.WriteIdentity(ankh.SecretsKeyPath, identity); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Template(testLogger(), echoChart(), root, testConfig()); err == nil || !strings.Contains(err.Error(), "isn't encrypted") {
+		t.Errorf("expected a plain text secrets error, got %v", err)
+	}
+
+	other, err := secrets.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEncrypted(t, secretsPath, "password: not-for-us\n", other)
+	if _, err := Template(testLogger(), echoChart(), root, testConfig()); err == nil || !strings.Contains(err.Error(), secrets.ErrNoIdentity.Error()) {
+		t.Errorf("expected a wrong key error, got %v", err)
+	}
+}
+
+func TestTemplateSecretRefs(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/app" || r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"password":"vault-password"}}}`))
+	}))
+	defer vault.Close()
+
+	for name, value := range map[string]string{"VAULT_ADDR": vault.URL, "VAULT_TOKEN": "s.token", "ANKH_TEST_API_KEY": "env-api-key"} {
+		old, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	root := ankhFile(t, dir, "root", "app")
+	root.Charts[0].DefaultValues = map[string]interface{}{"replicas": 2}
+	root.Charts[0].Values = map[string]interface{}{
+		"dev": map[interface{}]interface{}{"db": map[interface{}]interface{}{"password": "ref+vault://secret/app#password"}},
+	}
+	writeFile(t, filepath.Join(dir, "root", "token"), "file-token\n")
+	writeFile(t, filepath.Join(dir, "root", "charts", "app", "ankh-values.yaml"),
+		"dev:\n  apiKey: ref+env://ANKH_TEST_API_KEY\n  token: ref+file://token\nproduction:\n  apiKey: ref+env://UNUSED\n")
+
+	contents := map[string]string{}
+	var files []string
+	fake := &runnertest.Fake{
+		Respond: func(call runnertest.Call) runnertest.Response {
+			files = valuesFiles(call.Args)
+			for _, f := range files {
+				b, _ := ioutil.ReadFile(f)
+				contents[filepath.Base(f)] = string(b)
+			}
+			return runnertest.Response{Stdout: "password: vault-password\n"}
+		},
+	}
+
+	outputs, err := TemplateCharts(testLogger(), fake, root, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"default-values.yaml": "replicas: 2\n",
+		"values.yaml":         "db:\n  password: vault-password\n",
+		"ankh-values.yaml":    "apiKey: env-api-key\ntoken: file-token\n",
+	}
+	for name, e := range expected {
+		if contents[name] != e {
+			t.Errorf("expected %s to be %q, got %q", name, e, contents[name])
+		}
+	}
+
+	// only the files that held secrets are removed
+	for _, f := range files {
+		_, err := os.Stat(f)
+		if filepath.Base(f) == "default-values.yaml" && err != nil {
+			t.Errorf("expected %s to be kept", f)
+		}
+		if filepath.Base(f) != "default-values.yaml" && !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed after templating", f)
+		}
+	}
+
+	if Redactor(outputs).Redact(outputs[0].Output) != "password: "+secrets.Redacted+"\n" {
+		t.Errorf("expected resolved secrets to be redacted, got %v", outputs[0].SecretValues)
+	}
+
+	root.Charts[0].Values["dev"] = map[interface{}]interface{}{"password": "ref+vault://secret/missing#password"}
+	if _, err := Template(testLogger(), echoChart(), root, testConfig()); err == nil || !strings.Contains(err.Error(), "no vault secret at 'secret/missing'") {
+		t.Errorf("expected a missing secret error, got %v", err)
+	}
+}
+
+func TestTemplateSharesVaultProvider(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	var reads int32
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/app" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&reads, 1)
+		w.Write([]byte(`{"data":{"data":{"password":"vault-password"}}}`))
+	}))
+	defer vault.Close()
+
+	for name, value := range map[string]string{"VAULT_ADDR": vault.URL, "VAULT_TOKEN": "s.token"} {
+		old, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	ref := map[string]interface{}{"password": "ref+vault://secret/app#password"}
+	root := ankhFile(t, dir, "root", "app", "worker")
+	root.Charts[0].DefaultValues = ref
+	root.Charts[1].DefaultValues = ref
+	dep := ankhFile(t, dir, "dep", "db")
+	dep.Charts[0].DefaultValues = ref
+	root.DependenciesResovled = []ankh.AnkhFile{dep}
+
+	if _, err := Template(testLogger(), echoChart(), root, testConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if reads != 1 {
+		t.Errorf("expected the secret to be read once for every chart, got %d reads", reads)
+	}
+}
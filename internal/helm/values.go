@@ -0,0 +1,286 @@
+package helm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/cache"
+	"github.com/jondlm/ankh/internal/lock"
+	"github.com/jondlm/ankh/internal/secrets"
+	"github.com/jondlm/ankh/internal/util"
+	"github.com/jondlm/ankh/internal/values"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// layer is a layer of values along with the name of the values file it's
+// written to for helm
+type layer struct {
+	values.Layer
+	valuesFile string
+}
+
+// chartSource is where the files of a chart came from: a directory next to
+// the ankh file or a tarball in the chart cache
+type chartSource struct {
+	path    string
+	tarball bool
+}
+
+// file names a file of the chart for humans
+func (s chartSource) file(chart ankh.Chart, name string) string {
+	if s.tarball {
+		return s.path + ":" + chart.Name + "/" + name
+	}
+	return filepath.Join(s.path, name)
+}
+
+// valuesOptions changes how chartValues gets a chart and its values ready
+type valuesOptions struct {
+	// offline only takes remote charts from the chart cache, failing with
+	// ErrNotCached for any that aren't there
+	offline bool
+	// withoutSecrets leaves the chart's secrets files out
+	withoutSecrets bool
+}
+
+// prepareChart copies a local chart, or extracts a remote one, into dir and
+// returns the path of the copy
+func prepareChart(log *logrus.Logger, dir string, chart ankh.Chart, ankhFile ankh.AnkhFile, ctx ankh.Context, pin *lock.Entry, offline bool) (string, chartSource, error) {
+	chartPath := filepath.Join(dir, chart.Name)
+
+	// if we already have a dir, let's just copy it to a temp directory so we can
+	// make changes to the ankh specific yaml files before passing them as `-f`
+	// args to `helm template`
+	if dirPath, isLocal := localChartDir(ankhFile, chart); isLocal {
+		if err := util.CopyDir(dirPath, chartPath); err != nil {
+			return "", chartSource{}, err
+		}
+		return chartPath, chartSource{path: dirPath}, nil
+	}
+
+	var entry cache.Entry
+	if offline {
+		cached, ok, err := cachedChart(cache.New(ankh.ChartCacheDir), chart, pin)
+		if err != nil {
+			return "", chartSource{}, err
+		}
+		if !ok {
+			return "", chartSource{}, ErrNotCached
+		}
+		entry = cached
+	} else {
+		fetched, err := fetchChart(log, chart, ctx, pin, false)
+		if err != nil {
+			return "", chartSource{}, err
+		}
+		entry = fetched
+	}
+
+	f, err := os.Open(entry.Path)
+	if err != nil {
+		return "", chartSource{}, err
+	}
+	defer f.Close()
+
+	log.Debugf("untarring chart to %s", dir)
+	if err = util.Untar(dir, f); err != nil {
+		return "", chartSource{}, err
+	}
+	return chartPath, chartSource{path: entry.Path, tarball: true}, nil
+}
+
+// chartLayers returns the layers of values that apply to a chart in the
+// current context, lowest precedence first, which is the order they're
+// passed to helm in. Secrets files go on top of all of them.
+func chartLayers(chart ankh.Chart, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig, chartPath string, source chartSource) ([]layer, error) {
+	ctx := ankhConfig.CurrentContext
+	layers := []layer{}
+	add := func(name, file, valuesFile string, v interface{}) {
+		layers = append(layers, layer{Layer: values.Layer{Name: name, File: file, Values: v}, valuesFile: valuesFile})
+	}
+
+	if chart.DefaultValues != nil {
+		add("default_values", ankhFile.Path, "default-values.yaml", chart.DefaultValues)
+	}
+
+	if chart.Values != nil && chart.Values[ctx.Environment] != nil {
+		add("values["+ctx.Environment+"]", ankhFile.Path, "values.yaml", chart.Values[ctx.Environment])
+	}
+
+	if chart.ResourceProfiles != nil && chart.ResourceProfiles[ctx.ResourceProfile] != nil {
+		add("resource_profiles["+ctx.ResourceProfile+"]", ankhFile.Path, "resource-profiles.yaml", chart.ResourceProfiles[ctx.ResourceProfile])
+	}
+
+	valuesPath := filepath.Join(chartPath, "ankh-values.yaml")
+	if _, err := os.Stat(valuesPath); err == nil {
+		reduced, err := reduceYAMLFile(valuesPath, ctx.Environment, ankhConfig.SupportedEnvironments)
+		if err != nil {
+			return nil, fmt.Errorf("unable to process ankh-values.yaml file for chart '%s': %v", chart.Name, err)
+		}
+		add("ankh-values.yaml["+ctx.Environment+"]", source.file(chart, "ankh-values.yaml"), "ankh-values.yaml", reduced)
+	}
+
+	resourceProfilesPath := filepath.Join(chartPath, "ankh-resource-profiles.yaml")
+	if _, err := os.Stat(resourceProfilesPath); err == nil {
+		reduced, err := reduceYAMLFile(resourceProfilesPath, ctx.ResourceProfile, ankhConfig.SupportedResourceProfiles)
+		if err != nil {
+			return nil, fmt.Errorf("unable to process ankh-resource-profiles.yaml file for chart '%s': %v", chart.Name, err)
+		}
+		add("ankh-resource-profiles.yaml["+ctx.ResourceProfile+"]", source.file(chart, "ankh-resource-profiles.yaml"), "ankh-resource-profiles.yaml", reduced)
+	}
+
+	// globals win over every other layer apart from secrets, the way `--set`
+	// used to. A values file keeps their types and nesting intact.
+	if len(ctx.Global) > 0 {
+		add("global", strings.Join(ankh.AnkhConfigPaths, ":"), "globals.yaml", map[string]interface{}{"global": ctx.Global})
+	}
+
+	return layers, nil
+}
+
+// ChartValues returns every layer of values a chart from an ankh file or
+// its dependencies is templated with, lowest precedence first. It starts
+// with the chart's own values.yaml and ends with its secrets files. Secret
+// values are redacted and `ref+` references are left as they are. The chart
+// name can be left out when the ankh file only has one chart.
+func ChartValues(log *logrus.Logger, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig, chartName string) ([]values.Layer, error) {
+	f, chart, err := findChart(ankhFile, ankhConfig, chartName)
+	if err != nil {
+		return nil, err
+	}
+	layers, _, err := chartValues(log, f, chart, ankhConfig, valuesOptions{})
+	return layers, err
+}
+
+// chartValues gets a chart ready in the working directory and returns every
+// layer of its values along with the path of the chart
+func chartValues(log *logrus.Logger, ankhFile ankh.AnkhFile, chart ankh.Chart, ankhConfig ankh.AnkhConfig, opts valuesOptions) ([]values.Layer, string, error) {
+	if err := chart.Validate(ankhConfig); err != nil {
+		return nil, "", err
+	}
+
+	l, _, err := lock.Read(lock.Path(ankhFile.Path))
+	if err != nil {
+		return nil, "", err
+	}
+
+	dataDir, err := ankh.DataDir()
+	if err != nil {
+		return nil, "", err
+	}
+	tmpDir, err := ioutil.TempDir(dataDir, chart.Name+"-")
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx := ankhConfig.CurrentContext
+	chartPath, source, err := prepareChart(log, tmpDir, chart, ankhFile, ctx, pinFor(l, chart), opts.offline)
+	if err != nil {
+		return nil, "", err
+	}
+
+	layers, err := chartLayers(chart, ankhFile, ankhConfig, chartPath, source)
+	if err != nil {
+		return nil, "", err
+	}
+	var secretsFiles []secretsFile
+	if !opts.withoutSecrets {
+		if secretsFiles, err = readSecrets(ankhFile, chart, ctx.Environment); err != nil {
+			return nil, "", err
+		}
+	}
+
+	all, err := valueLayers(chart, chartPath, source, layers, secretsFiles, ctx.Environment)
+	return all, chartPath, err
+}
+
+// valueLayers puts the chart's own values.yaml under the layers ankh passes
+// to helm and the secrets files over them, which is everything helm merges.
+// Secret values are redacted.
+func valueLayers(chart ankh.Chart, chartPath string, source chartSource, layers []layer, secretsFiles []secretsFile, environment string) ([]values.Layer, error) {
+	result := []values.Layer{}
+
+	chartDefaults, err := ioutil.ReadFile(filepath.Join(chartPath, "values.yaml"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defaults := map[interface{}]interface{}{}
+		if err := yaml.Unmarshal(chartDefaults, &defaults); err != nil {
+			return nil, fmt.Errorf("unable to parse values.yaml of chart '%s': %v", chart.Name, err)
+		}
+		result = append(result, values.Layer{Name: "chart values.yaml", File: source.file(chart, "values.yaml"), Values: defaults})
+	}
+
+	for _, l := range layers {
+		result = append(result, l.Layer)
+	}
+
+	for _, s := range secretsFiles {
+		var doc interface{}
+		if err := yaml.Unmarshal(s.plaintext, &doc); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %v", s.path, err)
+		}
+
+		name := "secrets"
+		if filepath.Base(filepath.Dir(s.path)) == environment {
+			name += "[" + environment + "]"
+		}
+		result = append(result, values.Layer{Name: name, File: s.path, Values: redactLeaves(doc)})
+	}
+
+	return result, nil
+}
+
+// findChart finds a chart by name in an ankh file or, failing that, its
+// dependencies
+func findChart(ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig, name string) (ankh.AnkhFile, ankh.Chart, error) {
+	if name == "" {
+		if len(ankhFile.Charts) == 1 {
+			return ankhFile, ankhFile.Charts[0], nil
+		}
+
+		names := []string{}
+		for _, c := range ankhFile.Charts {
+			names = append(names, c.Name)
+		}
+		return ankhFile, ankh.Chart{}, fmt.Errorf("%s has %d charts, pick one of %s", ankhFile.Path, len(names), strings.Join(names, ", "))
+	}
+
+	files := append([]ankh.AnkhFile{ankhFile}, ankh.TopologicalOrder(ankhFile, ankhConfig.CurrentContext.ClusterAdmin)...)
+	for _, f := range files {
+		for _, c := range f.Charts {
+			if c.Name == name {
+				return f, c, nil
+			}
+		}
+	}
+	return ankhFile, ankh.Chart{}, fmt.Errorf("no chart named '%s' in %s or its dependencies", name, ankhFile.Path)
+}
+
+// redactLeaves replaces every value in a decoded secrets file with
+// secrets.Redacted, keeping its keys
+func redactLeaves(x interface{}) interface{} {
+	switch x := x.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(x))
+		for k, v := range x {
+			out[k] = redactLeaves(v)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, v := range x {
+			out[i] = redactLeaves(v)
+		}
+		return out
+	case nil:
+		return nil
+	}
+	return secrets.Redacted
+}
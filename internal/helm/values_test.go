@@ -0,0 +1,85 @@
+package helm
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/secrets"
+	"github.com/jondlm/ankh/internal/values"
+)
+
+func TestChartValues(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	identity, err := secrets.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKeyPath := ankh.SecretsKeyPath
+	ankh.SecretsKeyPath = filepath.Join(dir, "keys", "secrets.key")
+	defer func() { ankh.SecretsKeyPath = oldKeyPath }()
+	if err := secrets.WriteIdentity(ankh.SecretsKeyPath, identity); err != nil {
+		t.Fatal(err)
+	}
+
+	root := ankhFile(t, dir, "root", "app", "other")
+	root.Charts[0].DefaultValues = map[string]interface{}{"replicas": 2}
+	root.Charts[0].Values = map[string]interface{}{"dev": map[interface{}]interface{}{"password": "ref+vault://secret/app#password"}}
+	root.Charts[0].ResourceProfiles = map[string]interface{}{"constrained": map[interface{}]interface{}{"cpu": 1}}
+
+	chartDir := filepath.Join(dir, "root", "charts", "app")
+	writeFile(t, filepath.Join(chartDir, "values.yaml"), "replicas: 1\nimage: app\n")
+	writeFile(t, filepath.Join(chartDir, "ankh-values.yaml"), "dev:\n  image: app-dev\nproduction:\n  image: app-production\n")
+	writeFile(t, filepath.Join(chartDir, "ankh-resource-profiles.yaml"), "natural:\n  memory: 2Gi\nconstrained:\n  memory: 1Gi\n")
+	writeEncrypted(t, filepath.Join(dir, "root", secrets.Dir, "dev", "app.yaml"), "password: dev-password\n", identity)
+
+	config := testConfig()
+	config.CurrentContext.Global = map[string]interface{}{"cluster": "test"}
+
+	if _, err := ChartValues(testLogger(), root, config, ""); err == nil || !strings.Contains(err.Error(), "pick one of app, other") {
+		t.Errorf("expected an error asking for a chart, got %v", err)
+	}
+	if _, err := ChartValues(testLogger(), root, config, "nope"); err == nil || !strings.Contains(err.Error(), "no chart named 'nope'") {
+		t.Errorf("expected an error for a missing chart, got %v", err)
+	}
+
+	layers, err := ChartValues(testLogger(), root, config, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []values.Layer{
+		{Name: "chart values.yaml", File: filepath.Join(chartDir, "values.yaml")},
+		{Name: "default_values", File: root.Path},
+		{Name: "values[dev]", File: root.Path},
+		{Name: "resource_profiles[constrained]", File: root.Path},
+		{Name: "ankh-values.yaml[dev]", File: filepath.Join(chartDir, "ankh-values.yaml")},
+		{Name: "ankh-resource-profiles.yaml[constrained]", File: filepath.Join(chartDir, "ankh-resource-profiles.yaml")},
+		{Name: "global", File: strings.Join(ankh.AnkhConfigPaths, ":")},
+		{Name: "secrets[dev]", File: filepath.Join(dir, "root", secrets.Dir, "dev", "app.yaml")},
+	}
+	if len(layers) != len(expected) {
+		t.Fatalf("expected %d layers, got %v", len(expected), layers)
+	}
+	for i, l := range layers {
+		if l.Name != expected[i].Name || l.File != expected[i].File {
+			t.Errorf("expected layer %d to be %s from %s, got %s from %s", i, expected[i].Name, expected[i].File, l.Name, l.File)
+		}
+	}
+
+	merged, err := values.Merge(layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := merged.YAML(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedYAML := "cpu: 1\nglobal:\n  cluster: test\nimage: app-dev\nmemory: 1Gi\npassword: " + secrets.Redacted + "\nreplicas: 2\n"
+	if out != expectedYAML {
+		t.Errorf("expected\n%s\ngot\n%s", expectedYAML, out)
+	}
+}
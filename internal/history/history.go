@@ -0,0 +1,231 @@
+package history
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// recordsFile holds one JSON record per line, oldest first, and manifests
+// holds the rendered manifest of every record by id
+const recordsFile = "records.jsonl"
+const manifestsDir = "manifests"
+
+// Chart is a chart that was part of a run
+type Chart struct {
+	AnkhFile string `json:"ankh_file"`
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+}
+
+// Record describes a single `ankh apply`
+type Record struct {
+	ID          string    `json:"id"`
+	Time        time.Time `json:"time"`
+	User        string    `json:"user"`
+	Context     string    `json:"context"`
+	KubeContext string    `json:"kube_context"`
+	Namespace   string    `json:"namespace"`
+	AnkhFile    string    `json:"ankh_file"`
+	Charts      []Chart   `json:"charts"`
+	// ManifestDigest is the sha256 of the rendered manifest
+	ManifestDigest string `json:"manifest_digest"`
+	DryRun         string `json:"dry_run,omitempty"`
+	// Result is what kubectl printed, ExitStatus is its exit status and Error
+	// is set when the apply failed
+	Result     string `json:"result"`
+	ExitStatus int    `json:"exit_status"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Failed reports whether the apply didn't go through
+func (r Record) Failed() bool {
+	return r.ExitStatus != 0 || r.Error != ""
+}
+
+// Filter narrows down the records returned by List. Empty fields match
+// everything.
+type Filter struct {
+	Context   string
+	Namespace string
+	AnkhFile  string
+	User      string
+	Since     time.Time
+	// Failed only matches records of failed applies
+	Failed bool
+	// Limit keeps only the newest Limit records when it's above zero
+	Limit int
+}
+
+func (f Filter) matches(r Record) bool {
+	switch {
+	case f.Context != "" && f.Context != r.Context:
+		return false
+	case f.Namespace != "" && f.Namespace != r.Namespace:
+		return false
+	case f.AnkhFile != "" && f.AnkhFile != r.AnkhFile:
+		return false
+	case f.User != "" && f.User != r.User:
+		return false
+	case !f.Since.IsZero() && r.Time.Before(f.Since):
+		return false
+	case f.Failed && !r.Failed():
+		return false
+	}
+	return true
+}
+
+// Store keeps the history of applies in Dir
+type Store struct {
+	Dir string
+}
+
+// New returns a Store that keeps its records in dir
+func New(dir string) Store {
+	return Store{Dir: dir}
+}
+
+// Add fills in the id and time of a record, stores its manifest and appends
+// it to the history. The manifest digest is filled in too unless it's
+// already set, which is how a redacted manifest keeps the digest of the real
+// one.
+func (s Store) Add(r Record, manifest string) (Record, error) {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	r.Time = r.Time.UTC()
+
+	id, err := newID(r.Time)
+	if err != nil {
+		return r, err
+	}
+	r.ID = id
+	if r.ManifestDigest == "" {
+		r.ManifestDigest = "sha256:" + Digest(manifest)
+	}
+
+	if err := os.MkdirAll(filepath.Join(s.Dir, manifestsDir), 0700); err != nil {
+		return r, err
+	}
+	if err := ioutil.WriteFile(s.manifestPath(r.ID), []byte(manifest), 0600); err != nil {
+		return r, fmt.Errorf("unable to store the manifest: %v", err)
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return r, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.Dir, recordsFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return r, err
+	}
+	// a single write keeps concurrent runs from interleaving records
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return r, err
+	}
+	return r, f.Close()
+}
+
+// List returns the records that match filter, oldest first
+func (s Store) List(filter Filter) ([]Record, error) {
+	records := []Record{}
+
+	f, err := os.Open(filepath.Join(s.Dir, recordsFile))
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		r := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("unable to parse history record on line %d: %v", lineNumber, err)
+		}
+		if filter.matches(r) {
+			records = append(records, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[len(records)-filter.Limit:]
+	}
+	return records, nil
+}
+
+// Get returns the record with the given id. A unique prefix of an id is
+// enough.
+func (s Store) Get(id string) (Record, error) {
+	records, err := s.List(Filter{})
+	if err != nil {
+		return Record{}, err
+	}
+
+	matches := []Record{}
+	for _, r := range records {
+		if r.ID == id {
+			return r, nil
+		}
+		if strings.HasPrefix(r.ID, id) {
+			matches = append(matches, r)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return Record{}, fmt.Errorf("no history record with id '%s'", id)
+	case 1:
+		return matches[0], nil
+	}
+	return Record{}, fmt.Errorf("id '%s' matches %d history records, use more of it", id, len(matches))
+}
+
+// Manifest returns the rendered manifest stored with a record
+func (s Store) Manifest(r Record) (string, error) {
+	manifest, err := ioutil.ReadFile(s.manifestPath(r.ID))
+	if err != nil {
+		return "", fmt.Errorf("unable to read the manifest of history record '%s': %v", r.ID, err)
+	}
+	return string(manifest), nil
+}
+
+func (s Store) manifestPath(id string) string {
+	return filepath.Join(s.Dir, manifestsDir, id+".yaml")
+}
+
+// Digest returns the hex sha256 of a manifest
+func Digest(manifest string) string {
+	sum := sha256.Sum256([]byte(manifest))
+	return hex.EncodeToString(sum[:])
+}
+
+// newID makes an id that sorts by time and is unlikely to collide with
+// another run in the same second
+func newID(t time.Time) (string, error) {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return t.Format("20060102T150405") + "-" + hex.EncodeToString(suffix), nil
+}
@@ -0,0 +1,97 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ankh-history-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := New(dir)
+
+	records, err := store.List(Filter{})
+	if err != nil || len(records) != 0 {
+		t.Fatalf("expected an empty history, got %v, %v", records, err)
+	}
+
+	now := time.Now()
+	adds := []struct {
+		record   Record
+		manifest string
+	}{
+		{Record{Time: now.Add(-48 * time.Hour), User: "alice", Context: "dev", Namespace: "web", AnkhFile: "/src/web/ankh.yaml"}, "kind: Service\n"},
+		{Record{Time: now.Add(-time.Hour), User: "bob", Context: "prod", Namespace: "web", AnkhFile: "/src/web/ankh.yaml", ExitStatus: 1, Error: "kubectl failed"}, "kind: Deployment\n"},
+		{Record{Time: now, User: "alice", Context: "prod", Namespace: "api", AnkhFile: "/src/api/ankh.yaml", Charts: []Chart{{AnkhFile: "/src/api/ankh.yaml", Name: "api", Version: "1.2.3"}}}, "kind: ConfigMap\n"},
+	}
+	ids := []string{}
+	for _, add := range adds {
+		rec, err := store.Add(add.record, add.manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.ID == "" || rec.ManifestDigest != "sha256:"+Digest(add.manifest) {
+			t.Errorf("expected an id and digest to be filled in, got %+v", rec)
+		}
+		ids = append(ids, rec.ID)
+	}
+
+	tests := []struct {
+		name     string
+		filter   Filter
+		expected []int
+	}{
+		{"everything", Filter{}, []int{0, 1, 2}},
+		{"context", Filter{Context: "prod"}, []int{1, 2}},
+		{"namespace", Filter{Namespace: "web"}, []int{0, 1}},
+		{"ankh file", Filter{AnkhFile: "/src/api/ankh.yaml"}, []int{2}},
+		{"user", Filter{User: "alice"}, []int{0, 2}},
+		{"since", Filter{Since: now.Add(-2 * time.Hour)}, []int{1, 2}},
+		{"failed", Filter{Failed: true}, []int{1}},
+		{"limit keeps the newest", Filter{Limit: 2}, []int{1, 2}},
+		{"combined", Filter{User: "alice", Context: "prod"}, []int{2}},
+	}
+	for _, test := range tests {
+		records, err := store.List(test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := []string{}
+		for _, r := range records {
+			actual = append(actual, r.ID)
+		}
+		expected := []string{}
+		for _, i := range test.expected {
+			expected = append(expected, ids[i])
+		}
+		if strings.Join(actual, " ") != strings.Join(expected, " ") {
+			t.Errorf("%s: expected %v, got %v", test.name, expected, actual)
+		}
+	}
+
+	rec, err := store.Get(ids[2][:len(ids[2])-2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ID != ids[2] || len(rec.Charts) != 1 || rec.Charts[0].Version != "1.2.3" {
+		t.Errorf("unexpected record %+v", rec)
+	}
+	manifest, err := store.Manifest(rec)
+	if err != nil || manifest != "kind: ConfigMap\n" {
+		t.Errorf("unexpected manifest %q, %v", manifest, err)
+	}
+
+	if _, err := store.Get("nope"); err == nil {
+		t.Error("expected an error for an unknown id")
+	}
+	if _, err := store.Get(""); err == nil || !strings.Contains(err.Error(), "matches 3") {
+		t.Errorf("expected an ambiguous id error, got %v", err)
+	}
+}
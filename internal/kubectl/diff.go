@@ -0,0 +1,261 @@
+package kubectl
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/diff"
+	"github.com/jondlm/ankh/internal/runner"
+	"gopkg.in/yaml.v2"
+)
+
+// Object is a single Kubernetes object from a rendered manifest
+type Object struct {
+	APIVersion string
+	Kind       string
+	Name       string
+	Namespace  string
+	// Body is the object as it was parsed from the manifest
+	Body map[interface{}]interface{}
+}
+
+// String returns a short human readable identifier like `Deployment/web`
+func (o Object) String() string {
+	return o.Kind + "/" + o.Name
+}
+
+// Getter fetches the live state of objects from a cluster
+type Getter interface {
+	// Get returns the live object as YAML, or an empty string if the object
+	// doesn't exist
+	Get(obj Object) (string, error)
+}
+
+type kubectlGetter struct {
+	runner      runner.Runner
+	kubeContext string
+}
+
+// NewGetter returns a Getter which runs `kubectl get` using the current
+// context
+func NewGetter(r runner.Runner, ankhConfig ankh.AnkhConfig) Getter {
+	return kubectlGetter{runner: r, kubeContext: ankhConfig.CurrentContext.KubeContext}
+}
+
+func (g kubectlGetter) Get(obj Object) (string, error) {
+	kubectlArgs := []string{"kubectl", "get", resourceName(obj), obj.Name,
+		"--context", g.kubeContext, "--namespace", obj.Namespace,
+		"--ignore-not-found", "-o", "yaml"}
+
+	var out, stderr bytes.Buffer
+	err := g.runner.Run(runner.Command{Args: kubectlArgs, Stdout: &out, Stderr: &stderr})
+	if err != nil {
+		return "", fmt.Errorf("error getting %s from the cluster:\n%s", obj, stderr.String())
+	}
+
+	return out.String(), nil
+}
+
+// resourceName qualifies the kind with its group and version so kubectl
+// doesn't have to guess between kinds with the same name, e.g.
+// `Deployment.v1.apps`
+func resourceName(obj Object) string {
+	parts := strings.SplitN(obj.APIVersion, "/", 2)
+	if len(parts) == 2 {
+		return fmt.Sprintf("%s.%s.%s", obj.Kind, parts[1], parts[0])
+	}
+	return obj.Kind
+}
+
+// ParseObjects splits a multi-document manifest into objects. Objects
+// without a namespace get defaultNamespace, which mirrors what `kubectl
+// apply --namespace` does.
+func ParseObjects(manifest string, defaultNamespace string) ([]Object, error) {
+	objects := []Object{}
+
+	for _, doc := range strings.Split("\n"+manifest, "\n---") {
+		body := map[interface{}]interface{}{}
+		if err := yaml.Unmarshal([]byte(doc), &body); err != nil {
+			return objects, fmt.Errorf("unable to parse manifest: %v", err)
+		}
+		if len(body) == 0 {
+			continue
+		}
+
+		obj := Object{Body: body}
+		obj.APIVersion, _ = body["apiVersion"].(string)
+		obj.Kind, _ = body["kind"].(string)
+		if metadata, ok := body["metadata"].(map[interface{}]interface{}); ok {
+			obj.Name, _ = metadata["name"].(string)
+			obj.Namespace, _ = metadata["namespace"].(string)
+		}
+
+		if obj.Kind == "" || obj.Name == "" {
+			return objects, fmt.Errorf("unable to parse manifest: found an object without a kind or name:\n%s", doc)
+		}
+		if obj.Namespace == "" {
+			obj.Namespace = defaultNamespace
+		}
+
+		objects = append(objects, obj)
+	}
+
+	return objects, nil
+}
+
+// ObjectDiff is the difference between a rendered object and its live
+// counterpart
+type ObjectDiff struct {
+	Object Object
+	// Diff is a unified diff from the live object to the rendered one. It's
+	// empty when they match.
+	Diff string
+}
+
+// Diff compares every object in a rendered manifest against the cluster.
+// Objects without a namespace are looked up in namespace, which should be the
+// namespace of the ankh file the manifest came from. Fields that only exist
+// on the live object, like `status` or `metadata.uid`, are ignored so that
+// only fields ankh manages show up.
+func Diff(getter Getter, manifest string, namespace string) ([]ObjectDiff, error) {
+	diffs := []ObjectDiff{}
+
+	objects, err := ParseObjects(manifest, namespace)
+	if err != nil {
+		return diffs, err
+	}
+
+	for _, obj := range objects {
+		liveYAML, err := getter.Get(obj)
+		if err != nil {
+			return diffs, err
+		}
+
+		var liveBody map[interface{}]interface{}
+		if strings.TrimSpace(liveYAML) != "" {
+			parsed := map[interface{}]interface{}{}
+			if err := yaml.Unmarshal([]byte(liveYAML), &parsed); err != nil {
+				return diffs, fmt.Errorf("unable to parse live %s: %v", obj, err)
+			}
+			liveBody = prune(parsed, obj.Body).(map[interface{}]interface{})
+		}
+
+		desiredBody := obj.Body
+		if obj.Kind == "Secret" {
+			liveBody, desiredBody = maskSecret(liveBody, desiredBody)
+		}
+
+		desiredBytes, err := yaml.Marshal(desiredBody)
+		if err != nil {
+			return diffs, err
+		}
+
+		live := ""
+		if liveBody != nil {
+			liveBytes, err := yaml.Marshal(liveBody)
+			if err != nil {
+				return diffs, err
+			}
+			live = string(liveBytes)
+		}
+
+		name := fmt.Sprintf("%s/%s", obj.Namespace, obj)
+		diffs = append(diffs, ObjectDiff{
+			Object: obj,
+			Diff:   diff.Unified(live, string(desiredBytes), "live/"+name, "rendered/"+name, 3),
+		})
+	}
+
+	return diffs, nil
+}
+
+// Secret values are masked the same way `kubectl diff` does it
+const (
+	masked       = "***"
+	maskedBefore = "*** (before)"
+	maskedAfter  = "*** (after)"
+)
+
+// maskSecret returns copies of a Secret with the values in `data` and
+// `stringData` replaced, so a diff shows which keys changed but not what
+// they hold. live is nil when the Secret doesn't exist yet.
+func maskSecret(live, desired map[interface{}]interface{}) (map[interface{}]interface{}, map[interface{}]interface{}) {
+	desired = copyMap(desired)
+	if live != nil {
+		live = copyMap(live)
+	}
+
+	for _, field := range []string{"data", "stringData"} {
+		d, _ := desired[field].(map[interface{}]interface{})
+		l, _ := live[field].(map[interface{}]interface{})
+
+		maskedDesired := map[interface{}]interface{}{}
+		for k, v := range d {
+			maskedDesired[k] = masked
+			if lv, ok := l[k]; ok && fmt.Sprint(lv) != fmt.Sprint(v) {
+				maskedDesired[k] = maskedAfter
+			}
+		}
+		maskedLive := map[interface{}]interface{}{}
+		for k, v := range l {
+			maskedLive[k] = masked
+			if dv, ok := d[k]; ok && fmt.Sprint(dv) != fmt.Sprint(v) {
+				maskedLive[k] = maskedBefore
+			}
+		}
+
+		if d != nil {
+			desired[field] = maskedDesired
+		}
+		if l != nil {
+			live[field] = maskedLive
+		}
+	}
+
+	return live, desired
+}
+
+func copyMap(m map[interface{}]interface{}) map[interface{}]interface{} {
+	out := make(map[interface{}]interface{}, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// prune drops everything from live that has no counterpart in desired. List
+// items are matched up by index, so live items past the end of the desired
+// list are dropped too.
+func prune(live, desired interface{}) interface{} {
+	switch d := desired.(type) {
+	case map[interface{}]interface{}:
+		l, ok := live.(map[interface{}]interface{})
+		if !ok {
+			return live
+		}
+		out := map[interface{}]interface{}{}
+		for k, v := range l {
+			if dv, ok := d[k]; ok {
+				out[k] = prune(v, dv)
+			}
+		}
+		return out
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok {
+			return live
+		}
+		if len(l) > len(d) {
+			l = l[:len(d)]
+		}
+		out := make([]interface{}, len(l))
+		for i := range l {
+			out[i] = prune(l[i], d[i])
+		}
+		return out
+	default:
+		return live
+	}
+}
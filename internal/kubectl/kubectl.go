@@ -1,11 +1,15 @@
 package kubectl
 
 import (
+	"bytes"
 	"fmt"
-	"io/ioutil"
-	"os/exec"
+	"strings"
+	"sync"
 
 	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/runner"
+	"github.com/jondlm/ankh/internal/secrets"
+	"github.com/sirupsen/logrus"
 )
 
 type action string
@@ -15,26 +19,115 @@ const (
 	Delete action = "delete"
 )
 
-func Execute(act action, input string, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig) (string, error) {
-	ctx := ankhConfig.CurrentContext
-	kubectlArgs := []string{"kubectl", string(act), "--context", ctx.KubeContext, "--namespace", ankhFile.Namespace, "-f", "-"}
+// Dry run modes understood by `kubectl --dry-run`
+const (
+	DryRunClient = "client"
+	DryRunServer = "server"
+)
+
+// DryRunArgs returns the extra arguments needed to make kubectl validate its
+// input without persisting anything. mode is either DryRunClient or
+// DryRunServer.
+func DryRunArgs(mode string) []string {
+	return []string{"--dry-run=" + mode}
+}
+
+// Error is returned when kubectl doesn't exit cleanly
+type Error struct {
+	// Args is the exact command that was run
+	Args     []string
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("error running the kubectl command `%s` (exit code %d): %v\n%s",
+		strings.Join(e.Args, " "), e.ExitCode, e.Err, e.Stderr)
+}
 
-	kubectlCmd := exec.Command(kubectlArgs[0], kubectlArgs[1:]...)
+// Execute runs a kubectl action against the rendered manifest in input.
+// extraArgs are passed straight through to kubectl, e.g. the result of
+// DryRunArgs. Deletes skip resources that are already gone. The manifest is
+// written to kubectl's stdin while its stdout and stderr are logged line by
+// line as they arrive, with redactor hiding secret values. The captured
+// stdout is returned, and any failure comes back as an *Error.
+func Execute(log *logrus.Logger, r runner.Runner, redactor *secrets.Redactor, act action, input string, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig, extraArgs ...string) (string, error) {
+	ctx := ankhConfig.CurrentContext
+	kubectlArgs := []string{"kubectl", string(act), "--context", ctx.KubeContext, "--namespace", ankhFile.Namespace}
+	if act == Delete {
+		// deleting something that's already gone isn't a failure
+		kubectlArgs = append(kubectlArgs, "--ignore-not-found")
+	}
+	kubectlArgs = append(kubectlArgs, extraArgs...)
+	kubectlArgs = append(kubectlArgs, "-f", "-")
 
-	kubectlStdoutPipe, _ := kubectlCmd.StdoutPipe()
-	kubectlStderrPipe, _ := kubectlCmd.StderrPipe()
-	kubectlStdinPipe, _ := kubectlCmd.StdinPipe()
+	log.Debugf("running kubectl command %s", strings.Join(kubectlArgs, " "))
 
-	kubectlCmd.Start()
-	kubectlStdinPipe.Write([]byte(input))
-	kubectlStdinPipe.Close()
+	var kubectlOut, kubectlErr bytes.Buffer
+	// kubectl can echo decrypted values back, in validation errors for
+	// example, so nothing it prints is logged as is
+	stdout := &lineWriter{capture: &kubectlOut, logLine: func(line string) { log.Info(redactor.Redact(line)) }}
+	stderr := &lineWriter{capture: &kubectlErr, logLine: func(line string) { log.Warn(redactor.Redact(line)) }}
 
-	kubectlOut, _ := ioutil.ReadAll(kubectlStdoutPipe)
-	kubectlErr, _ := ioutil.ReadAll(kubectlStderrPipe)
+	// the stdin reader is copied to the process on its own goroutine, so a
+	// large manifest can't block kubectl from draining stdout and stderr
+	err := r.Run(runner.Command{
+		Args:   kubectlArgs,
+		Stdin:  strings.NewReader(input),
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+	stdout.Flush()
+	stderr.Flush()
 
-	err := kubectlCmd.Wait()
 	if err != nil {
-		return "", fmt.Errorf("error running the kubectl command:\n%s", kubectlErr)
+		return kubectlOut.String(), &Error{
+			Args:     kubectlArgs,
+			ExitCode: runner.ExitCode(err),
+			Stderr:   redactor.Redact(kubectlErr.String()),
+			Err:      err,
+		}
+	}
+	return kubectlOut.String(), nil
+}
+
+// lineWriter captures everything written to it and calls logLine once for
+// every complete line
+type lineWriter struct {
+	capture *bytes.Buffer
+	logLine func(line string)
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.capture.Write(p)
+	w.partial = append(w.partial, p...)
+
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.logLine(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush logs anything left over after the last newline
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.partial) > 0 {
+		w.logLine(string(w.partial))
+		w.partial = nil
 	}
-	return string(kubectlOut), nil
 }
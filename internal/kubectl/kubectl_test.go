@@ -0,0 +1,346 @@
+package kubectl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/runner"
+	"github.com/jondlm/ankh/internal/runner/runnertest"
+	"github.com/jondlm/ankh/internal/secrets"
+	"github.com/sirupsen/logrus"
+)
+
+// testLogger returns a logger that writes plain messages to out
+func testLogger(out *bytes.Buffer) *logrus.Logger {
+	log := logrus.New()
+	log.Out = out
+	log.Formatter = &logrus.TextFormatter{DisableTimestamp: true, DisableColors: true}
+	return log
+}
+
+func testConfig() ankh.AnkhConfig {
+	return ankh.AnkhConfig{
+		CurrentContext: ankh.Context{KubeContext: "minikube"},
+	}
+}
+
+func TestExecute(t *testing.T) {
+	var logs bytes.Buffer
+	fake := runnertest.NewFake(runnertest.Response{Stdout: "deployment \"web\" configured\n"})
+	ankhFile := ankh.AnkhFile{Namespace: "web"}
+
+	output, err := Execute(testLogger(&logs), fake, nil, Apply, "kind: Deployment\n", ankhFile, testConfig(), DryRunArgs(DryRunServer)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "deployment \"web\" configured\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+
+	calls := fake.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("expected one call, got %d", len(calls))
+	}
+
+	expected := "kubectl apply --context minikube --namespace web --dry-run=server -f -"
+	if actual := strings.Join(calls[0].Args, " "); actual != expected {
+		t.Errorf("expected `%s`, got `%s`", expected, actual)
+	}
+	if calls[0].Stdin != "kind: Deployment\n" {
+		t.Errorf("expected the manifest on stdin, got %q", calls[0].Stdin)
+	}
+	if !strings.Contains(logs.String(), `level=info msg="deployment \"web\" configured"`) {
+		t.Errorf("expected stdout to be logged, got:\n%s", logs.String())
+	}
+}
+
+func TestExecuteError(t *testing.T) {
+	var logs bytes.Buffer
+	fake := runnertest.NewFake(runnertest.Response{
+		Stdout: "configmap \"web\" deleted\n",
+		Stderr: "error: deployments.apps \"web\" not found\nerror: services \"web\" not found",
+		Err:    runner.ExitError{Code: 1},
+	})
+
+	output, err := Execute(testLogger(&logs), fake, nil, Delete, "", ankh.AnkhFile{Namespace: "web"}, testConfig())
+
+	kubectlErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expected an *Error, got %#v", err)
+	}
+	if kubectlErr.ExitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", kubectlErr.ExitCode)
+	}
+	if !strings.Contains(kubectlErr.Stderr, `services "web" not found`) {
+		t.Errorf("expected stderr in the error, got %q", kubectlErr.Stderr)
+	}
+	if strings.Join(kubectlErr.Args, " ") != "kubectl delete --context minikube --namespace web --ignore-not-found -f -" {
+		t.Errorf("expected the command in the error, got %v", kubectlErr.Args)
+	}
+	if output != "configmap \"web\" deleted\n" {
+		t.Errorf("expected stdout to be returned with the error, got %q", output)
+	}
+
+	// the last stderr line has no trailing newline and should still be logged
+	for _, line := range []string{
+		`level=warning msg="error: deployments.apps \"web\" not found"`,
+		`level=warning msg="error: services \"web\" not found"`,
+	} {
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("expected %s to be logged, got:\n%s", line, logs.String())
+		}
+	}
+}
+
+func TestExecuteRedacts(t *testing.T) {
+	var logs bytes.Buffer
+	fake := runnertest.NewFake(runnertest.Response{
+		Stdout: "secret \"db\" configured\n",
+		Stderr: "error: invalid value \"hunter22\" for field password\n",
+		Err:    runner.ExitError{Code: 1},
+	})
+	redactor := secrets.NewRedactor([]string{"hunter22"})
+
+	_, err := Execute(testLogger(&logs), fake, redactor, Apply, "kind: Secret\n", ankh.AnkhFile{Namespace: "web"}, testConfig())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if strings.Contains(logs.String(), "hunter22") || strings.Contains(err.Error(), "hunter22") {
+		t.Errorf("expected the secret to be redacted, got logs:\n%s\nerror: %v", logs.String(), err)
+	}
+	if !strings.Contains(logs.String(), `invalid value \"<redacted>\"`) {
+		t.Errorf("expected the redacted line to be logged, got:\n%s", logs.String())
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var capture bytes.Buffer
+	lines := []string{}
+	w := &lineWriter{capture: &capture, logLine: func(line string) { lines = append(lines, line) }}
+
+	for _, chunk := range []string{"one\ntw", "o\n", "\nthree"} {
+		w.Write([]byte(chunk))
+	}
+	w.Flush()
+
+	if strings.Join(lines, "|") != "one|two||three" {
+		t.Errorf("unexpected lines %q", lines)
+	}
+	if capture.String() != "one\ntwo\n\nthree" {
+		t.Errorf("unexpected capture %q", capture.String())
+	}
+}
+
+func TestDiff(t *testing.T) {
+	manifest := `---
+# Source: web/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 3
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web
+  namespace: other
+data:
+  a: b
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+`
+
+	live := map[string]string{
+		"Deployment.v1.apps": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: web
+  uid: 1234
+spec:
+  replicas: 2
+status:
+  readyReplicas: 2
+`,
+		"ConfigMap": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web
+  namespace: other
+  resourceVersion: "10"
+data:
+  a: b
+`,
+	}
+
+	fake := &runnertest.Fake{
+		Respond: func(call runnertest.Call) runnertest.Response {
+			return runnertest.Response{Stdout: live[call.Args[2]]}
+		},
+	}
+
+	diffs, err := Diff(NewGetter(fake, testConfig()), manifest, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 3 {
+		t.Fatalf("expected 3 diffs, got %d", len(diffs))
+	}
+
+	if !strings.Contains(diffs[0].Diff, "-  replicas: 2\n+  replicas: 3\n") {
+		t.Errorf("expected a replicas change, got:\n%s", diffs[0].Diff)
+	}
+	if strings.Contains(diffs[0].Diff, "uid") || strings.Contains(diffs[0].Diff, "status") {
+		t.Errorf("expected fields ankh doesn't manage to be ignored, got:\n%s", diffs[0].Diff)
+	}
+	if diffs[1].Diff != "" {
+		t.Errorf("expected no changes to the ConfigMap, got:\n%s", diffs[1].Diff)
+	}
+	if !strings.Contains(diffs[2].Diff, "+kind: Service\n") {
+		t.Errorf("expected the Service to be new, got:\n%s", diffs[2].Diff)
+	}
+
+	calls := fake.Calls()
+	expected := "kubectl get ConfigMap web --context minikube --namespace other --ignore-not-found -o yaml"
+	if actual := strings.Join(calls[1].Args, " "); actual != expected {
+		t.Errorf("expected `%s`, got `%s`", expected, actual)
+	}
+}
+
+func TestDiffDependencyNamespace(t *testing.T) {
+	// the root ankh file deploys to web, its dependency to db
+	outputs := []struct {
+		namespace string
+		manifest  string
+	}{
+		{"db", "apiVersion: v1\nkind: Service\nmetadata:\n  name: db\nspec:\n  ports:\n  - port: 5432\n"},
+		{"web", "apiVersion: v1\nkind: Service\nmetadata:\n  name: web\nspec:\n  ports:\n  - port: 80\n"},
+	}
+	live := map[string]string{
+		"db":  "apiVersion: v1\nkind: Service\nmetadata:\n  name: db\n  namespace: db\nspec:\n  ports:\n  - port: 5432\n    protocol: TCP\n",
+		"web": "",
+	}
+	fake := &runnertest.Fake{
+		Respond: func(call runnertest.Call) runnertest.Response {
+			return runnertest.Response{Stdout: live[call.Args[3]]}
+		},
+	}
+
+	for _, o := range outputs {
+		diffs, err := Diff(NewGetter(fake, testConfig()), o.manifest, o.namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diffs) != 1 || diffs[0].Object.Namespace != o.namespace {
+			t.Fatalf("expected the %s Service in %s, got %+v", o.namespace, o.namespace, diffs)
+		}
+		if o.namespace == "db" && diffs[0].Diff != "" {
+			t.Errorf("expected no changes to the db Service, got:\n%s", diffs[0].Diff)
+		}
+		if o.namespace == "web" && !strings.Contains(diffs[0].Diff, "+++ rendered/web/Service/web\n") {
+			t.Errorf("expected the web Service to be new, got:\n%s", diffs[0].Diff)
+		}
+	}
+
+	for i, ns := range []string{"db", "web"} {
+		if args := strings.Join(fake.Calls()[i].Args, " "); !strings.Contains(args, "--namespace "+ns+" ") {
+			t.Errorf("expected the Service to be looked up in %s, got `%s`", ns, args)
+		}
+	}
+}
+
+func TestDiffPrunesListsByIndex(t *testing.T) {
+	manifest := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  containers:
+  - name: web
+    image: web:2
+`
+	// a sidecar that was injected into the live object and fields that
+	// only the cluster sets
+	live := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  containers:
+  - name: web
+    image: web:1
+    terminationMessagePath: /dev/termination-log
+  - name: proxy
+    image: proxy:1
+`
+	fake := runnertest.NewFake(runnertest.Response{Stdout: live})
+
+	diffs, err := Diff(NewGetter(fake, testConfig()), manifest, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := diffs[0].Diff
+	for _, unmanaged := range []string{"terminationMessagePath", "proxy"} {
+		if strings.Contains(d, unmanaged) {
+			t.Errorf("expected %s to be ignored, got:\n%s", unmanaged, d)
+		}
+	}
+	if !strings.Contains(d, "-  - image: web:1\n+  - image: web:2\n") {
+		t.Errorf("expected an image change, got:\n%s", d)
+	}
+}
+
+func TestDiffMasksSecrets(t *testing.T) {
+	manifest := `apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+data:
+  password: bmV3cGFzc3dvcmQ=
+  user: YWRtaW4=
+  token: dG9rZW4=
+stringData:
+  extra: plain-text-value
+`
+	live := `apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+data:
+  password: b2xkcGFzc3dvcmQ=
+  user: YWRtaW4=
+  removed: Z29uZQ==
+`
+	fake := runnertest.NewFake(runnertest.Response{Stdout: live})
+
+	diffs, err := Diff(NewGetter(fake, testConfig()), manifest, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := diffs[0].Diff
+	for _, value := range []string{"bmV3cGFzc3dvcmQ=", "b2xkcGFzc3dvcmQ=", "YWRtaW4=", "dG9rZW4=", "plain-text-value"} {
+		if strings.Contains(d, value) {
+			t.Errorf("expected %s to be masked, got:\n%s", value, d)
+		}
+	}
+	for _, line := range []string{
+		"-  password: '*** (before)'\n",
+		"+  password: '*** (after)'\n",
+		"   user: '***'\n",
+		"+  token: '***'\n",
+		"+  extra: '***'\n",
+	} {
+		if !strings.Contains(d, line) {
+			t.Errorf("expected %q in the diff, got:\n%s", line, d)
+		}
+	}
+}
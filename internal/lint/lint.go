@@ -0,0 +1,481 @@
+package lint
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/helm"
+	"github.com/jondlm/ankh/internal/secrets"
+	"github.com/jondlm/ankh/internal/util"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Formats supported by Report.Format
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Finding is a single problem found by Lint
+type Finding struct {
+	File string `json:"file"`
+	// Line is 0 when the problem isn't about a particular line
+	Line    int    `json:"line,omitempty"`
+	Chart   string `json:"chart,omitempty"`
+	Message string `json:"message"`
+}
+
+func (f Finding) Error() string {
+	position := f.File
+	if f.Line > 0 {
+		position += ":" + strconv.Itoa(f.Line)
+	}
+	return position + ": " + f.Message
+}
+
+// Report is everything Lint found
+type Report struct {
+	Findings []Finding `json:"findings"`
+}
+
+// Format renders the report as text, one finding per line, or as JSON
+func (r Report) Format(format string) (string, error) {
+	switch format {
+	case FormatText:
+		errs := []error{}
+		for _, f := range r.Findings {
+			errs = append(errs, f)
+		}
+		if len(errs) == 0 {
+			return "", nil
+		}
+		return util.MultiErrorFormat(errs) + "\n", nil
+	case FormatJSON:
+		out, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(out) + "\n", nil
+	default:
+		return "", fmt.Errorf("unknown lint format '%s', expected one of %s or %s", format, FormatText, FormatJSON)
+	}
+}
+
+type linter struct {
+	log    *logrus.Logger
+	report *Report
+
+	config   ankh.AnkhConfig
+	configOK bool
+	// configPaths are the config files of ankh.AnkhConfigPaths that exist
+	// and configPositions holds the positions of every one that could be read
+	configPaths     []string
+	configPositions map[string]positions
+
+	// visited holds every ankh file that's been linted and stack the chain
+	// of dependencies being linted right now
+	visited map[string]bool
+	stack   []string
+	// charts holds the first ankh file every chart was seen in, by namespace
+	// and name
+	charts map[string]string
+
+	// withSecrets is set when there's a key to decrypt secrets files with
+	withSecrets bool
+}
+
+// Lint checks the ankh config and every ankh file in the tree rooted at
+// filename without contacting a registry or a cluster. It validates the
+// config, every chart's `values` and `resource_profiles` keys, the keys of
+// the ankh-values.yaml and ankh-resource-profiles.yaml files and the
+// values.schema.json of charts, and that scripts, dependencies and charts
+// exist. Remote charts are only validated against their schema when they're
+// in the chart cache already. Without a secrets key the values set by secrets
+// files can't be validated, which is logged as a warning.
+// contextOverride picks the context like `--context` does.
+func Lint(log *logrus.Logger, filename, contextOverride string) Report {
+	l := linter{
+		log:             log,
+		report:          &Report{Findings: []Finding{}},
+		configPositions: map[string]positions{},
+		visited:         map[string]bool{},
+		charts:          map[string]string{},
+	}
+	if _, err := os.Stat(ankh.SecretsKeyPath); err == nil {
+		l.withSecrets = true
+	}
+
+	l.lintConfig(contextOverride)
+
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		l.add(filename, 0, "", "%v", err)
+		return *l.report
+	}
+	l.lintFile(absPath, nil)
+
+	return *l.report
+}
+
+func (l *linter) add(file string, line int, chart, format string, args ...interface{}) {
+	l.report.Findings = append(l.report.Findings, Finding{File: file, Line: line, Chart: chart, Message: fmt.Sprintf(format, args...)})
+}
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+): (.*)`)
+
+// addYAMLError adds a finding for every line a yaml.v2 error mentions
+func (l *linter) addYAMLError(file string, err error) {
+	matches := yamlErrorLine.FindAllStringSubmatch(err.Error(), -1)
+	if len(matches) == 0 {
+		l.add(file, 0, "", "%v", err)
+		return
+	}
+	for _, m := range matches {
+		line, _ := strconv.Atoi(m[1])
+		l.add(file, line, "", "%s", m[2])
+	}
+}
+
+var backticked = regexp.MustCompile("`([^`]+)`")
+
+func (l *linter) lintConfig(contextOverride string) {
+	paths, err := ankh.ExistingConfigPaths(ankh.AnkhConfigPaths)
+	if err != nil {
+		l.add(ankh.AnkhConfigPaths[0], 0, "", "%v", err)
+		return
+	}
+	l.configPaths = paths
+
+	readable := true
+	for _, p := range paths {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			l.add(p, 0, "", "unable to read the ankh config: %v", err)
+			readable = false
+			continue
+		}
+		if err := yaml.UnmarshalStrict(data, &ankh.AnkhConfig{}); err != nil {
+			l.addYAMLError(p, err)
+			readable = false
+			continue
+		}
+		l.configPositions[p] = indexPositions(data)
+	}
+	if !readable {
+		return
+	}
+
+	config, err := ankh.ReadAnkhConfigs(paths)
+	if err != nil {
+		l.add(paths[0], 0, "", "%v", err)
+		return
+	}
+	if contextOverride != "" {
+		config.CurrentContextName = contextOverride
+	}
+
+	// the config errors name the key they're about, which is either in the
+	// current context or at the top of the config
+	current := joinPath("contexts", config.CurrentContextName)
+	errs := config.ValidateAndInit()
+	for _, err := range errs {
+		candidates := []string{}
+		for _, m := range backticked.FindAllStringSubmatch(err.Error(), -1) {
+			candidates = append(candidates, joinPath(current, m[1]), m[1])
+		}
+		file, line := l.configLine(append(candidates, current, "current_context")...)
+		l.add(file, line, "", "%v", err)
+	}
+
+	l.config = config
+	l.configOK = len(errs) == 0
+}
+
+// configLine finds the first of paths that's in a config file, preferring
+// later files since they win
+func (l *linter) configLine(paths ...string) (string, int) {
+	for _, p := range paths {
+		for i := len(l.configPaths) - 1; i >= 0; i-- {
+			file := l.configPaths[i]
+			if line, ok := l.configPositions[file][p]; ok {
+				return file, line
+			}
+		}
+	}
+	return l.configPaths[len(l.configPaths)-1], 0
+}
+
+// reference is where an ankh file was depended on from
+type reference struct {
+	file string
+	line int
+}
+
+func (l *linter) lintFile(absPath string, from *reference) {
+	for i, inProgress := range l.stack {
+		if inProgress == absPath {
+			chain := append(append([]string{}, l.stack[i:]...), absPath)
+			l.add(from.file, from.line, "", "dependency cycle detected: %s", strings.Join(chain, " -> "))
+			return
+		}
+	}
+	if l.visited[absPath] {
+		return
+	}
+	l.visited[absPath] = true
+	l.stack = append(l.stack, absPath)
+	defer func() { l.stack = l.stack[:len(l.stack)-1] }()
+
+	l.log.Debugf("linting %s", absPath)
+
+	data, err := ioutil.ReadFile(absPath)
+	if err != nil {
+		if from != nil {
+			l.add(from.file, from.line, "", "unable to read dependency: %v", err)
+		} else {
+			l.add(absPath, 0, "", "unable to read ankh file: %v", err)
+		}
+		return
+	}
+
+	f := ankh.AnkhFile{}
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		l.addYAMLError(absPath, err)
+		return
+	}
+	f.Path = absPath
+	pos := indexPositions(data)
+
+	seen := map[string]bool{}
+	for i, chart := range f.Charts {
+		l.lintChart(f, pos, i, chart, seen)
+	}
+
+	l.lintScripts(f, pos, "bootstrap", "bootstrap.scripts", f.Bootstrap.Scripts)
+	l.lintScripts(f, pos, "pre-delete", "teardown.pre_delete_scripts", f.Teardown.PreDeleteScripts)
+	l.lintScripts(f, pos, "teardown", "teardown.scripts", f.Teardown.Scripts)
+
+	l.lintDependencies(f, pos, "admin_dependencies", f.AdminDependencies)
+	l.lintDependencies(f, pos, "dependencies", f.Dependencies)
+}
+
+func (l *linter) lintChart(f ankh.AnkhFile, pos positions, i int, chart ankh.Chart, seen map[string]bool) {
+	chartPath := fmt.Sprintf("charts[%d]", i)
+	line := pos.line(chartPath)
+
+	if chart.Name == "" {
+		l.add(f.Path, line, "", "chart has no `name`")
+		return
+	}
+	if seen[chart.Name] {
+		// it's the same chart directory, which has been checked already
+		l.add(f.Path, line, chart.Name, "chart '%s' is listed more than once", chart.Name)
+		return
+	}
+	// the same chart can be installed in several namespaces, but not twice
+	// in the same one
+	key := f.Namespace + "/" + chart.Name
+	if other, ok := l.charts[key]; ok {
+		l.add(f.Path, line, chart.Name, "chart '%s' is also in %s, in the same namespace", chart.Name, other)
+	} else {
+		l.charts[key] = f.Path
+	}
+	seen[chart.Name] = true
+
+	ok := true
+	if l.configOK {
+		for _, err := range chart.Errors(l.config) {
+			ok = false
+			if e, isKey := err.(*ankh.UnsupportedKeyError); isKey {
+				l.add(f.Path, pos.line(joinPath(chartPath, e.Field, e.Key)), chart.Name, "%v", err)
+				continue
+			}
+			l.add(f.Path, line, chart.Name, "%v", err)
+		}
+	}
+
+	dirPath := filepath.Join(filepath.Dir(f.Path), "charts", chart.Name)
+	info, err := os.Stat(dirPath)
+	local := err == nil && info.IsDir()
+	if !local && chart.Version == "" {
+		l.add(f.Path, line, chart.Name, "chart '%s' has no local directory at %s and no `version` to fetch", chart.Name, dirPath)
+		return
+	}
+
+	if !l.configOK {
+		return
+	}
+	// the ankh-values.yaml and ankh-resource-profiles.yaml of remote charts
+	// are checked while their values are read
+	if local {
+		ok = l.lintKeyedFile(filepath.Join(dirPath, "ankh-values.yaml"), chart.Name, "environment", l.config.SupportedEnvironments) && ok
+		ok = l.lintKeyedFile(filepath.Join(dirPath, "ankh-resource-profiles.yaml"), chart.Name, "resource profile", l.config.SupportedResourceProfiles) && ok
+	}
+
+	// the schema can only be checked once the values themselves make sense
+	if ok {
+		l.lintSchema(f, pos, chartPath, chart)
+	}
+}
+
+// lintKeyedFile checks that the keys of an ankh-values.yaml or
+// ankh-resource-profiles.yaml file are exactly the supported ones, since
+// templating fails for any that's missing. It reports whether the file is
+// fine.
+func (l *linter) lintKeyedFile(file, chart, kind string, supported []string) bool {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		l.add(file, 0, chart, "%v", err)
+		return false
+	}
+
+	keyed := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &keyed); err != nil {
+		l.addYAMLError(file, err)
+		return false
+	}
+	pos := indexPositions(data)
+
+	ok := true
+	keys := []string{}
+	for k := range keyed {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !util.Contains(supported, k) {
+			ok = false
+			l.add(file, pos.line(k), chart, "unsupported %s '%s', expected one of %s", kind, k, strings.Join(supported, ", "))
+		}
+	}
+	for _, k := range supported {
+		if _, found := keyed[k]; !found {
+			ok = false
+			l.add(file, 0, chart, "missing `%s` key, templating for that %s will fail", k, kind)
+		}
+	}
+	return ok
+}
+
+func (l *linter) lintSchema(f ankh.AnkhFile, pos positions, chartPath string, chart ankh.Chart) {
+	if !l.withSecrets && len(secrets.Files(f.Path, chart.Name, l.config.CurrentContext.Environment)) > 0 {
+		l.log.Warnf("there's no secrets key at %s, so the values chart '%s' gets from its secrets files aren't validated", ankh.SecretsKeyPath, chart.Name)
+	}
+
+	violations, err := helm.ValidateChart(l.log, f, chart, l.config, l.withSecrets)
+	if err == helm.ErrNotCached {
+		l.log.Debugf("skipping the schema of chart '%s', which isn't cached yet", chart.Name)
+		return
+	}
+	if err != nil {
+		l.add(f.Path, pos.line(chartPath), chart.Name, "unable to check the values of chart '%s': %v", chart.Name, err)
+		return
+	}
+
+	for _, v := range violations {
+		file, line := f.Path, pos.line(chartPath)
+		layers := []string{}
+		for i, o := range v.Sources {
+			if i == 0 {
+				file, line = l.locate(f, pos, chartPath, o.Layer, o.File, v.Keys)
+			}
+			layers = append(layers, o.Layer)
+		}
+
+		message := v.Path + ": " + v.Message
+		if len(layers) > 0 {
+			message += " (set by " + strings.Join(layers, ", ") + ")"
+		}
+		l.add(file, line, chart.Name, "%s", message)
+	}
+}
+
+// locate finds the file and line of a value from a layer of a chart's values
+func (l *linter) locate(f ankh.AnkhFile, pos positions, chartPath, layer, file string, keys []string) (string, int) {
+	name, selector := layer, ""
+	if i := strings.Index(layer, "["); i >= 0 && strings.HasSuffix(layer, "]") {
+		name, selector = layer[:i], layer[i+1:len(layer)-1]
+	}
+
+	switch name {
+	case "default_values", "values", "resource_profiles":
+		at := []string{chartPath, name}
+		if selector != "" {
+			at = append(at, selector)
+		}
+		return f.Path, pos.line(joinPath("", append(at, keys...)...))
+	case "ankh-values.yaml", "ankh-resource-profiles.yaml":
+		return file, l.fileLine(file, joinPath(selector, keys...))
+	case "chart values.yaml":
+		return file, l.fileLine(file, joinPath("", keys...))
+	case "global":
+		// global values are written under a `global` key of the chart's
+		// values
+		context := joinPath("contexts", l.config.CurrentContextName, "global")
+		if len(keys) > 0 {
+			keys = keys[1:]
+		}
+		return l.configLine(joinPath(context, keys...), context)
+	}
+	return file, 0
+}
+
+// fileLine finds the line of a path in a file that isn't otherwise indexed
+func (l *linter) fileLine(file, at string) int {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0
+	}
+	return indexPositions(data).line(at)
+}
+
+func (l *linter) lintScripts(f ankh.AnkhFile, pos positions, stage, field string, scripts []ankh.Script) {
+	for i, s := range scripts {
+		line := pos.line(joinPath(field, fmt.Sprintf("[%d]", i), "path"))
+
+		if s.Path == "" {
+			l.add(f.Path, line, "", "%s script has no `path`", stage)
+			continue
+		}
+
+		scriptPath := s.Path
+		if !filepath.IsAbs(scriptPath) {
+			scriptPath = filepath.Join(filepath.Dir(f.Path), scriptPath)
+		}
+
+		info, err := os.Stat(scriptPath)
+		switch {
+		case os.IsNotExist(err):
+			l.add(f.Path, line, "", "%s script %s doesn't exist", stage, scriptPath)
+		case err != nil:
+			l.add(f.Path, line, "", "%s script %s: %v", stage, scriptPath, err)
+		case info.IsDir():
+			l.add(f.Path, line, "", "%s script %s is a directory", stage, scriptPath)
+		case info.Mode()&0111 == 0:
+			l.add(f.Path, line, "", "%s script %s isn't executable", stage, scriptPath)
+		}
+	}
+}
+
+func (l *linter) lintDependencies(f ankh.AnkhFile, pos positions, field string, dependencies []string) {
+	for i, d := range dependencies {
+		// resolved the same way ankh.ProcessAnkhFile does
+		if !path.IsAbs(d) {
+			d = path.Join(filepath.Dir(f.Path), d, "ankh.yaml")
+		}
+		l.lintFile(d, &reference{file: f.Path, line: pos.line(fmt.Sprintf("%s[%d]", field, i))})
+	}
+}
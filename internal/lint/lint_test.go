@@ -0,0 +1,285 @@
+package lint
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/cache"
+	"github.com/sirupsen/logrus"
+)
+
+const testConfig = `current_context: dev
+supported_environments: [dev, production]
+supported_resource_profiles: [natural, constrained]
+contexts:
+  dev:
+    kube_context: minikube
+    environment: dev
+    resource_profile: constrained
+    helm_registry_url: http://localhost
+    global:
+      replicas: many
+  broken:
+    kube_context: minikube
+    environment: staging
+    resource_profile: constrained
+    helm_registry_url: http://localhost
+`
+
+// setup writes files relative to a temp dir and points the ankh config and
+// data dir into it
+func setup(t *testing.T, files map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "ankh-lint-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, contents := range files {
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(name, ".sh") {
+			mode = 0755
+		}
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldConfigPaths, oldDataDir, oldChartCacheDir, oldKeyPath := ankh.AnkhConfigPaths, ankh.AnkhDataDir, ankh.ChartCacheDir, ankh.SecretsKeyPath
+	ankh.AnkhConfigPaths = []string{filepath.Join(dir, "config")}
+	ankh.AnkhDataDir = filepath.Join(dir, "data")
+	ankh.ChartCacheDir = filepath.Join(dir, "cache", "charts")
+	ankh.SecretsKeyPath = filepath.Join(dir, "keys", "secrets.key")
+
+	return dir, func() {
+		ankh.AnkhConfigPaths, ankh.AnkhDataDir, ankh.ChartCacheDir, ankh.SecretsKeyPath = oldConfigPaths, oldDataDir, oldChartCacheDir, oldKeyPath
+		os.RemoveAll(dir)
+	}
+}
+
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	return log
+}
+
+func messages(r Report) []string {
+	out := []string{}
+	for _, f := range r.Findings {
+		out = append(out, f.Error())
+	}
+	return out
+}
+
+func TestLint(t *testing.T) {
+	dir, cleanup := setup(t, map[string]string{
+		"config": testConfig,
+		"root/ankh.yaml": `namespace: web
+charts:
+  - name: web
+    values:
+      dev: {}
+      staging: {}
+  - name: remote
+  - name: web
+bootstrap:
+  scripts:
+    - path: up.sh
+    - path: missing.sh
+dependencies:
+  - ../dep
+  - ../nowhere
+`,
+		"root/up.sh":                                  "#!/bin/sh\n",
+		"root/charts/web/values.yaml":                 "replicas: 1\n",
+		"root/charts/web/ankh-values.yaml":            "dev: {}\nstaging: {}\n",
+		"root/charts/web/ankh-resource-profiles.yaml": "natural: {}\n",
+		"dep/ankh.yaml":                               "namespace: dep\ncharts:\n  - name: remote\n    version: 1.0.0\n  - name: db\ndependencies:\n  - ../root\n",
+		"dep/charts/db/values.yaml":                   "size: huge\n",
+		"dep/charts/db/values.schema.json":            `{"properties": {"size": {"enum": ["small"]}, "global": {"properties": {"replicas": {"type": "integer"}}}}}`,
+	})
+	defer cleanup()
+
+	root := filepath.Join(dir, "root", "ankh.yaml")
+	dep := filepath.Join(dir, "dep", "ankh.yaml")
+	config := filepath.Join(dir, "config")
+	chart := filepath.Join(dir, "root", "charts", "web")
+
+	report := Lint(testLogger(), root, "")
+
+	expected := []string{
+		root + ":6: unsupported environment 'staging' found in ankh file `values` for chart 'web'",
+		chart + "/ankh-values.yaml:2: unsupported environment 'staging', expected one of dev, production",
+		chart + "/ankh-values.yaml: missing `production` key, templating for that environment will fail",
+		chart + "/ankh-resource-profiles.yaml: missing `constrained` key, templating for that resource profile will fail",
+		root + ":7: chart 'remote' has no local directory at " + filepath.Join(dir, "root", "charts", "remote") + " and no `version` to fetch",
+		root + ":8: chart 'web' is listed more than once",
+		root + ":12: bootstrap script " + filepath.Join(dir, "root", "missing.sh") + " doesn't exist",
+		config + ":11: $.global.replicas: expected integer, got string (set by global)",
+		filepath.Join(dir, "dep", "charts", "db", "values.yaml") + ":1: $.size: must be one of \"small\" (set by chart values.yaml)",
+		dep + ":7: dependency cycle detected: " + root + " -> " + dep + " -> " + root,
+		root + ":15: unable to read dependency: open " + filepath.Join(dir, "nowhere", "ankh.yaml") + ": no such file or directory",
+	}
+	got := messages(report)
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+// cacheChart puts a chart tarball with the given files in the chart cache
+func cacheChart(t *testing.T, name, version string, files map[string]string) {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for path, contents := range files {
+		header := &tar.Header{Name: name + "/" + path, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cache.New(ankh.ChartCacheDir).Put(name, version, "http://localhost/"+name+"-"+version+".tgz", "", &buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLintRemoteCharts(t *testing.T) {
+	dir, cleanup := setup(t, map[string]string{
+		"config": testConfig,
+		"root/ankh.yaml": `namespace: web
+charts:
+  - name: api
+    version: 1.0.0
+    default_values:
+      port: http
+  - name: worker
+    version: ~2.0
+  - name: db
+    version: 3.0.0
+dependencies:
+  - ../dep
+  - ../other
+`,
+		"root/secrets/api.yaml":            "not decryptable without a key\n",
+		"dep/ankh.yaml":                    "namespace: web\ncharts:\n  - name: db\n",
+		"dep/charts/db/values.yaml":        "size: huge\n",
+		"dep/charts/db/values.schema.json": `{"properties": {"size": {"enum": ["small"]}}}`,
+		"other/ankh.yaml":                  "namespace: other\ncharts:\n  - name: api\n    version: 1.0.0\n",
+	})
+	defer cleanup()
+
+	cacheChart(t, "api", "1.0.0", map[string]string{
+		"Chart.yaml":         "name: api\nversion: 1.0.0\n",
+		"values.schema.json": `{"required": ["password"], "properties": {"port": {"type": "integer"}}}`,
+	})
+
+	root := filepath.Join(dir, "root", "ankh.yaml")
+	dep := filepath.Join(dir, "dep", "ankh.yaml")
+
+	// the cached chart is validated without its secrets, so the missing
+	// password is only reported where there's no secrets file that could
+	// set it. The chart with a range and no lock and the one that isn't
+	// cached are skipped, and the same chart in another namespace is fine.
+	report := Lint(testLogger(), root, "")
+	expected := []string{
+		root + ":6: $.port: expected integer, got string (set by default_values)",
+		dep + ":3: chart 'db' is also in " + root + ", in the same namespace",
+		filepath.Join(dir, "dep", "charts", "db", "values.yaml") + ":1: $.size: must be one of \"small\" (set by chart values.yaml)",
+		filepath.Join(dir, "other", "ankh.yaml") + ":3: $: missing required password",
+	}
+	got := messages(report)
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestLintConfig(t *testing.T) {
+	dir, cleanup := setup(t, map[string]string{
+		"config":    testConfig,
+		"ankh.yaml": "namespace: web\ncharts:\n  - name: web\n    version: 1.0.0\n    values:\n      staging: {}\n",
+	})
+	defer cleanup()
+
+	// with a broken config only the config is reported, since everything
+	// else is checked against it
+	report := Lint(testLogger(), filepath.Join(dir, "ankh.yaml"), "broken")
+	expected := filepath.Join(dir, "config") + ":2: environment 'staging' not found in `supported_environments`"
+	if got := messages(report); len(got) != 1 || got[0] != expected {
+		t.Errorf("expected %s, got %v", expected, got)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "ankh.yaml"), []byte("namespace: web\ncharts: {\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report = Lint(testLogger(), filepath.Join(dir, "ankh.yaml"), "")
+	if len(report.Findings) != 1 || report.Findings[0].Line != 2 {
+		t.Errorf("expected the parse error with its line, got %v", messages(report))
+	}
+
+	// config files that don't exist are skipped, as long as one does
+	missing := filepath.Join(dir, "missing")
+	ankh.AnkhConfigPaths = []string{missing, filepath.Join(dir, "config")}
+	if got := messages(Lint(testLogger(), filepath.Join(dir, "ankh.yaml"), "broken")); len(got) == 0 || !strings.HasPrefix(got[0], filepath.Join(dir, "config")+":2: ") {
+		t.Errorf("expected the broken context first, got %v", got)
+	}
+	ankh.AnkhConfigPaths = []string{missing}
+	expected = missing + ": unable to read the ankh config, none of " + missing + " exist"
+	if got := messages(Lint(testLogger(), filepath.Join(dir, "ankh.yaml"), "")); len(got) == 0 || got[0] != expected {
+		t.Errorf("expected %s, got %v", expected, got)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	report := Report{Findings: []Finding{
+		{File: "ankh.yaml", Line: 3, Chart: "web", Message: "first"},
+		{File: "config", Message: "second"},
+	}}
+
+	out, err := report.Format(FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "ankh.yaml:3: first\nconfig: second\n" {
+		t.Errorf("unexpected text output %q", out)
+	}
+
+	out, err = report.Format(FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := Report{}
+	if err := json.Unmarshal([]byte(out), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Findings) != 2 || decoded.Findings[0] != report.Findings[0] {
+		t.Errorf("unexpected json output %s", out)
+	}
+
+	if out, _ := (Report{Findings: []Finding{}}).Format(FormatJSON); out != "{\n  \"findings\": []\n}\n" {
+		t.Errorf("expected an empty list of findings, got %s", out)
+	}
+
+	if _, err := report.Format("xml"); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+}
@@ -0,0 +1,136 @@
+package lint
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// positions maps the paths of keys and list items in a YAML file, like
+// `charts[0].values.dev`, to the line they're on. yaml.v2 doesn't keep
+// positions, so this follows the indentation of block style YAML. Anything
+// inside flow style `{}` or `[]` collections is found at the line of the
+// collection.
+type positions map[string]int
+
+var keyLine = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s#'"][^:#]*?)\s*:(\s|$)`)
+
+// frame is a collection that's still open while indexing
+type frame struct {
+	indent int
+	path   string
+	list   bool
+	next   int
+}
+
+func indexPositions(data []byte) positions {
+	p := positions{}
+	stack := []*frame{{indent: -1}}
+	pending := ""
+	blockIndent := -1
+
+	for i, raw := range strings.Split(string(data), "\n") {
+		line := i + 1
+		content := strings.TrimLeft(raw, " ")
+		indent := len(raw) - len(content)
+		content = strings.TrimRight(content, " \t\r")
+
+		if blockIndent >= 0 {
+			if content == "" || indent > blockIndent {
+				continue
+			}
+			blockIndent = -1
+		}
+		if content == "" || strings.HasPrefix(content, "#") || content == "---" {
+			continue
+		}
+
+		for len(stack) > 1 && stack[len(stack)-1].indent > indent {
+			stack = stack[:len(stack)-1]
+		}
+		top := stack[len(stack)-1]
+		isItem := content == "-" || strings.HasPrefix(content, "- ")
+
+		switch {
+		case top.indent < indent:
+			top = &frame{indent: indent, path: pending, list: isItem}
+			stack = append(stack, top)
+		case isItem && !top.list:
+			// list items can sit at the same indentation as their key
+			top = &frame{indent: indent, path: pending, list: true}
+			stack = append(stack, top)
+		case !isItem && top.list && len(stack) > 1:
+			stack = stack[:len(stack)-1]
+			top = stack[len(stack)-1]
+		}
+
+		for isItem {
+			itemPath := top.path + "[" + strconv.Itoa(top.next) + "]"
+			top.next++
+			p[itemPath] = line
+			pending = itemPath
+
+			rest := strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+			if rest == "" {
+				break
+			}
+			// the rest of the line is the first entry of a collection in the
+			// item, `- name: web` or `- - a`
+			indent += len(content) - len(rest)
+			content = rest
+			isItem = content == "-" || strings.HasPrefix(content, "- ")
+			top = &frame{indent: indent, path: itemPath, list: isItem}
+			stack = append(stack, top)
+		}
+
+		m := keyLine.FindStringSubmatch(content)
+		if m == nil {
+			continue
+		}
+		key := strings.Trim(m[1], `"'`)
+		path := joinPath(top.path, key)
+		p[path] = line
+		pending = path
+
+		value := strings.TrimSpace(content[len(m[0]):])
+		if strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+			blockIndent = indent
+		}
+	}
+
+	return p
+}
+
+// line returns the line of a path, or of the closest thing above it that's
+// in the file, or 0 if nothing is
+func (p positions) line(path string) int {
+	for path != "" {
+		if line, ok := p[path]; ok {
+			return line
+		}
+		path = parentPath(path)
+	}
+	return 0
+}
+
+func joinPath(path string, keys ...string) string {
+	for _, k := range keys {
+		switch {
+		case strings.HasPrefix(k, "["):
+			path += k
+		case path == "":
+			path = k
+		default:
+			path += "." + k
+		}
+	}
+	return path
+}
+
+func parentPath(path string) string {
+	i := strings.LastIndexAny(path, ".[")
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
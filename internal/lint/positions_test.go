@@ -0,0 +1,65 @@
+package lint
+
+import "testing"
+
+func TestIndexPositions(t *testing.T) {
+	data := `# comment
+namespace: web
+charts:
+- name: web
+  version: 1.0.0
+  default_values:
+    replicas: 2
+    ports: [80, 443]
+    script: |
+      name: not a key
+  values:
+    dev:
+      "quoted": true
+- name: db
+bootstrap:
+  scripts:
+    - path: ./up.sh
+    -
+      path: ./down.sh
+`
+	expected := map[string]int{
+		"namespace":                       2,
+		"charts":                          3,
+		"charts[0]":                       4,
+		"charts[0].name":                  4,
+		"charts[0].default_values.ports":  8,
+		"charts[0].default_values.script": 9,
+		"charts[0].values.dev.quoted":     13,
+		"charts[1].name":                  14,
+		"bootstrap.scripts[0].path":       17,
+		"bootstrap.scripts[1]":            18,
+		"bootstrap.scripts[1].path":       19,
+	}
+
+	p := indexPositions([]byte(data))
+	for path, line := range expected {
+		if p[path] != line {
+			t.Errorf("expected %s on line %d, got %d", path, line, p[path])
+		}
+	}
+	if _, ok := p["charts[0].default_values.name"]; ok {
+		t.Error("expected block scalars to be skipped")
+	}
+
+	if line := p.line("charts[0].default_values.ports[1]"); line != 8 {
+		t.Errorf("expected a missing path to fall back to its parent, got %d", line)
+	}
+	if line := p.line("missing"); line != 0 {
+		t.Errorf("expected 0 for a path that isn't there, got %d", line)
+	}
+}
+
+func TestJoinPath(t *testing.T) {
+	if p := joinPath("", "charts", "[1]", "values", "dev"); p != "charts[1].values.dev" {
+		t.Errorf("unexpected path %s", p)
+	}
+	if p := parentPath("charts[1]"); p != "charts" {
+		t.Errorf("unexpected parent %s", p)
+	}
+}
@@ -0,0 +1,123 @@
+package lock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// FileName is the name of the lock file written next to each ankh.yaml
+const FileName = "ankh.lock"
+
+const header = "# This file is generated by `ankh lock`, don't edit it by hand.\n"
+
+// Entry pins a single chart to exactly what was fetched when it was locked
+type Entry struct {
+	Name string
+	// Version is the version or constraint from the ankh file
+	Version string
+	// Resolved is the exact version Version resolved to
+	Resolved string
+	URL      string
+	// Digest is the sha256 digest of the chart tarball, prefixed with
+	// `sha256:`
+	Digest string
+}
+
+// Lock is the contents of an ankh.lock file
+type Lock struct {
+	Charts []Entry
+}
+
+// Path returns where the lock file for an ankh file lives
+func Path(ankhFilePath string) string {
+	return filepath.Join(filepath.Dir(ankhFilePath), FileName)
+}
+
+// Read loads a lock file. exists is false, with no error, when there isn't
+// one.
+func Read(path string) (l Lock, exists bool, err error) {
+	lockBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, false, nil
+	}
+	if err != nil {
+		return l, false, err
+	}
+
+	if err := yaml.UnmarshalStrict(lockBytes, &l); err != nil {
+		return l, true, fmt.Errorf("unable to process %s file: %v", path, err)
+	}
+
+	return l, true, nil
+}
+
+// Write saves a lock file
+func Write(path string, l Lock) error {
+	lockBytes, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append([]byte(header), lockBytes...), 0644)
+}
+
+// Find returns the entry for a chart
+func (l Lock) Find(name string) (Entry, bool) {
+	for _, e := range l.Charts {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// HexDigest returns the digest without its `sha256:` prefix
+func (e Entry) HexDigest() string {
+	return strings.TrimPrefix(e.Digest, "sha256:")
+}
+
+// Chart is a chart that should be locked, described by its name and the
+// version requested in the ankh file
+type Chart struct {
+	Name    string
+	Version string
+}
+
+// Check returns an error when a lock doesn't cover exactly the given charts
+// at the versions they're requested at
+func (l Lock) Check(charts []Chart) error {
+	problems := []string{}
+
+	for _, chart := range charts {
+		e, ok := l.Find(chart.Name)
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("chart '%s' is not locked", chart.Name))
+		case e.Version != chart.Version:
+			problems = append(problems, fmt.Sprintf("chart '%s' is locked at version '%s' but '%s' is requested", chart.Name, e.Version, chart.Version))
+		}
+	}
+
+	for _, e := range l.Charts {
+		found := false
+		for _, chart := range charts {
+			if chart.Name == e.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("chart '%s' is locked but no longer used", e.Name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package lock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ankh-lock-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := Path(filepath.Join(dir, "ankh.yaml"))
+	if path != filepath.Join(dir, "ankh.lock") {
+		t.Errorf("unexpected lock path %s", path)
+	}
+
+	if _, exists, err := Read(path); exists || err != nil {
+		t.Fatalf("expected a missing lock, got exists=%v err=%v", exists, err)
+	}
+
+	l := Lock{Charts: []Entry{{Name: "web", Version: "~1.2", Resolved: "1.2.5", URL: "http://registry/web-1.2.5.tgz", Digest: "sha256:abcd"}}}
+	if err := Write(path, l); err != nil {
+		t.Fatal(err)
+	}
+
+	read, exists, err := Read(path)
+	if err != nil || !exists {
+		t.Fatalf("expected a lock, got exists=%v err=%v", exists, err)
+	}
+	if len(read.Charts) != 1 || read.Charts[0] != l.Charts[0] {
+		t.Errorf("expected %+v, got %+v", l, read)
+	}
+	if read.Charts[0].HexDigest() != "abcd" {
+		t.Errorf("unexpected digest %s", read.Charts[0].HexDigest())
+	}
+}
+
+func TestCheck(t *testing.T) {
+	l := Lock{Charts: []Entry{
+		{Name: "web", Version: "~1.2"},
+		{Name: "api", Version: "2.0.0"},
+	}}
+
+	if err := l.Check([]Chart{{"web", "~1.2"}, {"api", "2.0.0"}}); err != nil {
+		t.Errorf("expected a matching lock, got %v", err)
+	}
+
+	err := l.Check([]Chart{{"web", "~1.3"}, {"worker", "1.0.0"}})
+	if err == nil {
+		t.Fatal("expected an out of date lock")
+	}
+	for _, problem := range []string{
+		"chart 'web' is locked at version '~1.2' but '~1.3' is requested",
+		"chart 'worker' is not locked",
+		"chart 'api' is locked but no longer used",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q in %v", problem, err)
+		}
+	}
+}
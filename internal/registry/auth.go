@@ -0,0 +1,135 @@
+package registry
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Credentials are sent with every request to the registry's host. A Token
+// is sent as a bearer token and takes precedence over Username and Password,
+// which are sent as basic auth.
+type Credentials struct {
+	Username string
+	Password string
+	Token    string
+}
+
+// Empty reports whether there's nothing to authenticate with
+func (c Credentials) Empty() bool {
+	return c.Token == "" && c.Username == "" && c.Password == ""
+}
+
+func (c Credentials) apply(req *http.Request) {
+	switch {
+	case c.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	case c.Username != "" || c.Password != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// NetrcCredentials looks up the login and password for host in the
+// netrc-style file at path, falling back to its `default` entry. A missing
+// file isn't an error, it just has no credentials.
+func NetrcCredentials(path, host string) (Credentials, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return Credentials{}, nil
+	}
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer f.Close()
+
+	machines, err := parseNetrc(f)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+
+	if c, ok := machines[host]; ok {
+		return c, nil
+	}
+	return machines[""], nil
+}
+
+// parseNetrc reads the machine, default, login and password tokens of a
+// netrc file. Everything else, including macro definitions, is skipped. The
+// default entry is stored under the empty host.
+func parseNetrc(r io.Reader) (map[string]Credentials, error) {
+	machines := map[string]Credentials{}
+
+	scanner := bufio.NewScanner(r)
+	var tokens []string
+	inMacro := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		// macro definitions run until the next blank line
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i, field := range fields {
+			if field == "macdef" {
+				fields = fields[:i]
+				inMacro = true
+				break
+			}
+		}
+		tokens = append(tokens, fields...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	current, inEntry := "", false
+	for i := 0; i < len(tokens); i++ {
+		value := func() (string, error) {
+			if i+1 >= len(tokens) {
+				return "", fmt.Errorf("missing value for `%s`", tokens[i])
+			}
+			i++
+			return tokens[i], nil
+		}
+
+		switch tokens[i] {
+		case "machine":
+			host, err := value()
+			if err != nil {
+				return nil, err
+			}
+			current, inEntry = host, true
+			machines[current] = Credentials{}
+		case "default":
+			current, inEntry = "", true
+			machines[current] = Credentials{}
+		case "login", "password", "account":
+			token := tokens[i]
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			if !inEntry {
+				return nil, fmt.Errorf("`%s` outside of a machine entry", token)
+			}
+			c := machines[current]
+			if token == "login" {
+				c.Username = v
+			} else if token == "password" {
+				c.Password = v
+			}
+			machines[current] = c
+		default:
+			return nil, fmt.Errorf("unexpected token `%s`", tokens[i])
+		}
+	}
+
+	return machines, nil
+}
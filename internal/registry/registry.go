@@ -0,0 +1,359 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultIndexTTL is how long a fetched index.yaml is trusted before it's
+// fetched again
+const DefaultIndexTTL = 5 * time.Minute
+
+// DefaultTimeout bounds a whole request to the registry, including reading
+// the body
+const DefaultTimeout = 2 * time.Minute
+
+// DefaultDialTimeout bounds connecting and the TLS handshake
+const DefaultDialTimeout = 10 * time.Second
+
+// DefaultResponseTimeout bounds waiting for the response headers
+const DefaultResponseTimeout = 30 * time.Second
+
+// DefaultRetries and DefaultBackoff control how failed requests are retried
+const DefaultRetries = 3
+const DefaultBackoff = 500 * time.Millisecond
+
+// ErrNoIndex is returned by Registry.Index when the registry doesn't serve an
+// index.yaml
+var ErrNoIndex = errors.New("registry has no index.yaml")
+
+// ChartVersion is a single chart version listed in a registry index
+type ChartVersion struct {
+	Name    string   `yaml:"name"`
+	Version string   `yaml:"version"`
+	Digest  string   `yaml:"digest"`
+	URLs    []string `yaml:"urls"`
+}
+
+// Index is the `index.yaml` file served by a Helm chart repository
+type Index struct {
+	APIVersion string                    `yaml:"apiVersion"`
+	Entries    map[string][]ChartVersion `yaml:"entries"`
+}
+
+// Resolve picks the highest version of a chart that satisfies constraint.
+// Versions in the index that aren't valid semantic versions are skipped.
+func (i Index) Resolve(name, constraint string) (ChartVersion, error) {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return ChartVersion{}, fmt.Errorf("invalid version constraint '%s': %v", constraint, err)
+	}
+
+	versions, ok := i.Entries[name]
+	if !ok {
+		return ChartVersion{}, fmt.Errorf("chart '%s' not found in the registry index", name)
+	}
+
+	var best ChartVersion
+	var bestVersion *semver.Version
+	for _, cv := range versions {
+		v, err := semver.NewVersion(cv.Version)
+		if err != nil || !c.Check(v) {
+			continue
+		}
+		if bestVersion == nil || v.GreaterThan(bestVersion) {
+			best, bestVersion = cv, v
+		}
+	}
+
+	if bestVersion == nil {
+		return ChartVersion{}, fmt.Errorf("no version of chart '%s' in the registry index satisfies '%s'", name, constraint)
+	}
+
+	best.Digest = strings.TrimPrefix(best.Digest, "sha256:")
+	return best, nil
+}
+
+// Registry is a Helm chart repository reachable over http
+type Registry struct {
+	URL    string
+	Client *http.Client
+	// Credentials are only sent to the registry's own host, never to charts
+	// the index points at somewhere else
+	Credentials Credentials
+	// CacheDir holds fetched index files so they can be reused for IndexTTL
+	// and as a fallback when the registry can't be reached
+	CacheDir string
+	IndexTTL time.Duration
+	// Retries is how many more times a request is tried after a timeout, a
+	// dropped connection or a 5xx/429 response, waiting Backoff and then
+	// twice as long each time. Other errors, like a bad certificate or a
+	// host that doesn't resolve, aren't retried.
+	Retries int
+	Backoff time.Duration
+}
+
+// Options configure how a Registry connects
+type Options struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots
+	CAFile string
+	// CertFile and KeyFile are a client certificate for mutual TLS
+	CertFile string
+	KeyFile  string
+	// Insecure skips verifying the registry's certificate
+	Insecure    bool
+	Credentials Credentials
+}
+
+// New returns a Registry for the repository at registryURL which keeps its
+// index files in cacheDir
+func New(registryURL, cacheDir string, opts Options) (*Registry, error) {
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   DefaultDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   DefaultDialTimeout,
+		ResponseHeaderTimeout: DefaultResponseTimeout,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	return &Registry{
+		URL:         strings.TrimRight(registryURL, "/"),
+		Client:      &http.Client{Transport: tr, Timeout: DefaultTimeout},
+		Credentials: opts.Credentials,
+		CacheDir:    cacheDir,
+		IndexTTL:    DefaultIndexTTL,
+		Retries:     DefaultRetries,
+		Backoff:     DefaultBackoff,
+	}, nil
+}
+
+func (opts Options) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.Insecure}
+
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the registry CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in the registry CA bundle %s", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, fmt.Errorf("a registry client certificate needs both a cert file and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the registry client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Index returns the registry's index.yaml, from the local copy if it was
+// fetched within IndexTTL. When the registry can't be reached a stale local
+// copy is used instead. A registry without an index returns ErrNoIndex.
+func (r *Registry) Index() (Index, error) {
+	index := Index{}
+
+	sum := sha256.Sum256([]byte(r.URL))
+	cachePath := filepath.Join(r.CacheDir, hex.EncodeToString(sum[:8])+".yaml")
+
+	cached, cacheErr := os.Stat(cachePath)
+	if cacheErr == nil && time.Since(cached.ModTime()) < r.IndexTTL {
+		return readIndex(cachePath)
+	}
+
+	body, err := r.Get(r.URL + "/index.yaml")
+	if err == nil {
+		defer body.Close()
+		err = writeFile(cachePath, body)
+	}
+
+	if err != nil {
+		if err == ErrNoIndex || cacheErr != nil {
+			return index, err
+		}
+		// the registry can't be reached, fall back to whatever we had
+		return readIndex(cachePath)
+	}
+
+	return readIndex(cachePath)
+}
+
+// ChartURL returns the absolute url to download a chart version from
+func (r *Registry) ChartURL(cv ChartVersion) (string, error) {
+	if len(cv.URLs) == 0 {
+		return "", fmt.Errorf("chart '%s' version '%s' has no urls in the registry index", cv.Name, cv.Version)
+	}
+
+	base, err := url.Parse(r.URL + "/")
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(cv.URLs[0])
+	if err != nil {
+		return "", err
+	}
+
+	return base.ResolveReference(ref).String(), nil
+}
+
+// Get downloads a url from the registry. The caller must close the body.
+// A 404 for an index.yaml is reported as ErrNoIndex.
+func (r *Registry) Get(u string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.sameHost(req.URL) {
+		r.Credentials.apply(req)
+	}
+
+	backoff := r.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := r.Client.Do(req)
+
+		retry := transient(err) || err == nil && (resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests)
+		if retry && attempt < r.Retries {
+			if err == nil {
+				resp.Body.Close()
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode == http.StatusNotFound && strings.HasSuffix(u, "/index.yaml"):
+				return nil, ErrNoIndex
+			case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+				return nil, fmt.Errorf("got a status code %v when trying to call %s, check the registry credentials", resp.StatusCode, u)
+			}
+			return nil, fmt.Errorf("got a status code %v when trying to call %s", resp.StatusCode, u)
+		}
+
+		return resp.Body, nil
+	}
+}
+
+// transient reports whether a failed request could work when it's tried
+// again, which is the case for timeouts and connections that were reset or
+// closed early
+func transient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// sameHost reports whether u points at the registry itself, which takes the
+// same scheme, host and port
+func (r *Registry) sameHost(u *url.URL) bool {
+	base, err := url.Parse(r.URL)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(base.Scheme, u.Scheme) &&
+		strings.EqualFold(base.Hostname(), u.Hostname()) &&
+		port(base) == port(u)
+}
+
+// port returns the port a url connects to, filling in the default one for
+// its scheme
+func port(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
+
+func readIndex(path string) (Index, error) {
+	index := Index{}
+
+	indexBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return index, err
+	}
+
+	if err := yaml.Unmarshal(indexBytes, &index); err != nil {
+		return index, fmt.Errorf("unable to parse registry index: %v", err)
+	}
+
+	return index, nil
+}
+
+// writeFile writes r to path by way of a temp file so readers never see a
+// partial file
+func writeFile(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".index-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
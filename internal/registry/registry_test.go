@@ -0,0 +1,406 @@
+package registry
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testIndex = `apiVersion: v1
+entries:
+  web:
+  - name: web
+    version: 1.2.0
+    digest: aaaa
+    urls:
+    - web-1.2.0.tgz
+  - name: web
+    version: 1.10.0
+    digest: sha256:bbbb
+    urls:
+    - https://cdn.example.com/web-1.10.0.tgz
+  - name: web
+    version: not-semver
+    urls:
+    - web-bogus.tgz
+  - name: web
+    version: 2.0.0-rc.1
+    urls:
+    - web-2.0.0-rc.1.tgz
+`
+
+func testRegistry(t *testing.T, handler http.HandlerFunc) (*Registry, func()) {
+	dir, err := ioutil.TempDir("", "ankh-registry-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handler)
+	reg, err := New(server.URL+"/charts/", dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.Backoff = time.Millisecond
+	return reg, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestIndexResolve(t *testing.T) {
+	requests := 0
+	reg, cleanup := testRegistry(t, func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.URL.Path != "/charts/index.yaml" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(testIndex))
+	})
+	defer cleanup()
+
+	index, err := reg.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"1.2.0":      "1.2.0",
+		"~1.2":       "1.2.0",
+		">=1 <2":     "1.10.0",
+		"*":          "1.10.0",
+		">=2.0.0-rc": "2.0.0-rc.1",
+	}
+	for constraint, expected := range tests {
+		cv, err := index.Resolve("web", constraint)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", constraint, err)
+			continue
+		}
+		if cv.Version != expected {
+			t.Errorf("%s: expected %s, got %s", constraint, expected, cv.Version)
+		}
+	}
+
+	cv, _ := index.Resolve("web", "1.10.0")
+	if cv.Digest != "bbbb" {
+		t.Errorf("expected the sha256: prefix to be dropped, got %s", cv.Digest)
+	}
+	if u, _ := reg.ChartURL(cv); u != "https://cdn.example.com/web-1.10.0.tgz" {
+		t.Errorf("expected an absolute url to be kept, got %s", u)
+	}
+	cv, _ = index.Resolve("web", "1.2.0")
+	if u, _ := reg.ChartURL(cv); u != reg.URL+"/web-1.2.0.tgz" {
+		t.Errorf("expected a relative url to be resolved against the registry, got %s", u)
+	}
+
+	if _, err := index.Resolve("web", "^3"); err == nil {
+		t.Error("expected an error for an unsatisfiable constraint")
+	}
+	if _, err := index.Resolve("api", "1.0.0"); err == nil {
+		t.Error("expected an error for a missing chart")
+	}
+
+	// the second call is served from the local copy
+	if _, err := reg.Index(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("expected one request, got %d", requests)
+	}
+}
+
+func TestIndexStaleFallback(t *testing.T) {
+	up := true
+	reg, cleanup := testRegistry(t, func(w http.ResponseWriter, req *http.Request) {
+		if !up {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(testIndex))
+	})
+	defer cleanup()
+
+	if _, err := reg.Index(); err != nil {
+		t.Fatal(err)
+	}
+
+	up = false
+	reg.IndexTTL = 0
+
+	index, err := reg.Index()
+	if err != nil {
+		t.Fatalf("expected the stale index to be used, got %v", err)
+	}
+	if len(index.Entries["web"]) != 4 {
+		t.Errorf("unexpected index %+v", index)
+	}
+}
+
+func TestNoIndex(t *testing.T) {
+	reg, cleanup := testRegistry(t, func(w http.ResponseWriter, req *http.Request) {
+		http.NotFound(w, req)
+	})
+	defer cleanup()
+
+	if _, err := reg.Index(); err != ErrNoIndex {
+		t.Errorf("expected ErrNoIndex, got %v", err)
+	}
+}
+
+func TestGetRetries(t *testing.T) {
+	requests := 0
+	reg, cleanup := testRegistry(t, func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests < 3 {
+			http.Error(w, "busy", http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("chart"))
+	})
+	defer cleanup()
+
+	body, err := reg.Get(reg.URL + "/web-1.0.0.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+
+	requests = -10
+	if _, err := reg.Get(reg.URL + "/web-1.0.0.tgz"); err == nil {
+		t.Error("expected an error once the retries run out")
+	}
+	if requests != -10+reg.Retries+1 {
+		t.Errorf("expected %d attempts, got %d", reg.Retries+1, requests+10)
+	}
+}
+
+func TestGetRetriesTransientErrors(t *testing.T) {
+	requests := 0
+	reg, cleanup := testRegistry(t, func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests == 1 {
+			// drop the connection without a response
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			return
+		}
+		http.Error(w, "bad request", http.StatusBadRequest)
+	})
+	defer cleanup()
+
+	// the dropped connection is tried again, the 400 isn't
+	if _, err := reg.Get(reg.URL + "/web-1.0.0.tgz"); err == nil || !strings.Contains(err.Error(), "status code 400") {
+		t.Errorf("expected the 400, got %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{&url.Error{Op: "Get", URL: "http://localhost", Err: timeoutError{}}, true},
+		{&url.Error{Op: "Get", URL: "http://localhost", Err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}, true},
+		{&url.Error{Op: "Get", URL: "http://localhost", Err: io.EOF}, true},
+		{&url.Error{Op: "Get", URL: "http://localhost", Err: &net.DNSError{Err: "no such host", Name: "nowhere"}}, false},
+		{&url.Error{Op: "Get", URL: "http://localhost", Err: x509.UnknownAuthorityError{}}, false},
+		{errors.New("unsupported protocol scheme"), false},
+	}
+	for _, test := range tests {
+		if transient(test.err) != test.expected {
+			t.Errorf("%v: expected transient to be %v", test.err, test.expected)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestSameHost(t *testing.T) {
+	reg := &Registry{URL: "https://charts.example.com/charts"}
+	tests := []struct {
+		url      string
+		expected bool
+	}{
+		{"https://charts.example.com/charts/web-1.0.0.tgz", true},
+		{"https://CHARTS.example.com:443/web-1.0.0.tgz", true},
+		{"http://charts.example.com/web-1.0.0.tgz", false},
+		{"https://charts.example.com:8443/web-1.0.0.tgz", false},
+		{"https://cdn.example.com/web-1.0.0.tgz", false},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reg.sameHost(u) != test.expected {
+			t.Errorf("%s: expected %v", test.url, test.expected)
+		}
+	}
+}
+
+func TestGetCredentials(t *testing.T) {
+	var auth string
+	reg, cleanup := testRegistry(t, func(w http.ResponseWriter, req *http.Request) {
+		auth = req.Header.Get("Authorization")
+	})
+	defer cleanup()
+
+	tests := []struct {
+		creds    Credentials
+		expected string
+	}{
+		{Credentials{}, ""},
+		{Credentials{Token: "abc"}, "Bearer abc"},
+		{Credentials{Username: "user", Password: "pass"}, "Basic dXNlcjpwYXNz"},
+		{Credentials{Username: "user", Password: "pass", Token: "abc"}, "Bearer abc"},
+	}
+	for _, test := range tests {
+		reg.Credentials = test.creds
+		body, err := reg.Get(reg.URL + "/index.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Close()
+		if auth != test.expected {
+			t.Errorf("%+v: expected %q, got %q", test.creds, test.expected, auth)
+		}
+	}
+
+	// charts hosted somewhere else don't get the registry's credentials
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth = req.Header.Get("Authorization")
+	}))
+	defer other.Close()
+
+	reg.Credentials = Credentials{Token: "abc"}
+	body, err := reg.Get(other.URL + "/web-1.0.0.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if auth != "" {
+		t.Errorf("expected no credentials for another host, got %q", auth)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ankh-registry-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		opts Options
+		ok   bool
+	}{
+		{Options{}, false},
+		{Options{CAFile: caFile}, true},
+		{Options{Insecure: true}, true},
+	}
+	for _, test := range tests {
+		reg, err := New(server.URL, dir, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reg.Retries = 0
+
+		body, err := reg.Get(server.URL + "/index.yaml")
+		if err == nil {
+			body.Close()
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%+v: expected success %v, got %v", test.opts, test.ok, err)
+		}
+	}
+
+	if _, err := New(server.URL, dir, Options{CAFile: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("expected an error for a missing CA bundle")
+	}
+	if _, err := New(server.URL, dir, Options{CertFile: caFile}); err == nil {
+		t.Error("expected an error for a cert without a key")
+	}
+}
+
+func TestNetrcCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ankh-registry-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "netrc")
+	netrc := `# registries
+machine charts.example.com login ci password s3cret
+macdef init
+cd /pub
+
+machine other.example.com
+  login someone
+  account ignored
+  password hunter2
+default login anonymous password guest
+`
+	if err := ioutil.WriteFile(path, []byte(netrc), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]Credentials{
+		"charts.example.com":  {Username: "ci", Password: "s3cret"},
+		"other.example.com":   {Username: "someone", Password: "hunter2"},
+		"unknown.example.com": {Username: "anonymous", Password: "guest"},
+	}
+	for host, expected := range tests {
+		creds, err := NetrcCredentials(path, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds != expected {
+			t.Errorf("%s: expected %+v, got %+v", host, expected, creds)
+		}
+	}
+
+	if creds, err := NetrcCredentials(filepath.Join(dir, "missing"), "charts.example.com"); err != nil || !creds.Empty() {
+		t.Errorf("expected no credentials for a missing file, got %+v, %v", creds, err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("machine charts.example.com login"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NetrcCredentials(path, "charts.example.com"); err == nil {
+		t.Error("expected an error for a truncated netrc file")
+	}
+}
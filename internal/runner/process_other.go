@@ -0,0 +1,17 @@
+//go:build !unix
+
+package runner
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Without process groups only the process itself is killed, so its children
+// can outlive it
+
+func newProcessGroup(c *exec.Cmd) {}
+
+func killProcessGroup(p *os.Process) {
+	p.Kill()
+}
@@ -0,0 +1,97 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// Command describes an external process to run
+type Command struct {
+	// Args holds the binary name followed by its arguments
+	Args []string
+	// Stdin, Stdout and Stderr are hooked up to the process when they're not
+	// nil
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Dir is the working directory of the process. An empty Dir is the
+	// current one.
+	Dir string
+	// Env is the environment of the process, in `KEY=value` form. A nil Env
+	// is the environment of ankh itself.
+	Env []string
+	// Context kills the process when it's done. A nil Context never does.
+	Context context.Context
+}
+
+// Runner runs external commands. Packages that shell out take a Runner
+// instead of calling os/exec directly so they can be tested without the real
+// binaries.
+type Runner interface {
+	Run(cmd Command) error
+}
+
+// Exec is a Runner that shells out using os/exec
+type Exec struct{}
+
+// Run starts the command and waits for it to finish. When the Context is
+// done the process is killed along with any children it started, so
+// grandchildren holding onto stdout or stderr can't keep Run waiting.
+func (Exec) Run(cmd Command) error {
+	c := exec.Command(cmd.Args[0], cmd.Args[1:]...)
+	c.Stdin = cmd.Stdin
+	c.Stdout = cmd.Stdout
+	c.Stderr = cmd.Stderr
+	c.Dir = cmd.Dir
+	c.Env = cmd.Env
+	newProcessGroup(c)
+
+	if err := c.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if cmd.Context != nil {
+		go func() {
+			select {
+			case <-cmd.Context.Done():
+				killProcessGroup(c.Process)
+			case <-done:
+			}
+		}()
+	}
+
+	return c.Wait()
+}
+
+// ExitError is a failed exit status. Fakes can return it to simulate a
+// command that exits with a specific code.
+type ExitError struct {
+	Code int
+}
+
+func (e ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode returns the exit code of the process
+func (e ExitError) ExitCode() int {
+	return e.Code
+}
+
+// ExitCode pulls the exit code out of an error returned by Run. It returns
+// -1 when the command never got to exit, e.g. because it couldn't be found.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(interface {
+		ExitCode() int
+	}); ok {
+		return e.ExitCode()
+	}
+	return -1
+}
@@ -0,0 +1,109 @@
+package runnertest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/jondlm/ankh/internal/runner"
+)
+
+// Call is a command that was run through a Fake
+type Call struct {
+	Args []string
+	Dir  string
+	Env  []string
+	// Stdin is everything the command was given on stdin
+	Stdin string
+}
+
+// Response is the canned result of a Call
+type Response struct {
+	Stdout string
+	Stderr string
+	Err    error
+}
+
+// Fake is a runner.Runner that records every command it's given and answers
+// with canned output instead of running anything. It's for tests of the
+// packages that shell out.
+type Fake struct {
+	// Respond decides what each call returns. A nil Respond makes every call
+	// succeed with no output.
+	Respond func(call Call) Response
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+// NewFake returns a Fake that hands out responses in order, one per call,
+// and fails any calls beyond that
+func NewFake(responses ...Response) *Fake {
+	var mu sync.Mutex
+	next := 0
+
+	return &Fake{
+		Respond: func(call Call) Response {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if next >= len(responses) {
+				return Response{Err: fmt.Errorf("unexpected call to %v", call.Args)}
+			}
+			next++
+			return responses[next-1]
+		},
+	}
+}
+
+// Run records the command and writes the canned response to its stdout and
+// stderr. A command whose Context is already done isn't run at all.
+func (f *Fake) Run(cmd runner.Command) error {
+	if cmd.Context != nil && cmd.Context.Err() != nil {
+		return cmd.Context.Err()
+	}
+
+	call := Call{Args: append([]string{}, cmd.Args...), Dir: cmd.Dir, Env: append([]string(nil), cmd.Env...)}
+	if cmd.Stdin != nil {
+		stdin, err := ioutil.ReadAll(cmd.Stdin)
+		if err != nil {
+			return err
+		}
+		call.Stdin = string(stdin)
+	}
+
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	f.mu.Unlock()
+
+	resp := Response{}
+	if f.Respond != nil {
+		resp = f.Respond(call)
+	}
+
+	if err := write(cmd.Stdout, resp.Stdout); err != nil {
+		return err
+	}
+	if err := write(cmd.Stderr, resp.Stderr); err != nil {
+		return err
+	}
+
+	return resp.Err
+}
+
+// Calls returns a copy of every call made so far
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Call{}, f.calls...)
+}
+
+func write(w io.Writer, s string) error {
+	if w == nil || s == "" {
+		return nil
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
@@ -0,0 +1,622 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a JSON Schema for chart values. The keywords that describe
+// values are checked: type, enum, const, the number, string, array and
+// object constraints, allOf, anyOf, oneOf, not and local `$ref`s. Other
+// validation keywords, like `format`, aren't checked and are listed in
+// Unsupported instead.
+type Schema struct {
+	root interface{}
+	// Unsupported are JSON pointers to the keywords of the schema that
+	// Validate doesn't check, like `#/properties/url/format`
+	Unsupported []string
+	// Unknown reports values that stand in for ones that aren't known yet,
+	// like secret references. They pass every check but still count as
+	// present for `required`.
+	Unknown func(v interface{}) bool
+
+	patterns map[string]*regexp.Regexp
+}
+
+// Violation is a value that doesn't match the schema
+type Violation struct {
+	// Path is a JSON path to the value, like `$.image.tag`
+	Path string
+	// Keys are the keys and list indexes on the way to the value
+	Keys    []string
+	Message string
+	// Missing are the keys a `required` is missing, for violations that are
+	// about nothing else
+	Missing []string
+}
+
+func (v Violation) String() string {
+	return v.Path + ": " + v.Message
+}
+
+// Parse parses a JSON Schema
+func Parse(data []byte) (*Schema, error) {
+	var root interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	switch root.(type) {
+	case map[string]interface{}, bool:
+	default:
+		return nil, fmt.Errorf("a schema has to be an object or a boolean")
+	}
+	s := &Schema{root: root, patterns: map[string]*regexp.Regexp{}}
+	s.Unsupported = unsupported(root, "#", []string{})
+	return s, nil
+}
+
+// unsupportedKeywords are the validation keywords of JSON Schema that
+// Validate doesn't check. Annotations like `title` or `default` don't
+// validate anything, so they aren't here.
+var unsupportedKeywords = map[string]bool{
+	"format":                true,
+	"contains":              true,
+	"minContains":           true,
+	"maxContains":           true,
+	"prefixItems":           true,
+	"propertyNames":         true,
+	"dependencies":          true,
+	"dependentRequired":     true,
+	"dependentSchemas":      true,
+	"if":                    true,
+	"then":                  true,
+	"else":                  true,
+	"unevaluatedItems":      true,
+	"unevaluatedProperties": true,
+	"$dynamicRef":           true,
+	"$recursiveRef":         true,
+}
+
+// unsupported walks a schema and every schema within it, adding pointers to
+// the unsupported keywords it finds to out
+func unsupported(schema interface{}, pointer string, out []string) []string {
+	sch, ok := schema.(map[string]interface{})
+	if !ok {
+		return out
+	}
+
+	for _, k := range sortedKeys(sch) {
+		child := pointer + "/" + escapePointer(k)
+		if unsupportedKeywords[k] {
+			out = append(out, child)
+			continue
+		}
+
+		switch k {
+		case "properties", "patternProperties", "definitions", "$defs":
+			if m, ok := sch[k].(map[string]interface{}); ok {
+				for _, name := range sortedKeys(m) {
+					out = unsupported(m[name], child+"/"+escapePointer(name), out)
+				}
+			}
+		case "allOf", "anyOf", "oneOf", "items":
+			if list, ok := sch[k].([]interface{}); ok {
+				for i, sub := range list {
+					out = unsupported(sub, child+"/"+strconv.Itoa(i), out)
+				}
+			} else {
+				out = unsupported(sch[k], child, out)
+			}
+		case "not", "additionalItems", "additionalProperties":
+			out = unsupported(sch[k], child, out)
+		}
+	}
+	return out
+}
+
+// escapePointer escapes a key for a JSON pointer
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+// Read reads and parses a JSON Schema file
+func Read(path string) (*Schema, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Validate checks values decoded from YAML against the schema and returns
+// every violation, in the order of the values' keys
+func (s *Schema) Validate(v interface{}) []Violation {
+	violations := []Violation{}
+	s.validate(s.root, v, "$", []string{}, &violations)
+	return violations
+}
+
+func (s *Schema) validate(schema, v interface{}, path string, keys []string, out *[]Violation) {
+	fail := func(format string, args ...interface{}) {
+		*out = append(*out, Violation{Path: path, Keys: keys, Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch schema := schema.(type) {
+	case bool:
+		if !schema {
+			fail("isn't allowed")
+		}
+		return
+	case map[string]interface{}:
+	default:
+		return
+	}
+	sch := schema.(map[string]interface{})
+
+	if ref, ok := sch["$ref"].(string); ok {
+		target, err := s.resolve(ref)
+		if err != nil {
+			fail("%v", err)
+			return
+		}
+		s.validate(target, v, path, keys, out)
+	}
+
+	if s.Unknown != nil && s.Unknown(v) {
+		return
+	}
+
+	if t, ok := sch["type"]; ok && !matchesType(t, v) {
+		fail("expected %s, got %s", typeList(t), typeName(v))
+		return
+	}
+
+	if enum, ok := sch["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if equal(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %s", jsonList(enum))
+		}
+	}
+	if c, ok := sch["const"]; ok && !equal(c, v) {
+		fail("must be %s", jsonValue(c))
+	}
+
+	if n, ok := number(v); ok {
+		s.validateNumber(sch, n, fail)
+	}
+	if str, ok := v.(string); ok {
+		s.validateString(sch, str, fail)
+	}
+	if list, ok := v.([]interface{}); ok {
+		s.validateArray(sch, list, path, keys, out, fail)
+	}
+	if obj, ok := object(v); ok {
+		s.validateObject(sch, obj, path, keys, out, fail)
+	}
+
+	s.validateCombinators(sch, v, path, keys, out, fail)
+}
+
+func (s *Schema) validateNumber(sch map[string]interface{}, n float64, fail func(string, ...interface{})) {
+	if min, ok := sch["minimum"].(float64); ok && n < min {
+		fail("must be at least %v", min)
+	}
+	if max, ok := sch["maximum"].(float64); ok && n > max {
+		fail("must be at most %v", max)
+	}
+	if min, ok := sch["exclusiveMinimum"].(float64); ok && n <= min {
+		fail("must be more than %v", min)
+	}
+	if max, ok := sch["exclusiveMaximum"].(float64); ok && n >= max {
+		fail("must be less than %v", max)
+	}
+	if m, ok := sch["multipleOf"].(float64); ok && m > 0 {
+		if q := n / m; math.Abs(q-math.Round(q)) > 1e-9 {
+			fail("must be a multiple of %v", m)
+		}
+	}
+}
+
+func (s *Schema) validateString(sch map[string]interface{}, str string, fail func(string, ...interface{})) {
+	length := float64(utf8.RuneCountInString(str))
+	if min, ok := sch["minLength"].(float64); ok && length < min {
+		fail("must be at least %v characters long", min)
+	}
+	if max, ok := sch["maxLength"].(float64); ok && length > max {
+		fail("must be at most %v characters long", max)
+	}
+	if pattern, ok := sch["pattern"].(string); ok {
+		re, err := s.pattern(pattern)
+		if err != nil {
+			fail("the schema has an invalid pattern %q: %v", pattern, err)
+		} else if !re.MatchString(str) {
+			fail("must match the pattern %q", pattern)
+		}
+	}
+}
+
+func (s *Schema) validateArray(sch map[string]interface{}, list []interface{}, path string, keys []string, out *[]Violation, fail func(string, ...interface{})) {
+	length := float64(len(list))
+	if min, ok := sch["minItems"].(float64); ok && length < min {
+		fail("must have at least %v items", min)
+	}
+	if max, ok := sch["maxItems"].(float64); ok && length > max {
+		fail("must have at most %v items", max)
+	}
+	if unique, ok := sch["uniqueItems"].(bool); ok && unique {
+		for i := range list {
+			for j := 0; j < i; j++ {
+				if equal(list[i], list[j]) {
+					fail("items %d and %d are the same", j, i)
+				}
+			}
+		}
+	}
+
+	switch items := sch["items"].(type) {
+	case []interface{}:
+		// a list of schemas checks the items in the same positions
+		for i, item := range list {
+			itemPath, itemKeys := indexPath(path, keys, i)
+			if i < len(items) {
+				s.validate(items[i], item, itemPath, itemKeys, out)
+			} else if additional, ok := sch["additionalItems"]; ok {
+				s.validate(additional, item, itemPath, itemKeys, out)
+			}
+		}
+	case nil:
+	default:
+		for i, item := range list {
+			itemPath, itemKeys := indexPath(path, keys, i)
+			s.validate(items, item, itemPath, itemKeys, out)
+		}
+	}
+}
+
+func (s *Schema) validateObject(sch map[string]interface{}, obj map[string]interface{}, path string, keys []string, out *[]Violation, fail func(string, ...interface{})) {
+	count := float64(len(obj))
+	if min, ok := sch["minProperties"].(float64); ok && count < min {
+		fail("must have at least %v keys", min)
+	}
+	if max, ok := sch["maxProperties"].(float64); ok && count > max {
+		fail("must have at most %v keys", max)
+	}
+
+	if required, ok := sch["required"].([]interface{}); ok {
+		missing := []string{}
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, ok := obj[name]; !ok {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			fail("missing required %s", strings.Join(missing, ", "))
+			(*out)[len(*out)-1].Missing = missing
+		}
+	}
+
+	properties, _ := sch["properties"].(map[string]interface{})
+	patternProperties, _ := sch["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := sch["additionalProperties"]
+
+	for _, k := range sortedKeys(obj) {
+		v := obj[k]
+		keyPath, keyKeys := childPath(path, keys, k)
+		matched := false
+
+		if p, ok := properties[k]; ok {
+			matched = true
+			s.validate(p, v, keyPath, keyKeys, out)
+		}
+		for _, pattern := range sortedKeys(patternProperties) {
+			re, err := s.pattern(pattern)
+			if err != nil || !re.MatchString(k) {
+				continue
+			}
+			matched = true
+			s.validate(patternProperties[pattern], v, keyPath, keyKeys, out)
+		}
+
+		if !matched && hasAdditional {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				*out = append(*out, Violation{Path: keyPath, Keys: keyKeys, Message: "isn't an allowed key" + suggestion(k, properties)})
+				continue
+			}
+			s.validate(additional, v, keyPath, keyKeys, out)
+		}
+	}
+}
+
+func (s *Schema) validateCombinators(sch map[string]interface{}, v interface{}, path string, keys []string, out *[]Violation, fail func(string, ...interface{})) {
+	if all, ok := sch["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			s.validate(sub, v, path, keys, out)
+		}
+	}
+	if anyOf, ok := sch["anyOf"].([]interface{}); ok && s.matching(anyOf, v, path, keys) == 0 {
+		fail("doesn't match any of the allowed schemas")
+	}
+	if oneOf, ok := sch["oneOf"].([]interface{}); ok {
+		if n := s.matching(oneOf, v, path, keys); n != 1 {
+			fail("must match exactly one of the allowed schemas, matches %d", n)
+		}
+	}
+	if not, ok := sch["not"]; ok && s.matching([]interface{}{not}, v, path, keys) == 1 {
+		fail("matches a schema it isn't allowed to")
+	}
+}
+
+// matching counts how many of schemas v matches
+func (s *Schema) matching(schemas []interface{}, v interface{}, path string, keys []string) int {
+	n := 0
+	for _, sub := range schemas {
+		violations := []Violation{}
+		s.validate(sub, v, path, keys, &violations)
+		if len(violations) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// resolve follows a `$ref` within the schema, like `#/definitions/port`
+func (s *Schema) resolve(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("the schema refers to %s, only refs within the schema are supported", ref)
+	}
+
+	current := s.root
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.Replace(strings.Replace(part, "~1", "/", -1), "~0", "~", -1)
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("the schema refers to %s, which doesn't exist", ref)
+		}
+		if current, ok = m[part]; !ok {
+			return nil, fmt.Errorf("the schema refers to %s, which doesn't exist", ref)
+		}
+	}
+	return current, nil
+}
+
+func (s *Schema) pattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := s.patterns[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if s.patterns == nil {
+		s.patterns = map[string]*regexp.Regexp{}
+	}
+	s.patterns[pattern] = re
+	return re, nil
+}
+
+func matchesType(t, v interface{}) bool {
+	switch t := t.(type) {
+	case string:
+		return isType(t, v)
+	case []interface{}:
+		for _, name := range t {
+			if name, ok := name.(string); ok && isType(name, v) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func isType(name string, v interface{}) bool {
+	actual := typeName(v)
+	switch name {
+	case "number":
+		return actual == "number" || actual == "integer"
+	case "integer":
+		return actual == "integer"
+	}
+	return name == actual
+}
+
+// typeName returns the JSON type of a value decoded from YAML
+func typeName(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[interface{}]interface{}, map[string]interface{}:
+		return "object"
+	case float32, float64:
+		if n, _ := number(v); n == math.Trunc(n) && !math.IsInf(n, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	if _, ok := number(v); ok {
+		return "integer"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func typeList(t interface{}) string {
+	if list, ok := t.([]interface{}); ok {
+		names := []string{}
+		for _, name := range list {
+			names = append(names, fmt.Sprint(name))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// object returns a map with string keys for maps decoded from YAML or JSON
+func object(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, true
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			out[fmt.Sprint(k)] = value
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// equal compares values the way JSON Schema does, so 1 from YAML equals 1.0
+// from JSON
+func equal(a, b interface{}) bool {
+	return reflect.DeepEqual(canonical(a), canonical(b))
+}
+
+func canonical(v interface{}) interface{} {
+	if n, ok := number(v); ok {
+		return n
+	}
+	if list, ok := v.([]interface{}); ok {
+		out := make([]interface{}, len(list))
+		for i, item := range list {
+			out[i] = canonical(item)
+		}
+		return out
+	}
+	if obj, ok := object(v); ok {
+		out := make(map[string]interface{}, len(obj))
+		for k, value := range obj {
+			out[k] = canonical(value)
+		}
+		return out
+	}
+	return v
+}
+
+func jsonValue(v interface{}) string {
+	out, err := json.Marshal(canonical(v))
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(out)
+}
+
+func jsonList(values []interface{}) string {
+	s := []string{}
+	for _, v := range values {
+		s = append(s, jsonValue(v))
+	}
+	return strings.Join(s, ", ")
+}
+
+var plainKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+func childPath(path string, keys []string, key string) (string, []string) {
+	childKeys := append(append([]string{}, keys...), key)
+	if plainKey.MatchString(key) {
+		return path + "." + key, childKeys
+	}
+	return path + "[" + strconv.Quote(key) + "]", childKeys
+}
+
+func indexPath(path string, keys []string, i int) (string, []string) {
+	index := "[" + strconv.Itoa(i) + "]"
+	return path + index, append(append([]string{}, keys...), index)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// suggestion points out the allowed key closest to a misspelled one
+func suggestion(key string, properties map[string]interface{}) string {
+	best, bestDistance := "", 3
+	for _, p := range sortedKeys(properties) {
+		if d := distance(strings.ToLower(key), strings.ToLower(p)); d < bestDistance {
+			best, bestDistance = p, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %s?", best)
+}
+
+// distance is the Levenshtein distance between two strings
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(prev[j]+1, current[j-1]+1, prev[j-1]+cost)
+		}
+		prev = current
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,144 @@
+package schema
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const testSchema = `{
+  "type": "object",
+  "required": ["image"],
+  "additionalProperties": false,
+  "definitions": {
+    "port": {"type": "integer", "minimum": 1, "maximum": 65535}
+  },
+  "properties": {
+    "image": {
+      "type": "object",
+      "required": ["repo"],
+      "properties": {
+        "repo": {"type": "string", "minLength": 1},
+        "tag": {"type": "string", "pattern": "^v[0-9]+"},
+        "pullPolicy": {"enum": ["Always", "IfNotPresent"]}
+      }
+    },
+    "replicas": {"type": "integer", "minimum": 1, "maximum": 10},
+    "ratio": {"type": "number", "exclusiveMaximum": 1},
+    "ports": {"type": "array", "items": {"$ref": "#/definitions/port"}, "uniqueItems": true, "maxItems": 3},
+    "labels": {"type": "object", "additionalProperties": {"type": "string"}},
+    "env": {"type": ["object", "null"], "patternProperties": {"^[A-Z_]+$": {"type": "string"}}},
+    "mode": {"oneOf": [{"const": "fast"}, {"type": "integer"}]},
+    "debug": {"anyOf": [{"type": "boolean"}, {"type": "string", "enum": ["yes", "no"]}]},
+    "legacy": {"not": {"type": "string"}}
+  }
+}`
+
+func TestValidate(t *testing.T) {
+	s, err := Parse([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		values     string
+		violations []string
+	}{
+		{"valid", "image: {repo: web, tag: v1, pullPolicy: Always}\nreplicas: 3\nratio: 0.5\nports: [80, 443]\nlabels: {team: ops}\nenv: {LOG_LEVEL: debug}\nmode: 2\ndebug: yes\n", nil},
+		{"integral float is an integer", "image: {repo: web}\nreplicas: 2.0\n", nil},
+		{"null allowed by type list", "image: {repo: web}\nenv: null\n", nil},
+		{"missing required", "replicas: 1\n", []string{"$: missing required image"}},
+		{"nested missing required", "image: {tag: v1}\n", []string{"$.image: missing required repo"}},
+		{"wrong type", "image: {repo: web}\nreplicas: three\n", []string{"$.replicas: expected integer, got string"}},
+		{"number bounds", "image: {repo: web}\nreplicas: 11\nratio: 1\n", []string{"$.ratio: must be less than 1", "$.replicas: must be at most 10"}},
+		{"string constraints", "image: {repo: '', tag: latest}\n", []string{"$.image.repo: must be at least 1 characters long", `$.image.tag: must match the pattern "^v[0-9]+"`}},
+		{"enum", "image: {repo: web, pullPolicy: Never}\n", []string{`$.image.pullPolicy: must be one of "Always", "IfNotPresent"`}},
+		{"array items through a ref", "image: {repo: web}\nports: [80, 0, 80, 70000]\n", []string{"$.ports: must have at most 3 items", "$.ports: items 0 and 2 are the same", "$.ports[1]: must be at least 1", "$.ports[3]: must be at most 65535"}},
+		{"additional properties", "image: {repo: web}\nreplica: 2\nlabels: {team: 1}\n", []string{"$.labels.team: expected string, got integer", "$.replica: isn't an allowed key, did you mean replicas?"}},
+		{"pattern properties", "image: {repo: web}\nenv: {LOG_LEVEL: 1, lower: x}\n", []string{"$.env.LOG_LEVEL: expected string, got integer"}},
+		{"odd keys are quoted", "image: {repo: web}\nlabels: {app.kubernetes.io/name: 1}\n", []string{`$.labels["app.kubernetes.io/name"]: expected string, got integer`}},
+		{"combinators", "image: {repo: web}\nmode: slow\ndebug: maybe\nlegacy: x\n", []string{"$.debug: doesn't match any of the allowed schemas", "$.legacy: matches a schema it isn't allowed to", "$.mode: must match exactly one of the allowed schemas, matches 0"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var values interface{}
+			if err := yaml.Unmarshal([]byte(test.values), &values); err != nil {
+				t.Fatal(err)
+			}
+
+			actual := []string{}
+			for _, v := range s.Validate(values) {
+				actual = append(actual, v.String())
+			}
+			if strings.Join(actual, "\n") != strings.Join(test.violations, "\n") {
+				t.Errorf("expected\n%s\ngot\n%s", strings.Join(test.violations, "\n"), strings.Join(actual, "\n"))
+			}
+		})
+	}
+}
+
+func TestValidateKeysAndUnknown(t *testing.T) {
+	s, err := Parse([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Unknown = func(v interface{}) bool { return v == "<unknown>" }
+
+	var values interface{}
+	if err := yaml.Unmarshal([]byte("image: {repo: web, tag: <unknown>}\nreplicas: <unknown>\nports: [80, 0]\n"), &values); err != nil {
+		t.Fatal(err)
+	}
+
+	violations := s.Validate(values)
+	if len(violations) != 1 {
+		t.Fatalf("expected unknown values to pass, got %v", violations)
+	}
+	if strings.Join(violations[0].Keys, " ") != "ports [1]" {
+		t.Errorf("unexpected keys %v", violations[0].Keys)
+	}
+
+	for _, bad := range []string{"[]", "{", `{"$ref": "#/definitions/nope"}`} {
+		s, err := Parse([]byte(bad))
+		if err != nil {
+			continue
+		}
+		if len(s.Validate(map[interface{}]interface{}{})) == 0 {
+			t.Errorf("expected %s to be rejected", bad)
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	s, err := Parse([]byte(`{
+  "title": "values",
+  "definitions": {"url": {"type": "string", "format": "uri"}},
+  "properties": {
+    "format": {"type": "string"},
+    "hosts": {"type": "array", "items": {"format": "hostname"}, "contains": {"const": "localhost"}},
+    "a/b": {"if": {"type": "string"}, "then": {"minLength": 1}},
+    "mode": {"anyOf": [{"type": "integer"}, {"propertyNames": {"maxLength": 3}}]}
+  }
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"#/definitions/url/format",
+		"#/properties/a~1b/if",
+		"#/properties/a~1b/then",
+		"#/properties/hosts/contains",
+		"#/properties/hosts/items/format",
+		"#/properties/mode/anyOf/1/propertyNames",
+	}
+	if strings.Join(s.Unsupported, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(s.Unsupported, "\n"))
+	}
+
+	if s, _ := Parse([]byte(testSchema)); len(s.Unsupported) != 0 {
+		t.Errorf("expected every keyword of the test schema to be supported, got %v", s.Unsupported)
+	}
+}
@@ -0,0 +1,118 @@
+package script
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/runner"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout is used for scripts that don't set their own `timeout`
+const DefaultTimeout = 5 * time.Minute
+
+// RunBootstrap runs the bootstrap scripts of an ankh file and its
+// dependencies. Each file's scripts run once, in the same order the files
+// get applied.
+func RunBootstrap(log *logrus.Logger, r runner.Runner, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig) error {
+	for _, f := range ankh.TopologicalOrder(ankhFile, ankhConfig.CurrentContext.ClusterAdmin) {
+		if err := run(log, r, "bootstrap", f.Bootstrap.Scripts, f, ankhConfig); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunPreDelete runs the teardown scripts that have to run before anything is
+// deleted, in the same order as RunTeardown
+func RunPreDelete(log *logrus.Logger, r runner.Runner, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig) error {
+	return runReversed(log, r, "pre-delete", func(f ankh.AnkhFile) []ankh.Script { return f.Teardown.PreDeleteScripts }, ankhFile, ankhConfig)
+}
+
+// RunTeardown runs the teardown scripts of an ankh file and its dependencies
+// in the opposite order of RunBootstrap
+func RunTeardown(log *logrus.Logger, r runner.Runner, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig) error {
+	return runReversed(log, r, "teardown", func(f ankh.AnkhFile) []ankh.Script { return f.Teardown.Scripts }, ankhFile, ankhConfig)
+}
+
+// runReversed runs some scripts of every file in the tree, dependents first
+func runReversed(log *logrus.Logger, r runner.Runner, stage string, scripts func(ankh.AnkhFile) []ankh.Script, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig) error {
+	ankhFiles := ankh.TopologicalOrder(ankhFile, ankhConfig.CurrentContext.ClusterAdmin)
+	for i := len(ankhFiles) - 1; i >= 0; i-- {
+		if err := run(log, r, stage, scripts(ankhFiles[i]), ankhFiles[i], ankhConfig); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func run(log *logrus.Logger, r runner.Runner, stage string, scripts []ankh.Script, ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig) error {
+	dir := filepath.Dir(ankhFile.Path)
+	env := append(os.Environ(), Env(ankhFile, ankhConfig)...)
+
+	for _, s := range scripts {
+		scriptPath := s.Path
+		if !filepath.IsAbs(scriptPath) {
+			scriptPath = filepath.Join(dir, scriptPath)
+		}
+
+		timeout := s.Timeout
+		if timeout <= 0 {
+			timeout = DefaultTimeout
+		}
+
+		log.Infof("running %s script %s", stage, scriptPath)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		var stdout, stderr bytes.Buffer
+		err := r.Run(runner.Command{
+			Args:    []string{scriptPath},
+			Dir:     dir,
+			Env:     env,
+			Stdout:  &stdout,
+			Stderr:  &stderr,
+			Context: ctx,
+		})
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		cancel()
+
+		if stdout.Len() > 0 {
+			log.Debugf("%s script %s output:\n%s", stage, scriptPath, strings.TrimRight(stdout.String(), "\n"))
+		}
+
+		if timedOut {
+			return fmt.Errorf("%s script %s timed out after %v:\n%s", stage, scriptPath, timeout, strings.TrimSpace(stderr.String()))
+		}
+		if err != nil {
+			return fmt.Errorf("%s script %s failed: %v\n%s", stage, scriptPath, err, strings.TrimSpace(stderr.String()))
+		}
+	}
+
+	return nil
+}
+
+// Env returns the environment variables, in `KEY=value` form, that describe
+// the current context to a script. The context's name is ANKH_CONTEXT_NAME
+// because ANKH_CONTEXT picks the context of ankh itself, which scripts that
+// run ankh should be able to set on their own.
+func Env(ankhFile ankh.AnkhFile, ankhConfig ankh.AnkhConfig) []string {
+	ctx := ankhConfig.CurrentContext
+	return []string{
+		"ANKH_CONTEXT_NAME=" + ankhConfig.CurrentContextName,
+		"ANKH_KUBE_CONTEXT=" + ctx.KubeContext,
+		"ANKH_NAMESPACE=" + ankhFile.Namespace,
+		"ANKH_ENVIRONMENT=" + ctx.Environment,
+		"ANKH_RESOURCE_PROFILE=" + ctx.ResourceProfile,
+		"ANKH_CLUSTER_ADMIN=" + strconv.FormatBool(ctx.ClusterAdmin),
+		"ANKH_FILE=" + ankhFile.Path,
+	}
+}
@@ -0,0 +1,198 @@
+package script
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jondlm/ankh/internal/ankh"
+	"github.com/jondlm/ankh/internal/runner"
+	"github.com/jondlm/ankh/internal/runner/runnertest"
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	return log
+}
+
+func testConfig() ankh.AnkhConfig {
+	return ankh.AnkhConfig{
+		CurrentContextName: "dev",
+		CurrentContext: ankh.Context{
+			KubeContext:     "minikube",
+			Environment:     "dev",
+			ResourceProfile: "constrained",
+			ClusterAdmin:    true,
+		},
+	}
+}
+
+// writeScript writes an executable shell script to path
+func writeScript(t *testing.T, path, body string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tree sets up a root ankh file that depends on dep, where every script
+// appends its stage and ankh file name to the file at the returned path
+func tree(t *testing.T, dir string) (ankh.AnkhFile, string) {
+	out := filepath.Join(dir, "out")
+	record := func(stage string) string {
+		return "echo \"" + stage + " $(basename $(dirname $ANKH_FILE))\" >> " + out + "\n"
+	}
+
+	files := map[string]ankh.AnkhFile{}
+	for _, name := range []string{"dep", "root"} {
+		f := ankh.AnkhFile{Path: filepath.Join(dir, name, "ankh.yaml"), Namespace: name}
+		for _, stage := range []string{"bootstrap", "pre-delete", "teardown"} {
+			writeScript(t, filepath.Join(dir, name, stage+".sh"), record(stage))
+		}
+		f.Bootstrap.Scripts = []ankh.Script{{Path: "bootstrap.sh"}}
+		f.Teardown.PreDeleteScripts = []ankh.Script{{Path: "pre-delete.sh"}}
+		f.Teardown.Scripts = []ankh.Script{{Path: filepath.Join(dir, name, "teardown.sh")}}
+		files[name] = f
+	}
+
+	root := files["root"]
+	root.DependenciesResovled = []ankh.AnkhFile{files["dep"]}
+	return root, out
+}
+
+func TestRunOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ankh-script-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root, out := tree(t, dir)
+	for _, run := range []func(*logrus.Logger, runner.Runner, ankh.AnkhFile, ankh.AnkhConfig) error{RunBootstrap, RunPreDelete, RunTeardown} {
+		if err := run(testLogger(), runner.Exec{}, root, testConfig()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "bootstrap dep\nbootstrap root\npre-delete root\npre-delete dep\nteardown root\nteardown dep\n"
+	if string(got) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestRunEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ankh-script-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	writeScript(t, filepath.Join(dir, "env.sh"), "env | grep ^ANKH_ | sort > "+out+"\npwd >> "+out+"\n")
+
+	f := ankh.AnkhFile{Path: filepath.Join(dir, "ankh.yaml"), Namespace: "web"}
+	f.Bootstrap.Scripts = []ankh.Script{{Path: "env.sh"}}
+	if err := RunBootstrap(testLogger(), runner.Exec{}, f, testConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		"ANKH_CLUSTER_ADMIN=true",
+		"ANKH_CONTEXT_NAME=dev",
+		"ANKH_ENVIRONMENT=dev",
+		"ANKH_FILE=" + f.Path,
+		"ANKH_KUBE_CONTEXT=minikube",
+		"ANKH_NAMESPACE=web",
+		"ANKH_RESOURCE_PROFILE=constrained",
+		realDir,
+	}, "\n") + "\n"
+	if string(got) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ankh-script-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	writeScript(t, filepath.Join(dir, "fail.sh"), "echo broken >&2\nexit 3\n")
+	writeScript(t, filepath.Join(dir, "slow.sh"), "echo started >&2\nsleep 30\n")
+	// the grandchild keeps stdout open long after the script itself is killed
+	writeScript(t, filepath.Join(dir, "orphan.sh"), "sleep 30 &\nsleep 30\n")
+	writeScript(t, filepath.Join(dir, "after.sh"), "touch "+out+"\n")
+
+	tests := []struct {
+		name     string
+		scripts  []ankh.Script
+		expected string
+	}{
+		{"failure", []ankh.Script{{Path: "fail.sh"}, {Path: "after.sh"}}, "bootstrap script " + filepath.Join(dir, "fail.sh") + " failed: exit status 3\nbroken"},
+		{"timeout", []ankh.Script{{Path: "slow.sh", Timeout: 100 * time.Millisecond}, {Path: "after.sh"}}, "bootstrap script " + filepath.Join(dir, "slow.sh") + " timed out after 100ms:\nstarted"},
+		{"orphaned output", []ankh.Script{{Path: "orphan.sh", Timeout: 100 * time.Millisecond}}, "bootstrap script " + filepath.Join(dir, "orphan.sh") + " timed out after 100ms:\n"},
+		{"missing", []ankh.Script{{Path: "missing.sh"}}, "bootstrap script " + filepath.Join(dir, "missing.sh") + " failed: fork/exec " + filepath.Join(dir, "missing.sh") + ": no such file or directory\n"},
+	}
+
+	for _, test := range tests {
+		f := ankh.AnkhFile{Path: filepath.Join(dir, "ankh.yaml")}
+		f.Bootstrap.Scripts = test.scripts
+
+		start := time.Now()
+		err := RunBootstrap(testLogger(), runner.Exec{}, f, testConfig())
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("%s: expected %q, got %v", test.name, test.expected, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: expected the script to be stopped, took %v", test.name, elapsed)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("%s: expected the scripts after a failure not to run", test.name)
+		}
+	}
+}
+
+func TestRunWithFake(t *testing.T) {
+	f := ankh.AnkhFile{Path: "/ankh/web/ankh.yaml", Namespace: "web"}
+	f.Bootstrap.Scripts = []ankh.Script{{Path: "first.sh"}, {Path: "/bin/second.sh"}, {Path: "third.sh"}}
+	fake := runnertest.NewFake(runnertest.Response{}, runnertest.Response{Stderr: "broken\n", Err: runner.ExitError{Code: 2}})
+
+	err := RunBootstrap(testLogger(), fake, f, testConfig())
+	if err == nil || err.Error() != "bootstrap script /bin/second.sh failed: exit status 2\nbroken" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	calls := fake.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("expected the scripts after a failure not to run, got %d calls", len(calls))
+	}
+	for i, expected := range []string{"/ankh/web/first.sh", "/bin/second.sh"} {
+		if calls[i].Args[0] != expected || calls[i].Dir != "/ankh/web" {
+			t.Errorf("expected %s to run in /ankh/web, got %v in %s", expected, calls[i].Args, calls[i].Dir)
+		}
+	}
+	if env := strings.Join(calls[0].Env, "\n"); !strings.Contains(env, "\nANKH_NAMESPACE=web\n") {
+		t.Errorf("expected the script to get ANKH_NAMESPACE, got\n%s", env)
+	}
+}
@@ -0,0 +1,95 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// Secrets files are encrypted with age (https://age-encryption.org) and
+// ASCII armored so they diff and review like any other text file. They can
+// be opened with the age CLI and the same key file as well.
+
+// binaryHeader starts an age file that isn't armored
+const binaryHeader = "age-encryption.org/v1\n"
+
+// ErrNoIdentity is returned by Decrypt when none of the identities can open
+// the file
+var ErrNoIdentity = errors.New("none of the secret keys can decrypt this file")
+
+// IsEncrypted reports whether data is an encrypted secrets file
+func IsEncrypted(data []byte) bool {
+	return isArmored(data) || bytes.HasPrefix(data, []byte(binaryHeader))
+}
+
+func isArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(armor.Header))
+}
+
+// Encrypt seals plaintext so any of the recipients can open it
+func Encrypt(plaintext []byte, recipients []Recipient) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients to encrypt to")
+	}
+
+	ageRecipients := []age.Recipient{}
+	for _, r := range recipients {
+		ageRecipients = append(ageRecipients, r.key)
+	}
+
+	var buf bytes.Buffer
+	armored := armor.NewWriter(&buf)
+	w, err := age.Encrypt(armored, ageRecipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := armored.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decrypt opens an encrypted secrets file with whichever identity it was
+// encrypted to
+func Decrypt(data []byte, identities []Identity) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return nil, fmt.Errorf("not an encrypted secrets file")
+	}
+
+	var src io.Reader = bytes.NewReader(data)
+	if isArmored(data) {
+		src = armor.NewReader(src)
+	}
+
+	ageIdentities := []age.Identity{}
+	for _, i := range identities {
+		ageIdentities = append(ageIdentities, i.key)
+	}
+
+	r, err := age.Decrypt(src, ageIdentities...)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, ErrNoIdentity
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt secrets file: %v", err)
+	}
+
+	plaintext, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt secrets file, it may have been tampered with: %v", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,164 @@
+package secrets
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// RecipientsFile lists the public keys secrets files in a directory are
+// encrypted to, one per line
+const RecipientsFile = "recipients"
+
+// Identity is an age X25519 private key that can decrypt secrets files
+type Identity struct {
+	key *age.X25519Identity
+}
+
+// Recipient is an age X25519 public key that secrets files can be encrypted
+// to
+type Recipient struct {
+	key *age.X25519Recipient
+}
+
+// GenerateIdentity makes a new random identity
+func GenerateIdentity() (Identity, error) {
+	key, err := age.GenerateX25519Identity()
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{key: key}, nil
+}
+
+// Recipient returns the public half of an identity
+func (i Identity) Recipient() Recipient {
+	return Recipient{key: i.key.Recipient()}
+}
+
+// String returns the identity as an `AGE-SECRET-KEY-1...` string
+func (i Identity) String() string {
+	return i.key.String()
+}
+
+// String returns the public key as an `age1...` string
+func (r Recipient) String() string {
+	return r.key.String()
+}
+
+// ParseIdentity reads an identity written by Identity.String or age-keygen
+func ParseIdentity(s string) (Identity, error) {
+	key, err := age.ParseX25519Identity(strings.TrimSpace(s))
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid secret key: %v", err)
+	}
+	return Identity{key: key}, nil
+}
+
+// ParseRecipient reads a public key written by Recipient.String or age-keygen
+func ParseRecipient(s string) (Recipient, error) {
+	key, err := age.ParseX25519Recipient(strings.TrimSpace(s))
+	if err != nil {
+		return Recipient{}, fmt.Errorf("invalid public key: %v", err)
+	}
+	return Recipient{key: key}, nil
+}
+
+// ReadIdentities reads every identity in a key file. Blank lines and lines
+// starting with `#` are skipped.
+func ReadIdentities(path string) ([]Identity, error) {
+	identities := []Identity{}
+	err := readKeyLines(path, func(line string) error {
+		i, err := ParseIdentity(line)
+		if err == nil {
+			identities = append(identities, i)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret keys from %s: %v", path, err)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no secret keys found in %s", path)
+	}
+	return identities, nil
+}
+
+// ReadRecipients reads every public key in a recipients file
+func ReadRecipients(path string) ([]Recipient, error) {
+	recipients := []Recipient{}
+	err := readKeyLines(path, func(line string) error {
+		r, err := ParseRecipient(line)
+		if err == nil {
+			recipients = append(recipients, r)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read public keys from %s: %v", path, err)
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no public keys found in %s", path)
+	}
+	return recipients, nil
+}
+
+func readKeyLines(path string, parse func(line string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return eachKeyLine(f, parse)
+}
+
+func eachKeyLine(r io.Reader, parse func(line string) error) error {
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := parse(line); err != nil {
+			return fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// WriteIdentity writes a new key file readable only by its owner. An
+// existing file is never overwritten.
+func WriteIdentity(path string, i Identity) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	// the same layout as age-keygen, so the file works with `age -i` too
+	_, err = fmt.Fprintf(f, "# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), i.Recipient(), i)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// FindRecipients looks for the recipients file that applies to a secrets
+// file: the one next to it, or for per environment files, the one in the
+// directory above.
+func FindRecipients(secretsPath string) ([]Recipient, error) {
+	dir := filepath.Dir(secretsPath)
+	for _, candidate := range []string{filepath.Join(dir, RecipientsFile), filepath.Join(filepath.Dir(dir), RecipientsFile)} {
+		if _, err := os.Stat(candidate); err == nil {
+			return ReadRecipients(candidate)
+		}
+	}
+	return nil, fmt.Errorf("no %s file found next to %s", RecipientsFile, secretsPath)
+}
@@ -0,0 +1,65 @@
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EnvProvider resolves `ref+env://NAME` to the value of an environment
+// variable
+type EnvProvider struct {
+	// Lookup defaults to os.LookupEnv
+	Lookup func(name string) (string, bool)
+}
+
+// Get returns the value of the environment variable named by the reference
+func (p EnvProvider) Get(ref Ref) (string, error) {
+	if ref.Key != "" {
+		return "", fmt.Errorf("environment variable references don't take a #key")
+	}
+
+	lookup := p.Lookup
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	value, ok := lookup(ref.Path)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s isn't set", ref.Path)
+	}
+	return value, nil
+}
+
+// FileProvider resolves `ref+file://path` to the contents of a file, minus a
+// trailing newline, and `ref+file://path#key` to a key in a YAML or JSON
+// file. Relative paths are relative to Dir, which is the directory of the
+// ankh file.
+type FileProvider struct {
+	Dir string
+}
+
+// Get reads the file named by the reference
+func (p FileProvider) Get(ref Ref) (string, error) {
+	path := ref.Path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(p.Dir, path)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if ref.Key == "" {
+		return strings.TrimSuffix(string(contents), "\n"), nil
+	}
+
+	var doc interface{}
+	if err := yaml.Unmarshal(contents, &doc); err != nil {
+		return "", fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+	return lookupKey(doc, ref.Key)
+}
@@ -0,0 +1,205 @@
+package secrets
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// refPrefix starts a value that's a reference to a secret rather than the
+// secret itself, like `ref+vault://secret/app#password`
+const refPrefix = "ref+"
+
+// Ref is a parsed secret reference of the form
+// `ref+<provider>://<path>[?<query>][#<key>]`
+type Ref struct {
+	Provider string
+	Path     string
+	Query    url.Values
+	Key      string
+}
+
+func (r Ref) String() string {
+	s := refPrefix + r.Provider + "://" + r.Path
+	if len(r.Query) > 0 {
+		s += "?" + r.Query.Encode()
+	}
+	if r.Key != "" {
+		s += "#" + r.Key
+	}
+	return s
+}
+
+// IsRef reports whether a value is a secret reference
+func IsRef(s string) bool {
+	return strings.HasPrefix(s, refPrefix)
+}
+
+// ParseRef parses a secret reference
+func ParseRef(s string) (Ref, error) {
+	if !IsRef(s) {
+		return Ref{}, fmt.Errorf("secret references start with %s", refPrefix)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(s, refPrefix), "://", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return Ref{}, fmt.Errorf("invalid secret reference '%s', expected %s<provider>://<path>#<key>", s, refPrefix)
+	}
+
+	r := Ref{Provider: parts[0], Query: url.Values{}}
+	rest := parts[1]
+	if i := strings.LastIndex(rest, "#"); i >= 0 {
+		r.Key, rest = rest[i+1:], rest[:i]
+	}
+	if i := strings.Index(rest, "?"); i >= 0 {
+		query, err := url.ParseQuery(rest[i+1:])
+		if err != nil {
+			return Ref{}, fmt.Errorf("invalid query in secret reference '%s': %v", s, err)
+		}
+		r.Query, rest = query, rest[:i]
+	}
+	r.Path = rest
+
+	if r.Path == "" {
+		return Ref{}, fmt.Errorf("secret reference '%s' has no path", s)
+	}
+	return r, nil
+}
+
+// Provider looks up the secret a reference points to
+type Provider interface {
+	Get(ref Ref) (string, error)
+}
+
+// Resolver replaces secret references in chart values with the secrets they
+// point to, using the provider named by each reference
+type Resolver struct {
+	Providers map[string]Provider
+}
+
+// NewResolver returns a Resolver that uses the given providers
+func NewResolver(providers map[string]Provider) *Resolver {
+	return &Resolver{Providers: providers}
+}
+
+// Resolve returns a copy of values with every string that's entirely a
+// secret reference replaced by its secret, along with the secrets it
+// resolved so they can be redacted. values itself isn't changed.
+func (r *Resolver) Resolve(values interface{}) (interface{}, []string, error) {
+	found := []string{}
+	resolved, err := r.resolve(values, "", &found)
+	return resolved, found, err
+}
+
+func (r *Resolver) resolve(x interface{}, path string, found *[]string) (interface{}, error) {
+	switch x := x.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(x))
+		for k, v := range x {
+			resolved, err := r.resolve(v, joinPath(path, fmt.Sprint(k)), found)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = resolved
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(x))
+		for k, v := range x {
+			resolved, err := r.resolve(v, joinPath(path, k), found)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = resolved
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, v := range x {
+			resolved, err := r.resolve(v, fmt.Sprintf("%s[%d]", path, i), found)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = resolved
+		}
+		return out, nil
+	case string:
+		if !IsRef(x) {
+			return x, nil
+		}
+		secret, err := r.Get(x)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve `%s`: %v", path, err)
+		}
+		*found = append(*found, secret)
+		return secret, nil
+	}
+	return x, nil
+}
+
+// Get looks up a single secret reference
+func (r *Resolver) Get(s string) (string, error) {
+	ref, err := ParseRef(s)
+	if err != nil {
+		return "", err
+	}
+	provider, ok := r.Providers[ref.Provider]
+	if !ok {
+		return "", fmt.Errorf("unknown secret provider '%s' in '%s'", ref.Provider, s)
+	}
+
+	secret, err := provider.Get(ref)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", ref, err)
+	}
+	return secret, nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// lookupKey finds key in a decoded document. A key that isn't there as is is
+// tried as a dotted path into nested maps.
+func lookupKey(doc interface{}, key string) (string, error) {
+	if v, ok := index(doc, key); ok {
+		return scalar(v, key)
+	}
+
+	current := doc
+	for _, part := range strings.Split(key, ".") {
+		v, ok := index(current, part)
+		if !ok {
+			return "", fmt.Errorf("no key '%s'", key)
+		}
+		current = v
+	}
+	return scalar(current, key)
+}
+
+func index(doc interface{}, key string) (interface{}, bool) {
+	switch doc := doc.(type) {
+	case map[interface{}]interface{}:
+		v, ok := doc[key]
+		return v, ok
+	case map[string]interface{}:
+		v, ok := doc[key]
+		return v, ok
+	}
+	return nil, false
+}
+
+func scalar(v interface{}, key string) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", fmt.Errorf("key '%s' is empty", key)
+	case map[interface{}]interface{}, map[string]interface{}, []interface{}:
+		return "", fmt.Errorf("key '%s' isn't a single value", key)
+	case string:
+		return v, nil
+	}
+	return fmt.Sprint(v), nil
+}
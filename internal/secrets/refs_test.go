@@ -0,0 +1,94 @@
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRef(t *testing.T) {
+	ref, err := ParseRef("ref+vault://secret/team/app?version=2#db.password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Provider != "vault" || ref.Path != "secret/team/app" || ref.Query.Get("version") != "2" || ref.Key != "db.password" {
+		t.Errorf("unexpected ref %#v", ref)
+	}
+	if ref.String() != "ref+vault://secret/team/app?version=2#db.password" {
+		t.Errorf("expected the ref to round trip, got %s", ref)
+	}
+
+	ref, err = ParseRef("ref+file:///etc/app/token")
+	if err != nil || ref.Path != "/etc/app/token" || ref.Key != "" {
+		t.Errorf("unexpected ref %#v, %v", ref, err)
+	}
+
+	for _, bad := range []string{"vault://secret/app", "ref+vault:secret", "ref+://x", "ref+env://", "ref+env://#key"} {
+		if _, err := ParseRef(bad); err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ankh-refs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "creds.yaml"), []byte("db:\n  password: yaml-password\n  port: 5432\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := NewResolver(map[string]Provider{
+		"env": EnvProvider{Lookup: func(name string) (string, bool) {
+			return map[string]string{"API_KEY": "env-api-key"}[name], name == "API_KEY"
+		}},
+		"file": FileProvider{Dir: dir},
+	})
+
+	values := map[interface{}]interface{}{
+		"api":      map[interface{}]interface{}{"key": "ref+env://API_KEY"},
+		"token":    "ref+file://token",
+		"db":       []interface{}{"ref+file://creds.yaml#db.password", "ref+file://creds.yaml#db.port"},
+		"replicas": 3,
+		"note":     "not a ref+env://API_KEY",
+	}
+
+	resolved, found, err := resolver.Resolve(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "map[api:map[key:env-api-key] db:[yaml-password 5432] note:not a ref+env://API_KEY replicas:3 token:file-token]"
+	if fmt.Sprint(resolved) != expected {
+		t.Errorf("expected %s, got %v", expected, resolved)
+	}
+	if len(found) != 4 {
+		t.Errorf("expected every resolved secret, got %v", found)
+	}
+	if values["token"] != "ref+file://token" {
+		t.Error("expected the values not to be changed")
+	}
+
+	errors := map[string]string{
+		"ref+env://MISSING":          "`value`: ref+env://MISSING: environment variable MISSING isn't set",
+		"ref+file://nope":            "`value`: ref+file://nope: open",
+		"ref+file://creds.yaml#db.x": "no key 'db.x'",
+		"ref+file://creds.yaml#db":   "isn't a single value",
+		"ref+s3://bucket/key":        "unknown secret provider 's3'",
+	}
+	for ref, message := range errors {
+		_, _, err := resolver.Resolve(map[string]interface{}{"value": ref})
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("expected an error containing %q for %s, got %v", message, ref, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Dir is the directory next to an ankh file that holds its secrets files
+const Dir = "secrets"
+
+// Files returns the secrets files that exist for a chart, least specific
+// first: `secrets/<chart>.yaml` applies to every environment and
+// `secrets/<environment>/<chart>.yaml` to just one.
+func Files(ankhFilePath, chart, environment string) []string {
+	dir := filepath.Join(filepath.Dir(ankhFilePath), Dir)
+
+	files := []string{}
+	for _, path := range []string{filepath.Join(dir, chart+".yaml"), filepath.Join(dir, environment, chart+".yaml")} {
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// Values returns every scalar value in a decrypted secrets file so they can
+// be redacted
+func Values(plaintext []byte) ([]string, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(plaintext, &doc); err != nil {
+		return nil, fmt.Errorf("unable to parse secrets: %v", err)
+	}
+	return leaves(doc, []string{}), nil
+}
+
+func leaves(x interface{}, acc []string) []string {
+	switch x := x.(type) {
+	case map[interface{}]interface{}:
+		for _, v := range x {
+			acc = leaves(v, acc)
+		}
+	case []interface{}:
+		for _, v := range x {
+			acc = leaves(v, acc)
+		}
+	case nil:
+	default:
+		acc = append(acc, fmt.Sprint(x))
+	}
+	return acc
+}
+
+// MinSubstringLength is the shortest secret value a Redactor hides wherever
+// it appears. Shorter ones, like a PIN or `true`, are only hidden as whole
+// words, so a secret `1234` doesn't mangle `12345` or `port: 81234`.
+const MinSubstringLength = 6
+
+// Redacted replaces secret values
+const Redacted = "<redacted>"
+
+// Redactor hides secret values, and their base64 encodings as they appear in
+// the `data` of a kubernetes Secret, in text that's about to be logged or
+// stored. Every non-empty value is hidden.
+type Redactor struct {
+	replacer *strings.Replacer
+	// words are the values shorter than MinSubstringLength, longest first
+	words []string
+}
+
+// NewRedactor returns a Redactor for the given secret values
+func NewRedactor(values []string) *Redactor {
+	seen := map[string]bool{}
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		seen[v] = true
+		seen[base64.StdEncoding.EncodeToString([]byte(v))] = true
+	}
+
+	// longer values go first so a secret that contains another one is hidden
+	// as a whole
+	sorted := make([]string, 0, len(seen))
+	for v := range seen {
+		sorted = append(sorted, v)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	r := &Redactor{}
+	pairs := []string{}
+	for _, v := range sorted {
+		if len(v) < MinSubstringLength {
+			r.words = append(r.words, v)
+			continue
+		}
+		pairs = append(pairs, v, Redacted)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+	return r
+}
+
+// Redact hides every secret value in s
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	s = r.replacer.Replace(s)
+	for _, w := range r.words {
+		s = replaceWord(s, w)
+	}
+	return s
+}
+
+// replaceWord replaces word in s with Redacted wherever it isn't part of a
+// longer word
+func replaceWord(s, word string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, word)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+
+		end := i + len(word)
+		startsWord := i == 0 || !isWordByte(s[i-1]) || !isWordByte(word[0])
+		endsWord := end == len(s) || !isWordByte(s[end]) || !isWordByte(word[len(word)-1])
+		if !startsWord || !endsWord {
+			b.WriteString(s[:i+1])
+			s = s[i+1:]
+			continue
+		}
+
+		b.WriteString(s[:i])
+		b.WriteString(Redacted)
+		s = s[end:]
+	}
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
@@ -0,0 +1,191 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testIdentity(t *testing.T) Identity {
+	i, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func TestKeys(t *testing.T) {
+	i := testIdentity(t)
+
+	parsed, err := ParseIdentity(i.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Recipient().String() != i.Recipient().String() {
+		t.Error("expected a parsed identity to have the same public key")
+	}
+
+	r, err := ParseRecipient(i.Recipient().String())
+	if err != nil || r.String() != i.Recipient().String() {
+		t.Errorf("expected the public key to round trip, got %v, %v", r, err)
+	}
+
+	for _, bad := range []string{"", "nope", "age1!!!", "age1qqqq"} {
+		if _, err := ParseRecipient(bad); err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+	if _, err := ParseIdentity(i.Recipient().String()); err == nil {
+		t.Error("expected a public key not to parse as a secret key")
+	}
+
+	dir, err := ioutil.TempDir("", "ankh-secrets-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "keys", "secrets.key")
+	if err := WriteIdentity(keyPath, i); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteIdentity(keyPath, testIdentity(t)); err == nil {
+		t.Error("expected an existing key file not to be overwritten")
+	}
+	if info, _ := os.Stat(keyPath); info.Mode().Perm() != 0600 {
+		t.Errorf("expected the key file to be private, got %v", info.Mode())
+	}
+
+	identities, err := ReadIdentities(keyPath)
+	if err != nil || len(identities) != 1 || identities[0].String() != i.String() {
+		t.Errorf("expected to read the key back, got %v, %v", identities, err)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	alice, bob, eve := testIdentity(t), testIdentity(t), testIdentity(t)
+	plaintext := []byte("db:\n  password: hunter2\n")
+
+	encrypted, err := Encrypt(plaintext, []Recipient{alice.Recipient(), bob.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(encrypted) || IsEncrypted(plaintext) {
+		t.Error("expected only the encrypted file to be recognized as encrypted")
+	}
+	if strings.Contains(string(encrypted), "hunter2") {
+		t.Error("expected the plain text not to be in the encrypted file")
+	}
+
+	for _, i := range []Identity{alice, bob} {
+		decrypted, err := Decrypt(encrypted, []Identity{eve, i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decrypted) != string(plaintext) {
+			t.Errorf("expected %q, got %q", plaintext, decrypted)
+		}
+	}
+
+	if _, err := Decrypt(encrypted, []Identity{eve}); err != ErrNoIdentity {
+		t.Errorf("expected ErrNoIdentity, got %v", err)
+	}
+
+	if !strings.HasPrefix(string(encrypted), "-----BEGIN AGE ENCRYPTED FILE-----\n") {
+		t.Errorf("expected an armored age file, got:\n%s", encrypted)
+	}
+
+	// flip a character of the payload, past the header
+	lines := strings.Split(string(encrypted), "\n")
+	last := lines[len(lines)-3]
+	if last[0] == 'A' {
+		lines[len(lines)-3] = "B" + last[1:]
+	} else {
+		lines[len(lines)-3] = "A" + last[1:]
+	}
+	if _, err := Decrypt([]byte(strings.Join(lines, "\n")), []Identity{alice}); err == nil {
+		t.Error("expected tampering to be detected")
+	}
+
+	if _, err := Encrypt(plaintext, nil); err == nil {
+		t.Error("expected an error without recipients")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ankh-secrets-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ankhFile := filepath.Join(dir, "ankh.yaml")
+	if len(Files(ankhFile, "web", "dev")) != 0 {
+		t.Error("expected no secrets files")
+	}
+
+	recipient := testIdentity(t).Recipient()
+	for _, path := range []string{"secrets/web.yaml", "secrets/dev/web.yaml", "secrets/production/web.yaml"} {
+		full := filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(full), 0755)
+		if err := ioutil.WriteFile(full, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secrets", RecipientsFile), []byte("# ops\n"+recipient.String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := Files(ankhFile, "web", "dev")
+	expected := []string{filepath.Join(dir, "secrets/web.yaml"), filepath.Join(dir, "secrets/dev/web.yaml")}
+	if strings.Join(files, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected %v, got %v", expected, files)
+	}
+
+	// per environment files use the recipients file a level up
+	recipients, err := FindRecipients(filepath.Join(dir, "secrets/dev/web.yaml"))
+	if err != nil || len(recipients) != 1 || recipients[0].String() != recipient.String() {
+		t.Errorf("unexpected recipients %v, %v", recipients, err)
+	}
+	if _, err := FindRecipients(filepath.Join(dir, "elsewhere", "deep", "web.yaml")); err == nil {
+		t.Error("expected an error without a recipients file")
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	values, err := Values([]byte("db:\n  password: hunter2-secret\n  port: 5432\n  enabled: true\n  pin: \"7291\"\nkeys:\n- abcdefgh\n- abcdefgh-longer\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 6 {
+		t.Errorf("expected every leaf value, got %v", values)
+	}
+
+	r := NewRedactor(values)
+	encoded := base64.StdEncoding.EncodeToString([]byte("hunter2-secret"))
+
+	tests := map[string]string{
+		"password: hunter2-secret":  "password: " + Redacted,
+		"password: " + encoded:      "password: " + Redacted,
+		"port: 5432, enabled: true": "port: " + Redacted + ", enabled: " + Redacted,
+		"pin=7291;":                 "pin=" + Redacted + ";",
+		"ids 17291 72910 a7291":     "ids 17291 72910 a7291",
+		"pin: " + base64.StdEncoding.EncodeToString([]byte("7291")): "pin: " + Redacted,
+		"truest":               "truest",
+		"key: abcdefgh-longer": "key: " + Redacted,
+		"nothing to see":       "nothing to see",
+	}
+	for input, expected := range tests {
+		if actual := r.Redact(input); actual != expected {
+			t.Errorf("expected %q, got %q", expected, actual)
+		}
+	}
+
+	var none *Redactor
+	if none.Redact("as is") != "as is" {
+		t.Error("expected a nil Redactor to leave text alone")
+	}
+}
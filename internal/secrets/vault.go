@@ -0,0 +1,202 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultTimeout bounds a single request to Vault
+const VaultTimeout = 30 * time.Second
+
+// VaultProvider resolves `ref+vault://<mount>/<path>#<key>` against a Vault
+// KV version 2 secrets engine, so `ref+vault://secret/app#password` reads
+// the `password` key of the latest version of `secret/data/app`. A
+// `?version=N` query reads an older version. Mounts can be more than one
+// segment deep, like `team/kv`: Vault is asked which mount a path is under,
+// the way the vault CLI does it, and when it won't say the first segment is
+// the mount. Every secret is only fetched once per provider.
+type VaultProvider struct {
+	Address   string
+	Token     string
+	Namespace string
+	Client    *http.Client
+
+	mu     sync.Mutex
+	cache  map[string]map[string]interface{}
+	mounts []string
+}
+
+// NewVaultProvider returns a provider for the Vault server at address
+func NewVaultProvider(address, token, namespace string) *VaultProvider {
+	return &VaultProvider{
+		Address:   strings.TrimSuffix(address, "/"),
+		Token:     token,
+		Namespace: namespace,
+		Client:    &http.Client{Timeout: VaultTimeout},
+	}
+}
+
+// VaultToken returns the token the vault CLI would use: $VAULT_TOKEN, or
+// the one `vault login` saved in ~/.vault-token
+func VaultToken() string {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token
+	}
+	token, err := ioutil.ReadFile(filepath.Join(os.Getenv("HOME"), ".vault-token"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(token))
+}
+
+// Get returns a key of the secret named by the reference
+func (p *VaultProvider) Get(ref Ref) (string, error) {
+	if ref.Key == "" {
+		return "", fmt.Errorf("vault references need a #key")
+	}
+
+	data, err := p.read(ref.Path, ref.Query.Get("version"))
+	if err != nil {
+		return "", err
+	}
+	return lookupKey(data, ref.Key)
+}
+
+func (p *VaultProvider) read(path, version string) (map[string]interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cacheKey := path + "?" + version
+	if data, ok := p.cache[cacheKey]; ok {
+		return data, nil
+	}
+
+	if p.Address == "" {
+		return nil, fmt.Errorf("no vault address, set `vault_address` in the context or $VAULT_ADDR")
+	}
+	if p.Token == "" {
+		return nil, fmt.Errorf("no vault token, set $VAULT_TOKEN or run `vault login`")
+	}
+
+	path = strings.Trim(path, "/")
+	mount, err := p.mount(path)
+	if err != nil {
+		return nil, err
+	}
+	secretPath := strings.TrimPrefix(path+"/", mount)
+	if !strings.HasPrefix(path+"/", mount) || secretPath == "" {
+		return nil, fmt.Errorf("expected a vault path like <mount>/<path>, got '%s'", path)
+	}
+
+	u := p.Address + "/v1/" + mount + "data/" + strings.TrimSuffix(secretPath, "/")
+	if version != "" {
+		u += "?" + url.Values{"version": {version}}.Encode()
+	}
+
+	resp, err := p.get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body := struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+		Errors []string `json:"errors"`
+	}{}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	decodeErr := decoder.Decode(&body)
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("no vault secret at '%s'", path)
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized:
+		return nil, fmt.Errorf("vault denied access to '%s' (%s), check your token", path, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		if len(body.Errors) > 0 {
+			return nil, fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(body.Errors, ", "))
+		}
+		return nil, fmt.Errorf("vault returned %s", resp.Status)
+	case decodeErr != nil:
+		return nil, fmt.Errorf("unable to parse the vault response: %v", decodeErr)
+	case body.Data.Data == nil:
+		// KV v2 returns null data for deleted versions
+		return nil, fmt.Errorf("vault secret '%s' has no data, it may have been deleted", path)
+	}
+
+	if p.cache == nil {
+		p.cache = map[string]map[string]interface{}{}
+	}
+	p.cache[cacheKey] = body.Data.Data
+	return body.Data.Data, nil
+}
+
+// mount returns the KV mount a secret path is under, with a trailing slash.
+// Mounts that were already found are reused.
+func (p *VaultProvider) mount(path string) (string, error) {
+	for _, m := range p.mounts {
+		if strings.HasPrefix(path+"/", m) {
+			return m, nil
+		}
+	}
+
+	resp, err := p.get(p.Address + "/v1/sys/internal/ui/mounts/" + path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body := struct {
+		Data struct {
+			Path    string            `json:"path"`
+			Type    string            `json:"type"`
+			Options map[string]string `json:"options"`
+		} `json:"data"`
+	}{}
+
+	var mount string
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&body) != nil || body.Data.Path == "" {
+		// older Vaults, and tokens without access to the endpoint, don't
+		// say, which leaves the first segment
+		mount = strings.SplitN(path, "/", 2)[0] + "/"
+	} else {
+		mount = strings.TrimSuffix(body.Data.Path, "/") + "/"
+		if body.Data.Type != "kv" || body.Data.Options["version"] != "2" {
+			return "", fmt.Errorf("vault mount '%s' isn't a KV version 2 secrets engine", mount)
+		}
+	}
+	p.mounts = append(p.mounts, mount)
+	return mount, nil
+}
+
+// get makes an authenticated request to Vault
+func (p *VaultProvider) get(u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", p.Token)
+	if p.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.Namespace)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: VaultTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach vault: %v", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,120 @@
+package secrets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// vaultStub serves a KV v2 secrets engine mounted at `secret` with a single
+// secret at `app` that has two versions, another one mounted at `team/kv`
+// and a KV v1 one at `legacy`. It doesn't say where `other` is mounted.
+func vaultStub(t *testing.T, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		if r.Header.Get("X-Vault-Namespace") != "team" {
+			t.Errorf("expected the namespace header, got %q", r.Header.Get("X-Vault-Namespace"))
+		}
+
+		mounts := map[string]string{
+			"secret/":  `{"data":{"path":"secret/","type":"kv","options":{"version":"2"}}}`,
+			"team/kv/": `{"data":{"path":"team/kv/","type":"kv","options":{"version":"2"}}}`,
+			"legacy/":  `{"data":{"path":"legacy/","type":"kv","options":null}}`,
+		}
+		if strings.HasPrefix(r.URL.Path, "/v1/sys/internal/ui/mounts/") {
+			for mount, body := range mounts {
+				if strings.HasPrefix(strings.TrimPrefix(r.URL.Path, "/v1/sys/internal/ui/mounts/")+"/", mount) {
+					w.Write([]byte(body))
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch r.URL.Path + "?" + r.URL.RawQuery {
+		case "/v1/secret/data/app?", "/v1/secret/data/app?version=2":
+			w.Write([]byte(`{"data":{"data":{"password":"second-password","port":5432},"metadata":{"version":2}}}`))
+		case "/v1/secret/data/app?version=1":
+			w.Write([]byte(`{"data":{"data":{"password":"first-password"},"metadata":{"version":1}}}`))
+		case "/v1/team/kv/data/web/app?":
+			w.Write([]byte(`{"data":{"data":{"password":"team-password"},"metadata":{"version":1}}}`))
+		case "/v1/other/data/app?":
+			w.Write([]byte(`{"data":{"data":{"password":"other-password"},"metadata":{"version":1}}}`))
+		case "/v1/secret/data/deleted?":
+			w.Write([]byte(`{"data":{"data":null,"metadata":{"version":3}}}`))
+		case "/v1/secret/data/broken?":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"errors":["storage is sealed"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+}
+
+func TestVaultProvider(t *testing.T) {
+	var requests int32
+	server := vaultStub(t, &requests)
+	defer server.Close()
+
+	p := NewVaultProvider(server.URL+"/", "s.token", "team")
+	resolver := NewResolver(map[string]Provider{"vault": p})
+
+	tests := map[string]string{
+		"ref+vault://secret/app#password":           "second-password",
+		"ref+vault://secret/app#port":               "5432",
+		"ref+vault://secret/app?version=1#password": "first-password",
+		"ref+vault://team/kv/web/app#password":      "team-password",
+		"ref+vault://other/app#password":            "other-password",
+	}
+	for ref, expected := range tests {
+		actual, err := resolver.Get(ref)
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", ref, err)
+		}
+		if actual != expected {
+			t.Errorf("expected %s to be %q, got %q", ref, expected, actual)
+		}
+	}
+	// one lookup for each of the three mounts and one read for each of the
+	// four secrets
+	if requests != 7 {
+		t.Errorf("expected each mount to be looked up and each version of a secret to be fetched once, got %d requests", requests)
+	}
+
+	errors := map[string]string{
+		"ref+vault://secret/app":         "need a #key",
+		"ref+vault://secret/app#missing": "no key 'missing'",
+		"ref+vault://secret/nope#key":    "no vault secret at 'secret/nope'",
+		"ref+vault://secret/deleted#key": "may have been deleted",
+		"ref+vault://secret/broken#key":  "storage is sealed",
+		"ref+vault://secret#key":         "expected a vault path like <mount>/<path>",
+		"ref+vault://team/kv#key":        "expected a vault path like <mount>/<path>",
+		"ref+vault://legacy/app#key":     "vault mount 'legacy/' isn't a KV version 2 secrets engine",
+	}
+	for ref, message := range errors {
+		_, err := resolver.Get(ref)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("expected an error containing %q for %s, got %v", message, ref, err)
+		}
+	}
+
+	denied := NewResolver(map[string]Provider{"vault": NewVaultProvider(server.URL, "s.wrong", "team")})
+	if _, err := denied.Get("ref+vault://secret/app#password"); err == nil || !strings.Contains(err.Error(), "check your token") {
+		t.Errorf("expected a permission error, got %v", err)
+	}
+
+	unconfigured := NewResolver(map[string]Provider{"vault": NewVaultProvider("", "s.token", "")})
+	if _, err := unconfigured.Get("ref+vault://secret/app#password"); err == nil || !strings.Contains(err.Error(), "no vault address") {
+		t.Errorf("expected a missing address error, got %v", err)
+	}
+}
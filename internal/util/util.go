@@ -8,118 +8,266 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	//"github.com/davecgh/go-spew/spew"
 )
 
-// Collapse recursively traverses a map and tries to collapse it to a flat
-// slice of `key.key.key=value` pairs
-func Collapse(x interface{}, path []string, acc []string) []string {
-	if path == nil {
-		path = []string{}
-	}
-	if acc == nil {
-		acc = []string{}
-	}
-
-	switch x := x.(type) {
-	case map[string]interface{}:
-		var arr []string
-		for key, value := range x {
-			newPath := append(path, key)
-			arr = append(arr, Collapse(value, newPath, acc)...)
-		}
-		return arr
-	case bool:
-		return append(acc, strings.Join(path, ".")+"="+strconv.FormatBool(x))
-	case float64:
-		return append(acc, strings.Join(path, ".")+"="+strconv.FormatFloat(x, 'f', -1, 64))
-	case string:
-		return append(acc, strings.Join(path, ".")+"="+string(x))
-	case int:
-		return append(acc, strings.Join(path, ".")+"="+string(x))
-	default:
-		// Just exclude datatypes we don't know about. It's possible this isn't
-		// handling all the cases that yaml parsing can provide
-		return acc
-	}
-}
-
-// Untar takes a destination path and a reader; a tar reader loops over the tarfile
-// creating the file structure at 'dst' along the way, and writing any files
+// UntarMaxFileSize and UntarMaxSize limit how much data Untar writes for a
+// single file and for the whole archive, so a small compressed chart can't
+// fill up the disk
+var UntarMaxFileSize int64 = 64 << 20
+var UntarMaxSize int64 = 256 << 20
+
+// Untar extracts the gzipped tarball in r into dst. Entries that would land
+// outside of dst, either directly or by way of a symlink, are rejected.
+// Symlinks must point somewhere inside dst and hard links are extracted as
+// copies of the file they link to. Other entry types like devices are
+// skipped.
 func Untar(dst string, r io.Reader) error {
-
 	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
 	defer gzr.Close()
+
+	dst, err = filepath.Abs(dst)
 	if err != nil {
 		return err
 	}
 
 	tr := tar.NewReader(gzr)
+	var total int64
+	symlinks := []string{}
 
 	for {
 		header, err := tr.Next()
-
-		switch {
-
-		// if no more files are found return
-		case err == io.EOF:
+		if err == io.EOF {
+			// a symlink can go through others that were extracted after it,
+			// so they're only checked once they're all there
+			for _, link := range symlinks {
+				if !resolvesInside(dst, link) {
+					return fmt.Errorf("symlink %s points outside of the destination through another symlink", link)
+				}
+			}
 			return nil
-
-		// return any other error
-		case err != nil:
+		}
+		if err != nil {
 			return err
+		}
 
-		// if the header is nil, just skip it (not sure how this happens)
-		case header == nil:
+		target, err := untarPath(dst, header.Name)
+		if err != nil {
+			return err
+		}
+		if target == dst {
 			continue
 		}
 
-		// the target location where the dir/file should be created
-		target := filepath.Join(dst, header.Name)
+		// helm tarballs don't always have separate entries for directories, so
+		// parents get created as needed
+		if err := mkdirInside(dst, filepath.Dir(target)); err != nil {
+			return err
+		}
+		if err := checkNotSymlink(target); err != nil {
+			return err
+		}
 
-		// the following switch could also be done using fi.Mode(), not sure if there
-		// a benefit of using one vs. the other.
-		// fi := header.FileInfo()
+		mode := os.FileMode(header.Mode).Perm()
 
-		// check the file type
 		switch header.Typeflag {
-
-		// TODO: find out why header.Typeflag is a uint8 and tar.TypeDir is an
-		// int32? For some reason the tarballs coming out of helm don't have
-		// directories as separate entries, so all the directories get created by
-		// the `case 0` code
 		case tar.TypeDir:
-			if _, err := os.Stat(target); err != nil {
-				if err := os.MkdirAll(target, 0755); err != nil {
-					return err
-				}
+			if err := mkdirInside(dst, target); err != nil {
+				return err
 			}
 
-		// if it's a file create it
-		// TODO: why doesn't this line up with tar.TypeReg?
-		case 0:
-			dir := filepath.Dir(target)
-			// sometimes we have to mkdir -p the directories to contain the files we extract
-			if _, err := os.Stat(dir); err != nil {
-				if err := os.MkdirAll(dir, 0755); err != nil {
-					return err
-				}
+		// older tarballs use 0 rather than tar.TypeReg for regular files
+		case 0, tar.TypeReg:
+			if header.Size > UntarMaxFileSize {
+				return fmt.Errorf("%s is %d bytes, more than the %d byte limit", header.Name, header.Size, UntarMaxFileSize)
+			}
+			n, err := writeUntarFile(target, tr, mode, UntarMaxSize-total)
+			total += n
+			if err != nil {
+				return fmt.Errorf("unable to extract %s: %v", header.Name, err)
 			}
 
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+		case tar.TypeSymlink:
+			if filepath.IsAbs(header.Linkname) {
+				return fmt.Errorf("symlink %s points to an absolute path", header.Name)
+			}
+			if !inside(dst, filepath.Join(filepath.Dir(target), header.Linkname)) {
+				return fmt.Errorf("symlink %s points outside of the destination", header.Name)
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+			if !resolvesInside(dst, target) {
+				return fmt.Errorf("symlink %s points outside of the destination through another symlink", header.Name)
+			}
+			symlinks = append(symlinks, target)
+
+		case tar.TypeLink:
+			source, err := untarPath(dst, header.Linkname)
 			if err != nil {
 				return err
 			}
-			defer f.Close()
+			if err := checkNoSymlinks(dst, source); err != nil {
+				return err
+			}
+			info, err := os.Lstat(source)
+			if err != nil {
+				return fmt.Errorf("hard link %s points to %s which hasn't been extracted: %v", header.Name, header.Linkname, err)
+			}
+			if !info.Mode().IsRegular() {
+				return fmt.Errorf("hard link %s doesn't point to a regular file", header.Name)
+			}
 
-			// copy over contents
-			if _, err := io.Copy(f, tr); err != nil {
+			in, err := os.Open(source)
+			if err != nil {
 				return err
 			}
+			n, err := writeUntarFile(target, in, info.Mode().Perm(), UntarMaxSize-total)
+			in.Close()
+			total += n
+			if err != nil {
+				return fmt.Errorf("unable to extract %s: %v", header.Name, err)
+			}
+		}
+	}
+}
+
+// untarPath returns where an archive entry goes under dst, or an error if
+// that's outside of it
+func untarPath(dst, name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("archive entry %s has an absolute path", name)
+	}
+
+	target := filepath.Join(dst, name)
+	if !inside(dst, target) {
+		return "", fmt.Errorf("archive entry %s points outside of the destination", name)
+	}
+
+	return target, nil
+}
+
+// inside reports whether path is dst or somewhere under it
+func inside(dst, path string) bool {
+	rel, err := filepath.Rel(dst, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolvesInside follows path, and every symlink on the way, the way the
+// kernel would and reports whether it stays inside dst. Parts that don't
+// exist yet are taken as plain directories.
+func resolvesInside(dst, path string) bool {
+	rel, err := filepath.Rel(dst, path)
+	if err != nil {
+		return false
+	}
+
+	current := dst
+	pending := strings.Split(rel, string(filepath.Separator))
+	for hops := 0; len(pending) > 0; {
+		part := pending[0]
+		pending = pending[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			// current never has symlinks in it, so its parent is the real one
+			current = filepath.Dir(current)
+			if !inside(dst, current) {
+				return false
+			}
+			continue
+		}
+
+		next := filepath.Join(current, part)
+		info, err := os.Lstat(next)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		hops++
+		if hops > 255 {
+			return false
+		}
+		link, err := os.Readlink(next)
+		if err != nil || filepath.IsAbs(link) {
+			return false
+		}
+		pending = append(strings.Split(link, string(filepath.Separator)), pending...)
+	}
+
+	return true
+}
+
+// mkdirInside creates dir and its parents under dst, making sure none of the
+// existing ones are symlinks that could lead somewhere else
+func mkdirInside(dst, dir string) error {
+	if err := checkNoSymlinks(dst, dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// checkNoSymlinks makes sure none of the existing path elements between dst
+// and path are symlinks
+func checkNoSymlinks(dst, path string) error {
+	rel, err := filepath.Rel(dst, path)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+
+	current := dst
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		if err := checkNotSymlink(current); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+func checkNotSymlink(path string) error {
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("refusing to extract through the symlink %s", path)
+	}
+	return nil
+}
+
+// writeUntarFile writes r to a new file at path. It returns how many bytes
+// were written and fails once that passes remaining or UntarMaxFileSize.
+func writeUntarFile(path string, r io.Reader, mode os.FileMode, remaining int64) (int64, error) {
+	limit := UntarMaxFileSize
+	if remaining < limit {
+		limit = remaining
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode|0600)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(f, io.LimitReader(r, limit+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+	if n > limit {
+		return n, fmt.Errorf("more than %d bytes once decompressed", limit)
+	}
+
+	return n, nil
 }
 
 /* MIT License
@@ -0,0 +1,216 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// entry is a single crafted tarball entry
+type entry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+	size     int64
+}
+
+func tarball(t *testing.T, entries ...entry) *bytes.Buffer {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	for _, e := range entries {
+		size := e.size
+		if size == 0 {
+			size = int64(len(e.body))
+		}
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: size}
+		if e.typeflag != tar.TypeReg {
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestUntar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ankh-untar-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "dst")
+	err = Untar(dst, tarball(t,
+		entry{name: "app/Chart.yaml", typeflag: tar.TypeReg, body: "name: app\n"},
+		entry{name: "app/templates/", typeflag: tar.TypeDir},
+		entry{name: "app/templates/deployment.yaml", typeflag: tar.TypeReg, body: "kind: Deployment\n"},
+		entry{name: "app/values.yaml", typeflag: tar.TypeSymlink, linkname: "Chart.yaml"},
+		entry{name: "app/copy.yaml", typeflag: tar.TypeLink, linkname: "app/Chart.yaml"},
+		entry{name: "app/device", typeflag: tar.TypeChar},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"app/Chart.yaml":                "name: app\n",
+		"app/templates/deployment.yaml": "kind: Deployment\n",
+		"app/values.yaml":               "name: app\n",
+		"app/copy.yaml":                 "name: app\n",
+	}
+	for name, body := range expected {
+		actual, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if string(actual) != body {
+			t.Errorf("%s: expected %q, got %q", name, body, actual)
+		}
+	}
+
+	if info, err := os.Lstat(filepath.Join(dst, "app/copy.yaml")); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("expected the hard link to be extracted as a regular file, got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "app/device")); !os.IsNotExist(err) {
+		t.Errorf("expected the device to be skipped, got %v", err)
+	}
+}
+
+func TestUntarRejects(t *testing.T) {
+	defer func(file, total int64) { UntarMaxFileSize, UntarMaxSize = file, total }(UntarMaxFileSize, UntarMaxSize)
+	UntarMaxFileSize, UntarMaxSize = 10, 15
+
+	tests := []struct {
+		name     string
+		entries  []entry
+		expected string
+	}{
+		{
+			name:     "parent directory",
+			entries:  []entry{{name: "../evil", typeflag: tar.TypeReg, body: "x"}},
+			expected: "outside of the destination",
+		},
+		{
+			name:     "nested parent directory",
+			entries:  []entry{{name: "app/../../evil", typeflag: tar.TypeReg, body: "x"}},
+			expected: "outside of the destination",
+		},
+		{
+			name:     "absolute path",
+			entries:  []entry{{name: "/tmp/evil", typeflag: tar.TypeReg, body: "x"}},
+			expected: "absolute path",
+		},
+		{
+			name:     "symlink outside",
+			entries:  []entry{{name: "app/link", typeflag: tar.TypeSymlink, linkname: "../../etc"}},
+			expected: "outside of the destination",
+		},
+		{
+			name: "chained symlinks",
+			entries: []entry{
+				{name: "a/b/c/", typeflag: tar.TypeDir},
+				{name: "a/b/c/d", typeflag: tar.TypeSymlink, linkname: "../../.."},
+				{name: "e", typeflag: tar.TypeSymlink, linkname: "a/b/c/d/../secret"},
+			},
+			expected: "through another symlink",
+		},
+		{
+			name: "chained symlinks extracted later",
+			entries: []entry{
+				{name: "a/b/", typeflag: tar.TypeDir},
+				{name: "e", typeflag: tar.TypeSymlink, linkname: "a/b/x/../../../secret"},
+				{name: "a/b/x", typeflag: tar.TypeSymlink, linkname: ".."},
+			},
+			expected: "through another symlink",
+		},
+		{
+			name:     "absolute symlink",
+			entries:  []entry{{name: "link", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"}},
+			expected: "absolute path",
+		},
+		{
+			name: "write through a symlink",
+			entries: []entry{
+				{name: "sub/", typeflag: tar.TypeDir},
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "sub"},
+				{name: "link/evil", typeflag: tar.TypeReg, body: "x"},
+			},
+			expected: "through the symlink",
+		},
+		{
+			name: "overwrite a symlink",
+			entries: []entry{
+				{name: "file", typeflag: tar.TypeReg, body: "x"},
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "file"},
+				{name: "link", typeflag: tar.TypeReg, body: "y"},
+			},
+			expected: "through the symlink",
+		},
+		{
+			name:     "hard link outside",
+			entries:  []entry{{name: "link", typeflag: tar.TypeLink, linkname: "../../etc/passwd"}},
+			expected: "outside of the destination",
+		},
+		{
+			name:     "hard link to nothing",
+			entries:  []entry{{name: "link", typeflag: tar.TypeLink, linkname: "missing"}},
+			expected: "hasn't been extracted",
+		},
+		{
+			name:     "file too big",
+			entries:  []entry{{name: "big", typeflag: tar.TypeReg, body: strings.Repeat("x", 11)}},
+			expected: "byte limit",
+		},
+		{
+			name: "archive too big",
+			entries: []entry{
+				{name: "a", typeflag: tar.TypeReg, body: strings.Repeat("x", 10)},
+				{name: "b", typeflag: tar.TypeReg, body: strings.Repeat("x", 10)},
+			},
+			expected: "once decompressed",
+		},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "ankh-untar-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Untar(filepath.Join(dir, "a", "dst"), tarball(t, test.entries...))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.expected, err)
+		}
+
+		// nothing may have been written next to the destination
+		for _, path := range []string{filepath.Join(dir, "a", "evil"), filepath.Join(dir, "evil")} {
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				t.Errorf("%s: expected %s not to exist", test.name, path)
+			}
+		}
+
+		os.RemoveAll(dir)
+	}
+}
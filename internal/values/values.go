@@ -0,0 +1,271 @@
+package values
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Layer is one source of values for a chart. Layers are merged in order, so
+// later layers win.
+type Layer struct {
+	// Name says which layer it is, like `values[dev]`
+	Name string
+	// File is where the layer's values were read from
+	File   string
+	Values interface{}
+}
+
+// Origin is where a value in the merged result came from
+type Origin struct {
+	Layer string
+	File  string
+	// Overrides are the layers that set the same value before, most recent
+	// first
+	Overrides []string
+}
+
+func (o Origin) String() string {
+	s := o.Layer
+	if o.File != "" {
+		s += " (" + o.File + ")"
+	}
+	if len(o.Overrides) > 0 {
+		s += ", overrides " + strings.Join(o.Overrides, ", ")
+	}
+	return s
+}
+
+// Merged is the result of merging layers the way helm does: maps are merged
+// key by key, anything else, lists included, replaces what was there, and a
+// null removes the key.
+type Merged struct {
+	Values  map[interface{}]interface{}
+	origins map[string]Origin
+}
+
+// Merge merges layers in order
+func Merge(layers []Layer) (Merged, error) {
+	m := Merged{Values: map[interface{}]interface{}{}, origins: map[string]Origin{}}
+
+	for _, l := range layers {
+		if l.Values == nil {
+			continue
+		}
+		values, ok := normalize(l.Values).(map[interface{}]interface{})
+		if !ok {
+			return m, fmt.Errorf("%s from %s isn't a map of values", l.Name, l.File)
+		}
+		m.merge(m.Values, values, "", l)
+	}
+
+	return m, nil
+}
+
+func (m Merged) merge(dest, src map[interface{}]interface{}, path string, l Layer) {
+	for k, v := range src {
+		p := childPath(path, k)
+		destMap, destIsMap := dest[k].(map[interface{}]interface{})
+		srcMap, srcIsMap := v.(map[interface{}]interface{})
+
+		switch {
+		case v == nil:
+			delete(dest, k)
+			m.forget(p)
+		case destIsMap && srcIsMap:
+			m.merge(destMap, srcMap, p, l)
+		default:
+			overrides := m.overridden(p)
+			m.forget(p)
+			dest[k] = v
+			m.set(v, p, l, overrides)
+		}
+	}
+}
+
+// set records l as the origin of v and everything under it
+func (m Merged) set(v interface{}, path string, l Layer, overrides []string) {
+	if x, ok := v.(map[interface{}]interface{}); ok && len(x) > 0 {
+		for k, child := range x {
+			m.set(child, childPath(path, k), l, overrides)
+		}
+		return
+	}
+	m.origins[path] = Origin{Layer: l.Name, File: l.File, Overrides: overrides}
+}
+
+// overridden returns the layers that set anything at or under path, newest
+// first
+func (m Merged) overridden(path string) []string {
+	seen := map[string]bool{}
+	layers := []string{}
+	for _, p := range m.under(path) {
+		o := m.origins[p]
+		for _, name := range append([]string{o.Layer}, o.Overrides...) {
+			if !seen[name] {
+				seen[name] = true
+				layers = append(layers, name)
+			}
+		}
+	}
+	return layers
+}
+
+func (m Merged) forget(path string) {
+	for _, p := range m.under(path) {
+		delete(m.origins, p)
+	}
+}
+
+func (m Merged) under(path string) []string {
+	paths := []string{}
+	for p := range m.origins {
+		if p == path || strings.HasPrefix(p, path+pathSeparator) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Origin returns where the value at a path of keys came from
+func (m Merged) Origin(keys ...string) (Origin, bool) {
+	path := ""
+	for _, k := range keys {
+		path = childPath(path, k)
+	}
+	o, ok := m.origins[path]
+	return o, ok
+}
+
+// Sources returns where the value at a path of keys came from. Keys that
+// go into a list, or past the end of the values, give the origin of the
+// value that holds them, and a map gives the origins of everything in it.
+func (m Merged) Sources(keys ...string) []Origin {
+	for n := len(keys); n > 0; n-- {
+		if o, ok := m.Origin(keys[:n]...); ok {
+			return []Origin{o}
+		}
+	}
+
+	path := ""
+	for _, k := range keys {
+		path = childPath(path, k)
+	}
+	origins := []Origin{}
+	seen := map[string]bool{}
+	for _, p := range m.under(path) {
+		o := m.origins[p]
+		if id := o.Layer + "\x00" + o.File; !seen[id] {
+			seen[id] = true
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
+
+// pathSeparator can't appear in a YAML key that anyone would write
+const pathSeparator = "\x00"
+
+func childPath(path string, key interface{}) string {
+	if path == "" {
+		return fmt.Sprint(key)
+	}
+	return path + pathSeparator + fmt.Sprint(key)
+}
+
+// YAML renders the merged values. With explain set every value is followed
+// by a comment saying which layer set it.
+func (m Merged) YAML(explain bool) (string, error) {
+	var buf bytes.Buffer
+	if err := m.render(&buf, m.Values, "", "", explain); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (m Merged) render(buf *bytes.Buffer, x map[interface{}]interface{}, path, indent string, explain bool) error {
+	keys := make([]interface{}, 0, len(x))
+	for k := range x {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+
+	for _, k := range keys {
+		p := childPath(path, k)
+		key, err := marshal(k)
+		if err != nil {
+			return err
+		}
+
+		if child, ok := x[k].(map[interface{}]interface{}); ok && len(child) > 0 {
+			fmt.Fprintf(buf, "%s%s:\n", indent, key)
+			if err := m.render(buf, child, p, indent+"  ", explain); err != nil {
+				return err
+			}
+			continue
+		}
+
+		comment := ""
+		if o, ok := m.origins[p]; ok && explain {
+			comment = "  # " + o.String()
+		}
+
+		value, err := marshal(x[k])
+		if err != nil {
+			return err
+		}
+		lines := strings.Split(value, "\n")
+
+		// lists start on the line after their key, block strings carry on
+		// after it
+		if list, ok := x[k].([]interface{}); ok && len(list) > 0 {
+			fmt.Fprintf(buf, "%s%s:%s\n", indent, key, comment)
+		} else {
+			fmt.Fprintf(buf, "%s%s: %s%s\n", indent, key, lines[0], comment)
+			lines = lines[1:]
+		}
+		for _, line := range lines {
+			fmt.Fprintf(buf, "%s%s\n", indent, line)
+		}
+	}
+	return nil
+}
+
+func marshal(v interface{}) (string, error) {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// normalize turns the map[string]interface{} maps that come from ankh files
+// into the map[interface{}]interface{} ones that come from values files so
+// they merge with each other
+func normalize(x interface{}) interface{} {
+	switch x := x.(type) {
+	case map[string]interface{}:
+		out := make(map[interface{}]interface{}, len(x))
+		for k, v := range x {
+			out[k] = normalize(v)
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(x))
+		for k, v := range x {
+			out[k] = normalize(v)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, v := range x {
+			out[i] = normalize(v)
+		}
+		return out
+	}
+	return x
+}
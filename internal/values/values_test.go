@@ -0,0 +1,103 @@
+package values
+
+import (
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	layers := []Layer{
+		{Name: "chart", File: "values.yaml", Values: map[interface{}]interface{}{
+			"image":    map[interface{}]interface{}{"repo": "web", "tag": "latest"},
+			"ports":    []interface{}{80},
+			"debug":    true,
+			"resource": "small",
+		}},
+		{Name: "default_values", File: "ankh.yaml", Values: map[string]interface{}{
+			"image": map[string]interface{}{"tag": "v1"},
+			"ports": []interface{}{80, 443},
+			"debug": nil,
+		}},
+		{Name: "values[dev]", File: "ankh.yaml", Values: nil},
+		{Name: "ankh-values.yaml[dev]", File: "charts/web/ankh-values.yaml", Values: map[interface{}]interface{}{
+			"image":    map[interface{}]interface{}{"tag": "dev"},
+			"resource": map[interface{}]interface{}{"cpu": 1},
+		}},
+	}
+
+	m, err := Merge(layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := m.YAML(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `image:
+  repo: web
+  tag: dev
+ports:
+- 80
+- 443
+resource:
+  cpu: 1
+`
+	if out != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out)
+	}
+
+	origins := []struct {
+		keys     []string
+		expected string
+	}{
+		{[]string{"image", "repo"}, "chart (values.yaml)"},
+		{[]string{"image", "tag"}, "ankh-values.yaml[dev] (charts/web/ankh-values.yaml), overrides default_values, chart"},
+		{[]string{"ports"}, "default_values (ankh.yaml), overrides chart"},
+		{[]string{"resource", "cpu"}, "ankh-values.yaml[dev] (charts/web/ankh-values.yaml), overrides chart"},
+	}
+	for _, test := range origins {
+		o, ok := m.Origin(test.keys...)
+		if !ok || o.String() != test.expected {
+			t.Errorf("expected %v to come from %q, got %q", test.keys, test.expected, o)
+		}
+	}
+	if _, ok := m.Origin("debug"); ok {
+		t.Error("expected a removed value to have no origin")
+	}
+
+	if _, err := Merge([]Layer{{Name: "values[dev]", File: "ankh.yaml", Values: []interface{}{"a"}}}); err == nil {
+		t.Error("expected an error merging a list as a layer")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	m, err := Merge([]Layer{
+		{Name: "chart", File: "values.yaml", Values: map[interface{}]interface{}{
+			"config": "line one\nline two\n",
+			"hosts":  []interface{}{map[interface{}]interface{}{"name": "a", "port": 80}},
+			"empty":  map[interface{}]interface{}{},
+		}},
+		{Name: "global", Values: map[string]interface{}{"global": map[string]interface{}{"cluster": "test"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := m.YAML(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `config: |  # chart (values.yaml)
+  line one
+  line two
+empty: {}  # chart (values.yaml)
+global:
+  cluster: test  # global
+hosts:  # chart (values.yaml)
+- name: a
+  port: 80
+`
+	if out != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package workdir
+
+// Without flock, MinAge is all that keeps GC from removing the working
+// directories of runs going in other processes
+
+func lock(dir string) error {
+	return nil
+}
+
+func unlock(dir string) {}
+
+func inUse(dir string) bool {
+	return false
+}
@@ -0,0 +1,56 @@
+//go:build unix
+
+package workdir
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// held keeps the lock files of this process open. The kernel drops the locks
+// when the process exits, however it exits.
+var held = map[string]*os.File{}
+var heldMu sync.Mutex
+
+func lock(dir string) error {
+	f, err := os.OpenFile(filepath.Join(dir, LockFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return err
+	}
+
+	heldMu.Lock()
+	defer heldMu.Unlock()
+	held[filepath.Clean(dir)] = f
+	return nil
+}
+
+func unlock(dir string) {
+	heldMu.Lock()
+	defer heldMu.Unlock()
+	if f, ok := held[filepath.Clean(dir)]; ok {
+		f.Close()
+		delete(held, filepath.Clean(dir))
+	}
+}
+
+// inUse reports whether a run still holds the lock of dir. Directories
+// without a lock file are from older versions of ankh and never in use.
+func inUse(dir string) bool {
+	f, err := os.Open(filepath.Join(dir, LockFile))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		return true
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return false
+}
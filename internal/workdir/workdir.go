@@ -0,0 +1,130 @@
+package workdir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DefaultMaxAge and DefaultMaxCount are how long, and how many of, the
+// working directories of failed runs are kept around for debugging
+const DefaultMaxAge = 7 * 24 * time.Hour
+const DefaultMaxCount = 10
+
+// MinAge protects the working directories of runs that may still be going in
+// another process from MaxCount. MaxAge still applies to them.
+const MinAge = 10 * time.Minute
+
+// Policy decides which working directories GC removes. A zero MaxAge or
+// MaxCount turns that limit off, and a negative MaxAge removes everything.
+type Policy struct {
+	MaxAge   time.Duration
+	MaxCount int
+}
+
+// DefaultPolicy is applied after every run
+var DefaultPolicy = Policy{MaxAge: DefaultMaxAge, MaxCount: DefaultMaxCount}
+
+// Dir is a working directory left behind by a run
+type Dir struct {
+	Path     string
+	Modified time.Time
+}
+
+// LockFile is held by the run a working directory belongs to for as long as
+// it's going
+const LockFile = ".lock"
+
+// Create makes a new working directory for this run under root and locks it,
+// so GC in other processes leaves it alone until this process removes it or
+// exits. Runs started in the same second still get directories of their own.
+func Create(root string) (string, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", err
+	}
+
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		var dir string
+		dir, err = ioutil.TempDir(root, fmt.Sprintf("%d-", time.Now().Unix()))
+		if err != nil {
+			return "", err
+		}
+
+		// GC in another process may have removed the directory before it
+		// was locked, in which case there's nothing to clean up
+		if err = lock(dir); err == nil {
+			return dir, nil
+		}
+		os.RemoveAll(dir)
+	}
+	return "", err
+}
+
+// Remove deletes the working directory of a run once it's done with it
+func Remove(dir string) error {
+	unlock(dir)
+	return os.RemoveAll(dir)
+}
+
+// GC removes the working directories under root that are older than the
+// policy's MaxAge, then all but the newest MaxCount of what's left. The
+// directory named by current, which belongs to this run, and the ones locked
+// by runs still going in other processes are never removed.
+func GC(root, current string, policy Policy) ([]Dir, error) {
+	dirs, err := List(root)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []Dir{}
+	kept := 0
+	for _, d := range dirs {
+		if filepath.Clean(d.Path) == filepath.Clean(current) || inUse(d.Path) {
+			continue
+		}
+
+		age := time.Since(d.Modified)
+		expired := policy.MaxAge < 0 || (policy.MaxAge > 0 && age > policy.MaxAge)
+		overCount := policy.MaxCount > 0 && kept >= policy.MaxCount && age > MinAge
+		if !expired && !overCount {
+			kept++
+			continue
+		}
+
+		if err := os.RemoveAll(d.Path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, d)
+	}
+
+	return removed, nil
+}
+
+// List returns the working directories under root, newest first
+func List(root string) ([]Dir, error) {
+	infos, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return []Dir{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := []Dir{}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		dirs = append(dirs, Dir{Path: filepath.Join(root, info.Name()), Modified: info.ModTime()})
+	}
+
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return dirs[i].Modified.After(dirs[j].Modified)
+	})
+
+	return dirs, nil
+}
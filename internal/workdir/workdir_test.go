@@ -0,0 +1,134 @@
+package workdir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGC(t *testing.T) {
+	root, err := ioutil.TempDir("", "ankh-workdir-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// run dirs named by how many hours ago they were last touched
+	now := time.Now()
+	mkdirs := func(names ...string) {
+		for _, name := range names {
+			path := filepath.Join(root, name)
+			if err := os.MkdirAll(filepath.Join(path, "chart"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			hours, _ := strconv.Atoi(strings.TrimPrefix(name, "h"))
+			modified := now.Add(-time.Duration(hours) * time.Hour)
+			if err := os.Chtimes(path, modified, modified); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	names := func(dirs []Dir) string {
+		s := []string{}
+		for _, d := range dirs {
+			s = append(s, filepath.Base(d.Path))
+		}
+		return strings.Join(s, " ")
+	}
+
+	mkdirs("h0", "h1", "h2", "h3", "h200")
+	if err := ioutil.WriteFile(filepath.Join(root, "stray-file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dirs, err := List(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := names(dirs); actual != "h0 h1 h2 h3 h200" {
+		t.Errorf("expected the dirs newest first, got %s", actual)
+	}
+
+	// h200 is too old, and only two of the rest are kept. h0 is the
+	// current run and is never touched.
+	removed, err := GC(root, filepath.Join(root, "h0"), Policy{MaxAge: 100 * time.Hour, MaxCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := names(removed); actual != "h3 h200" {
+		t.Errorf("expected h3 and h200 to be removed, got %s", actual)
+	}
+
+	dirs, _ = List(root)
+	if actual := names(dirs); actual != "h0 h1 h2" {
+		t.Errorf("unexpected dirs left %s", actual)
+	}
+
+	// a fresh dir may belong to a run in another process, so the count
+	// doesn't remove it
+	mkdirs("h5")
+	os.Chtimes(filepath.Join(root, "h1"), now, now)
+	removed, err = GC(root, "", Policy{MaxCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := names(removed); actual != "h2 h5" {
+		t.Errorf("expected h2 and h5 to be removed, got %s", actual)
+	}
+
+	removed, err = GC(root, "", Policy{MaxAge: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := names(removed); actual != "h0 h1" && actual != "h1 h0" {
+		t.Errorf("expected everything to be removed, got %s", actual)
+	}
+
+	if dirs, err := List(filepath.Join(root, "missing")); err != nil || len(dirs) != 0 {
+		t.Errorf("expected no dirs for a missing root, got %v, %v", dirs, err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	root, err := ioutil.TempDir("", "ankh-workdir-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// runs started in the same second get directories of their own
+	first, err := Create(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Create(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("expected two directories, got %s twice", first)
+	}
+
+	// neither is removed while its run is going, whatever the policy
+	removed, err := GC(root, first, Policy{MaxAge: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("expected the live directories to be kept, removed %v", removed)
+	}
+
+	if err := Remove(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(second); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", second, err)
+	}
+	if _, err := os.Stat(first); err != nil {
+		t.Errorf("expected %s to be left alone, got %v", first, err)
+	}
+}